@@ -1,6 +1,7 @@
 package bot
 
 import (
+	"errors"
 	"log"
 	"regexp"
 	"strconv"
@@ -8,28 +9,56 @@ import (
 	"text/template"
 	"time"
 
+	"github.com/asdine/storm/v3"
 	"github.com/w32blaster/shortana/db"
 	"github.com/w32blaster/shortana/geoip"
+	"github.com/w32blaster/shortana/health"
+	"github.com/w32blaster/shortana/qr"
+	"github.com/w32blaster/shortana/retention"
 	"github.com/w32blaster/shortana/stats"
+	"github.com/w32blaster/shortana/suffix"
+	"github.com/w32blaster/shortana/urlcheck"
+	"github.com/w32blaster/shortana/useragent"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
 )
 
-type addingStep int
-
+// steps of dialogs, they are kept in the db.Session
 const (
 	None = 1 + iota
 	RequestedShortenedUrl
 	RequestedTargetLink
 	RequestedDescription
 	RequestedButtonIsPrivateOrPublic
+	RequestedRedirectType
+	RequestedExpiryDate
+	RequestedMaxClicks
+	RequestedUTM
+	RequestedConfirmation
+	RequestedEditField
+	RequestedEditTarget
+	RequestedEditDescription
+	RequestedEditSuffix
+	RequestedPassword
+	RequestedRules
+	RequestedVariants
 
 	public                = "p"
-	ButtonDeleteMsgPrefix = "dM" // for button "delete message"
-	ButtonUpdateMsgPrefix = "uM" // for button "update message"
-	ButtonDeleteURL       = "dU" // for button "delete URL"
-	ButtonCancelDelete    = "dc" // cancel delete
+	ButtonSkip            = "skip" // for button "skip this optional step"
+	ButtonDeleteMsgPrefix = "dM"   // for button "delete message"
+	ButtonUpdateMsgPrefix = "uM"   // for button "update message"
+	ButtonDeleteURL       = "dU"   // for button "delete URL"
+	ButtonCancelDelete    = "dc"   // cancel delete
+	ButtonRedirectType    = "rt"   // for buttons "redirect type"
+	ButtonClearRules      = "cr"   // for button "remove all the redirect rules"
+	ButtonClearVariants   = "cv"   // for button "stop the A/B split"
+	ButtonSaveDraft       = "sv"   // for button "save the new link"
+	ButtonDiscardDraft    = "dd"   // for button "don't save the new link"
+	ButtonEditField       = "ed"   // for buttons "change this field of the link"
+	ButtonGenerateSuffix  = "gs"   // for button "generate the short URL"
 	Separator             = "#"
+
+	maxMessageLength = 4096 // Telegram doesn't accept longer messages
 )
 
 var (
@@ -37,6 +66,15 @@ var (
 	patternCommandStatsForURLOneDay = regexp.MustCompile(`^stats(\d+)x(\d{8})$`)
 	patternCommandStatsOneView      = regexp.MustCompile(`^stats(\d+)x(\d{8})x(\d+)$`)
 	patternCommandStatsView         = regexp.MustCompile(`^(view)(\d+)$`)
+	patternCommandPassword          = regexp.MustCompile(`^password(\d+)$`)
+	patternCommandRemovePassword    = regexp.MustCompile(`^nopassword(\d+)$`)
+	patternCommandRedirectType      = regexp.MustCompile(`^redirect(\d+)$`)
+	patternCommandRules             = regexp.MustCompile(`^rules(\d+)$`)
+	patternCommandSplit             = regexp.MustCompile(`^split(\d+)$`)
+	patternCommandPassthrough       = regexp.MustCompile(`^passthrough(\d+)$`)
+	patternCommandQRCode            = regexp.MustCompile(`^qr(\d+)$`)
+	patternCommandEdit              = regexp.MustCompile(`^edit(\d+)$`)
+	patternCommandHealth            = regexp.MustCompile(`^health(\d+)$`)
 
 	funcMap = template.FuncMap{
 		"markdownEscape": markdownEscape,
@@ -49,28 +87,44 @@ var (
 type (
 	StatsForURLOneDay struct {
 		Views        []db.OneViewStatistic
+		Rollups      []db.DailyRollup // what is left of the views older than the retention period
+		Referrers    []db.ReferrerStatistics
 		ShortURL     db.ShortURL
 		SelectedDate string
 	}
 
+	RetentionData struct {
+		Report      db.RollupReport
+		Days        int
+		RollupEvery string
+	}
+
 	StatsGroupedByURLData struct {
 		Stats    map[string]db.OneURLSummaryStatistics
 		Hostname string
+		Dropped  uint64 // views lost since the start, because the statistics queue was full
 	}
 
 	StatsForOneURL struct {
-		Stats    map[string]db.OneDaySummaryStatistics
-		ShortURL db.ShortURL
+		Stats     map[string]db.OneDaySummaryStatistics
+		Variants  []db.VariantSummaryStatistics
+		Referrers []db.ReferrerStatistics // for the whole time
+		Clients   *db.ClientBreakdown     // for the whole time
+		ShortURL  db.ShortURL
 	}
 
 	Command struct {
-		db               *db.Database
-		bot              *tgbotapi.BotAPI
-		hostname         string
-		stats            *stats.Statistics
-		geoIP            *geoip.GeoIP
-		step             addingStep // when we start a dialog to add a new data, we should remember step for it
-		halfSavedShortID string     // short URL saved in DB with half filled data in it
+		db           *db.Database
+		bot          *tgbotapi.BotAPI
+		hostname     string
+		stats        *stats.Statistics
+		geoIP        *geoip.GeoIP
+		suffixes     suffix.Generator
+		suffixPolicy suffix.Policy
+		targets      urlcheck.Checker
+		linkChecker  *health.Checker
+		retention    retention.Policy
+		rollupEvery  time.Duration
 	}
 )
 
@@ -86,6 +140,8 @@ func (c *Command) ProcessCommands(message *tgbotapi.Message) {
 	command := extractCommand(message.Command())
 	log.Println("This is command /" + command)
 
+	session := c.loadSession(chatID, message.From.ID)
+
 	switch command {
 
 	case "start":
@@ -95,7 +151,29 @@ func (c *Command) ProcessCommands(message *tgbotapi.Message) {
 		renderShortenedURLsList(c.bot, chatID, c.db, c.hostname)
 
 	case "add":
-		c.initiateAdding(chatID)
+		c.initiateAdding(session)
+
+	case "incomplete":
+		c.renderIncompleteLinks(chatID)
+
+	case "health":
+		c.renderLinksHealth(chatID)
+
+	case "bots":
+		c.toggleIncludeBots(chatID)
+
+	case "rebuildstats":
+		c.rebuildCounters(chatID)
+
+	case "retention":
+		c.renderRetentionDryRun(chatID)
+
+	case "cancel":
+		if session.Step == None {
+			sendEscMsg(c.bot, chatID, "There is nothing to cancel")
+			return
+		}
+		c.cancelDialog(session, "Ok, cancelled")
 
 	case "download":
 		fnOnUpdate := func(msg string) {
@@ -124,6 +202,51 @@ func (c *Command) ProcessCommands(message *tgbotapi.Message) {
 			return
 		}
 
+		if patternCommandPassword.MatchString(command) {
+			c.initiateSettingPassword(session, command)
+			return
+		}
+
+		if patternCommandRemovePassword.MatchString(command) {
+			c.removePassword(chatID, command)
+			return
+		}
+
+		if patternCommandRedirectType.MatchString(command) {
+			c.askRedirectType(chatID, command)
+			return
+		}
+
+		if patternCommandRules.MatchString(command) {
+			c.initiateSettingRules(session, command)
+			return
+		}
+
+		if patternCommandSplit.MatchString(command) {
+			c.initiateSettingVariants(session, command)
+			return
+		}
+
+		if patternCommandPassthrough.MatchString(command) {
+			c.togglePassthrough(chatID, command)
+			return
+		}
+
+		if patternCommandQRCode.MatchString(command) {
+			c.sendQRCode(chatID, command)
+			return
+		}
+
+		if patternCommandEdit.MatchString(command) {
+			c.initiateEditing(session, command)
+			return
+		}
+
+		if patternCommandHealth.MatchString(command) {
+			c.checkLinkHealth(chatID, command)
+			return
+		}
+
 		sendEscMsg(c.bot, chatID, "Sorry, I don't recognyze such command: "+command+", please call /help to get full list of commands I understand")
 
 	}
@@ -155,61 +278,597 @@ func (c *Command) renderStats(command string, chatID int64, messageIDtoReplace s
 	}
 }
 
-// initiate process of adding a new short URL, this process consists of few steps, so we keep state inside
-// internal variable "step"
-func (c *Command) initiateAdding(chatID int64) {
-	c.step = RequestedShortenedUrl
-	sendEscMsg(c.bot, chatID, "Ok, can you send me the short url please? Send me just suffix without a hostname")
+// initiate process of adding a new short URL, this process consists of few steps, so we keep the new link
+// as a draft inside the session of this user. The link is saved only when user confirms it
+func (c *Command) initiateAdding(session *db.Session) {
+	session.Draft = db.ShortURL{}
+	c.setStep(session, RequestedShortenedUrl, "")
+	resp, _ := sendEscMsg(c.bot, session.ChatID, "Ok, can you send me the short url please? Send me just suffix without a hostname "+
+		"or press the button and I will make it up")
+	renderGenerateSuffixButton(c.bot, session.ChatID, resp.MessageID)
+}
+
+// checks the suffix sent by user, the link with the given ID is allowed to keep its own suffix
+func (c *Command) validateSuffix(text string, linkID int) error {
+	if err := c.suffixPolicy.Validate(text); err != nil {
+		return err
+	}
+	if existing, err := c.db.FindUrl(text, c.suffixPolicy.IgnoreCase); err == nil && existing.ID != linkID {
+		return errors.New("the short URL '" + text + "' already exists")
+	}
+	return nil
+}
+
+// returns TRUE if the generated suffix can't be used
+func (c *Command) isSuffixUnavailable(text string) bool {
+	return c.suffixPolicy.Validate(text) != nil || c.db.IsShortUrlTaken(text, c.suffixPolicy.IgnoreCase)
+}
+
+// generates the suffix of the new link. If the suffix depends on the target URL, then the draft is left without
+// suffix and it will be generated as soon as the target URL is received
+func (c *Command) generateSuffix(session *db.Session) {
+	chatID := session.ChatID
+	if !c.suffixes.NeedsTarget() || len(session.Draft.TargetUrl) > 0 {
+		generated, err := c.suffixes.Generate(session.Draft.TargetUrl, c.isSuffixUnavailable)
+		if err != nil {
+			log.Println("Can't generate a short URL, error " + err.Error())
+			sendEscMsg(c.bot, chatID, "Sorry, I couldn't make up a free short URL. Can you send me one please?")
+			return
+		}
+		session.Draft.ShortUrl = generated
+	}
+
+	if len(session.Draft.TargetUrl) > 0 {
+		return
+	}
+
+	c.setStep(session, RequestedTargetLink, "")
+	if len(session.Draft.ShortUrl) > 0 {
+		sendEscMsg(c.bot, chatID, "Your short URL is "+c.hostname+"/"+session.Draft.ShortUrl+
+			". Now can you send me the full target URL where the short URL will lead to?")
+	} else {
+		sendEscMsg(c.bot, chatID, "Ok, the short URL will be made from the target URL. "+
+			"Can you send me the full target URL where the short URL will lead to?")
+	}
 }
 
 func (c *Command) ProcessSimpleText(bot *tgbotapi.BotAPI, message *tgbotapi.Message) {
 	chatID := message.Chat.ID
-	switch c.step {
+	session := c.loadSession(chatID, message.From.ID)
+	switch session.Step {
 
 	// Step 1: requested the Short URL
 	case RequestedShortenedUrl:
-		if err := c.db.SaveShortUrlObject(&db.ShortURL{ShortUrl: message.Text, IsPublic: false}); err != nil {
-			c.step = None
-			sendEscMsg(c.bot, chatID, "Sorry, I tried to save your short URL but failed. "+
-				"Can you start from beginning please?")
-			log.Println("Failed to save a new short link, error " + err.Error())
+		if err := c.validateSuffix(message.Text, 0); err != nil {
+			sendEscMsg(c.bot, chatID, "Sorry, "+err.Error()+". Can you send me another one please?")
 			return
 		}
-		c.halfSavedShortID = message.Text
-		c.step = RequestedTargetLink
+
+		session.Draft.ShortUrl = message.Text
+		c.setStep(session, RequestedTargetLink, "")
 		sendEscMsg(c.bot, chatID, "Ok, can you send me the full target URL where the short URL will lead to?")
 
-	// step 2: a new short URL is saved with only one value and a target link was requested
+	// step 2: the suffix is in the draft and a target link was requested
 	case RequestedTargetLink:
 
-		if len(message.Text) == 0 || !strings.HasPrefix(message.Text, "http") {
-			sendEscMsg(c.bot, chatID, "Incorrect value, please send me the full URL link, please")
+		targetUrl := strings.TrimSpace(message.Text)
+		if err := c.targets.Check(targetUrl); err != nil {
+			sendEscMsg(c.bot, chatID, "Sorry, "+err.Error()+". Can you send me another one please?")
 			return
 		}
 
-		if err := c.db.UpdateShortUrl(c.halfSavedShortID, "TargetUrl", message.Text); err != nil {
-			sendEscMsg(c.bot, chatID, "Sorry, can't update TargetURL "+
-				"Can you send me once again please?")
-			log.Println("Failed to update a short link, error " + err.Error())
-			return
+		session.Draft.TargetUrl = targetUrl
+		if len(session.Draft.ShortUrl) == 0 {
+			c.generateSuffix(session)
+			if len(session.Draft.ShortUrl) == 0 {
+				session.Draft.TargetUrl = ""
+				c.setStep(session, RequestedShortenedUrl, "")
+				return
+			}
+			sendEscMsg(c.bot, chatID, "Your short URL is "+c.hostname+"/"+session.Draft.ShortUrl)
 		}
 
-		c.step = RequestedDescription
+		c.setStep(session, RequestedDescription, "")
 		sendEscMsg(c.bot, chatID, "Nice one. Now send me the description, please?")
 
 	// step 3: description
 	case RequestedDescription:
-		if err := c.db.UpdateShortUrl(c.halfSavedShortID, "Description", message.Text); err != nil {
-			sendEscMsg(c.bot, chatID, "Sorry, can't update Description "+
+		session.Draft.Description = message.Text
+		c.setStep(session, RequestedButtonIsPrivateOrPublic, "")
+		resp, _ := sendEscMsg(c.bot, chatID, "Nice one. Is it public or private?")
+		renderPublicPrivateButtons(c.bot, chatID, resp.MessageID)
+
+	// step 5 (optional): expiry date
+	case RequestedExpiryDate:
+		expiresAt, err := parseExpiryDate(message.Text, time.Now())
+		if err != nil {
+			sendEscMsg(c.bot, chatID, "Sorry, "+err.Error()+". Please send me the date like 2021-01-31 or 2021-01-31 18:00 (UTC)")
+			return
+		}
+
+		session.Draft.ExpiresAt = expiresAt
+		c.requestMaxClicks(session)
+
+	// step 6 (optional): how many times the link can be followed
+	case RequestedMaxClicks:
+		maxClicks, err := strconv.Atoi(strings.TrimSpace(message.Text))
+		if err != nil || maxClicks <= 0 {
+			sendEscMsg(c.bot, chatID, "Incorrect value, please send me a positive number")
+			return
+		}
+
+		session.Draft.MaxClicks = maxClicks
+		c.requestUTM(session)
+
+	// step 7 (optional): UTM tags added to the target URL
+	case RequestedUTM:
+		tags, err := parseUTM(message.Text)
+		if err != nil {
+			sendEscMsg(c.bot, chatID, "Sorry, "+err.Error()+". Can you send me the tags once again please?")
+			return
+		}
+
+		session.Draft.UTM = tags
+		c.requestConfirmation(session)
+
+	// new value for the link being edited
+	case RequestedEditTarget, RequestedEditDescription, RequestedEditSuffix:
+		c.applyEditValue(session, message.Text)
+
+	// the password for a protected link
+	case RequestedPassword:
+
+		// don't leave the password in the chat history
+		c.bot.Send(tgbotapi.NewDeleteMessage(chatID, message.MessageID))
+
+		// the empty hash means "no password", so a sticker or a photo must not remove the protection;
+		// the password is removed only by /nopassword<ID>
+		if len(strings.TrimSpace(message.Text)) == 0 {
+			sendEscMsg(c.bot, chatID, "Sorry, the password can't be empty, can you send me the password as text please?")
+			return
+		}
+
+		hash, err := db.HashPassword(message.Text)
+		if err != nil {
+			sendEscMsg(c.bot, chatID, "Sorry, can't use this password, can you send me another one please?")
+			log.Println("Failed to hash a password, error " + err.Error())
+			return
+		}
+
+		if err := c.db.UpdateShortUrl(session.ShortUrl, "PasswordHash", hash); err != nil {
+			sendEscMsg(c.bot, chatID, "Sorry, can't save the password. "+
 				"Can you send me once again please?")
 			log.Println("Failed to update a short link, error " + err.Error())
 			return
 		}
 
-		c.step = RequestedButtonIsPrivateOrPublic
-		resp, _ := sendEscMsg(c.bot, chatID, "Nice one. Is it public or private?")
-		renderPublicPrivateButtons(c.bot, chatID, resp.MessageID)
+		sendEscMsg(c.bot, chatID, "Done, the link '"+session.ShortUrl+"' is protected with the password now")
+		c.endSession(session)
+
+	// redirect rules for existing link, they replace all the existing rules
+	case RequestedRules:
+		rules, err := parseRules(message.Text, c.targets)
+		if err != nil {
+			sendEscMsg(c.bot, chatID, "Sorry, "+err.Error()+". Can you send me the rules once again please?")
+			return
+		}
+
+		if err := c.db.UpdateShortUrl(session.ShortUrl, "Rules", rules); err != nil {
+			sendEscMsg(c.bot, chatID, "Sorry, can't save the rules. "+
+				"Can you send me once again please?")
+			log.Println("Failed to update a short link, error " + err.Error())
+			return
+		}
+
+		sendEscMsg(c.bot, chatID, "Done, the link '"+session.ShortUrl+"' has "+strconv.Itoa(len(rules))+" rules now")
+		c.endSession(session)
+
+	// A/B split for existing link, replaces all the existing variants
+	case RequestedVariants:
+		variants, err := parseVariants(message.Text, c.targets)
+		if err != nil {
+			sendEscMsg(c.bot, chatID, "Sorry, "+err.Error()+". Can you send me the variants once again please?")
+			return
+		}
+
+		if err := c.db.UpdateShortUrl(session.ShortUrl, "Variants", variants); err != nil {
+			sendEscMsg(c.bot, chatID, "Sorry, can't save the variants. "+
+				"Can you send me once again please?")
+			log.Println("Failed to update a short link, error " + err.Error())
+			return
+		}
+
+		sendEscMsg(c.bot, chatID, "Done, visitors of '"+session.ShortUrl+"' are split between "+strconv.Itoa(len(variants))+" variants now")
+		c.endSession(session)
+	}
+}
+
+// shows the A/B split variants of the existing short URL and asks for the new ones, for example /split5
+func (c *Command) initiateSettingVariants(session *db.Session, command string) {
+	chatID := session.ChatID
+	shortUrl, ok := c.findShortUrlFromCommand(chatID, patternCommandSplit, command)
+	if !ok {
+		return
+	}
+
+	current := "There is no split yet, all visitors go to " + shortUrl.TargetUrl
+	if len(shortUrl.Variants) > 0 {
+		current = "Current variants are:\n\n" + formatVariants(shortUrl.Variants)
+	}
+
+	c.setStep(session, RequestedVariants, shortUrl.ShortUrl)
+	resp, _ := sendEscMsg(c.bot, chatID, current+"\n"+
+		"Send me the variants for '"+shortUrl.ShortUrl+"', one variant per line with its weight, for example:\n\n"+
+		"70 https://example.com/landing-a\n"+
+		"30 https://example.com/landing-b\n\n"+
+		"Every visitor always gets the same variant. Redirect rules, if any, are checked before the split.")
+	renderClearVariantsButton(c.bot, chatID, resp.MessageID, shortUrl.ID)
+}
+
+func (c *Command) clearVariants(session *db.Session, messageID int, strShortUrlID string) {
+	chatID := session.ChatID
+	shortUrlID, err := strconv.Atoi(strShortUrlID)
+	if err != nil {
+		sendMsg(c.bot, chatID, "Error parsing short URL ID")
+		return
+	}
+
+	shortUrl, err := c.db.GetUrlByID(shortUrlID)
+	if err != nil {
+		log.Println("can't find short URL, err: " + err.Error())
+		sendMsg(c.bot, chatID, "Cant find this url in a db")
+		return
+	}
+
+	if err := c.db.UpdateShortUrl(shortUrl.ShortUrl, "Variants", []db.Variant{}); err != nil {
+		sendEscMsg(c.bot, chatID, "Sorry, can't stop the split")
+		log.Println("Failed to update a short link, error " + err.Error())
+		return
+	}
+
+	if session.Step == RequestedVariants && session.ShortUrl == shortUrl.ShortUrl {
+		c.endSession(session)
+	}
+
+	// delete buttons
+	c.bot.Send(tgbotapi.NewDeleteMessage(chatID, messageID))
+	sendEscMsg(c.bot, chatID, "Done, the split is stopped and visitors of '"+shortUrl.ShortUrl+"' go to "+shortUrl.TargetUrl+" now")
+}
+
+// shows the redirect rules of the existing short URL and asks for the new ones, for example /rules5
+func (c *Command) initiateSettingRules(session *db.Session, command string) {
+	chatID := session.ChatID
+	shortUrl, ok := c.findShortUrlFromCommand(chatID, patternCommandRules, command)
+	if !ok {
+		return
+	}
+
+	current := "There are no rules yet."
+	if len(shortUrl.Rules) > 0 {
+		current = "Current rules are:\n\n" + formatRules(shortUrl.Rules)
+	}
+
+	c.setStep(session, RequestedRules, shortUrl.ShortUrl)
+	resp, _ := sendEscMsg(c.bot, chatID, current+"\n"+
+		"Send me the new rules for '"+shortUrl.ShortUrl+"', one rule per line, for example:\n\n"+
+		"country=DE,AT,CH https://example.de\n"+
+		"os=iOS https://apps.apple.com/app/id123\n"+
+		"os=Android device=mobile https://play.google.com/store/apps/details?id=com.example\n\n"+
+		"Conditions are os ("+strings.Join(useragent.OperatingSystems, ", ")+"), "+
+		"device ("+strings.Join(useragent.Devices, ", ")+") and country. "+
+		"The first matching rule wins, the rest of visitors go to "+shortUrl.TargetUrl)
+	renderClearRulesButton(c.bot, chatID, resp.MessageID, shortUrl.ID)
+}
+
+func (c *Command) clearRules(session *db.Session, messageID int, strShortUrlID string) {
+	chatID := session.ChatID
+	shortUrlID, err := strconv.Atoi(strShortUrlID)
+	if err != nil {
+		sendMsg(c.bot, chatID, "Error parsing short URL ID")
+		return
+	}
+
+	shortUrl, err := c.db.GetUrlByID(shortUrlID)
+	if err != nil {
+		log.Println("can't find short URL, err: " + err.Error())
+		sendMsg(c.bot, chatID, "Cant find this url in a db")
+		return
+	}
+
+	if err := c.db.UpdateShortUrl(shortUrl.ShortUrl, "Rules", []db.RedirectRule{}); err != nil {
+		sendEscMsg(c.bot, chatID, "Sorry, can't remove the rules")
+		log.Println("Failed to update a short link, error " + err.Error())
+		return
+	}
+
+	if session.Step == RequestedRules && session.ShortUrl == shortUrl.ShortUrl {
+		c.endSession(session)
+	}
+
+	// delete buttons
+	c.bot.Send(tgbotapi.NewDeleteMessage(chatID, messageID))
+	sendEscMsg(c.bot, chatID, "Done, all visitors of '"+shortUrl.ShortUrl+"' go to "+shortUrl.TargetUrl+" now")
+}
+
+// asks for a password for the existing short URL, for example /password5
+func (c *Command) initiateSettingPassword(session *db.Session, command string) {
+	chatID := session.ChatID
+	shortUrl, ok := c.findShortUrlFromCommand(chatID, patternCommandPassword, command)
+	if !ok {
+		return
+	}
+
+	c.setStep(session, RequestedPassword, shortUrl.ShortUrl)
+	sendEscMsg(c.bot, chatID, "Ok, send me the password for '"+shortUrl.ShortUrl+"'. "+
+		"I will delete your message right after I save it")
+}
+
+// removes password from the short URL, for example /nopassword5
+func (c *Command) removePassword(chatID int64, command string) {
+	shortUrl, ok := c.findShortUrlFromCommand(chatID, patternCommandRemovePassword, command)
+	if !ok {
+		return
+	}
+
+	if err := c.db.UpdateShortUrl(shortUrl.ShortUrl, "PasswordHash", ""); err != nil {
+		sendEscMsg(c.bot, chatID, "Sorry, can't remove the password")
+		log.Println("Failed to update a short link, error " + err.Error())
+		return
+	}
+	sendEscMsg(c.bot, chatID, "Done, the link '"+shortUrl.ShortUrl+"' is not protected anymore")
+}
+
+// switches on and off the passthrough of the path and the query string, for example /passthrough5
+func (c *Command) togglePassthrough(chatID int64, command string) {
+	shortUrl, ok := c.findShortUrlFromCommand(chatID, patternCommandPassthrough, command)
+	if !ok {
+		return
+	}
+
+	if err := c.db.UpdateShortUrl(shortUrl.ShortUrl, "Passthrough", !shortUrl.Passthrough); err != nil {
+		sendEscMsg(c.bot, chatID, "Sorry, can't change the passthrough mode")
+		log.Println("Failed to update a short link, error " + err.Error())
+		return
+	}
+
+	if shortUrl.Passthrough {
+		sendEscMsg(c.bot, chatID, "Done, the link '"+shortUrl.ShortUrl+"' ignores the extra path and the query string now")
+		return
+	}
+	sendEscMsg(c.bot, chatID, "Done, the link '"+shortUrl.ShortUrl+"' passes the extra path and the query string to the target now, "+
+		"for example "+c.hostname+"/"+shortUrl.ShortUrl+"/some/page?utm_source=x. "+
+		"If the target already has a query parameter with the same name, then the target value is kept")
+}
+
+// sends QR code of the short URL as a photo, for example /qr5
+func (c *Command) sendQRCode(chatID int64, command string) {
+	shortUrl, ok := c.findShortUrlFromCommand(chatID, patternCommandQRCode, command)
+	if !ok {
+		return
+	}
+
+	fullUrl := c.hostname + "/" + shortUrl.ShortUrl
+	opts, _ := qr.Options{Size: 512}.Normalize()
+	image, err := qr.Render(fullUrl, opts)
+	if err != nil {
+		log.Println("Can't render QR code, error " + err.Error())
+		sendMsg(c.bot, chatID, "Sorry, can't render QR code")
+		return
+	}
+
+	photo := tgbotapi.NewPhotoUpload(chatID, tgbotapi.FileBytes{
+		Name:  shortUrl.ShortUrl + ".png",
+		Bytes: image,
+	})
+	photo.Caption = fullUrl + "\nSVG or other sizes: " + c.hostname + "/qr/" + shortUrl.ShortUrl + "?format=svg&size=1024&level=H"
+	if _, err := c.bot.Send(photo); err != nil {
+		log.Println("Can't send QR code, error " + err.Error())
+	}
+}
+
+// finds short URL by ID taken from the command, such as /password5. The pattern must have only one group for ID
+func (c *Command) findShortUrlFromCommand(chatID int64, pattern *regexp.Regexp, command string) (*db.ShortURL, bool) {
+	shortUrlID, err := extractIDFromCommand(pattern, command)
+	if err != nil {
+		log.Printf("Cant extract ID from the %s command, error is %s", command, err.Error())
+		sendMsg(c.bot, chatID, "Cant parse command")
+		return nil, false
+	}
+
+	shortUrl, err := c.db.GetUrlByID(shortUrlID)
+	if err != nil {
+		log.Println("can't find short URL, err: " + err.Error())
+		sendMsg(c.bot, chatID, "Cant find this url in a db")
+		return nil, false
+	}
+	return shortUrl, true
+}
+
+func (c *Command) requestRedirectType(session *db.Session) {
+	chatID := session.ChatID
+	c.setStep(session, RequestedRedirectType, "")
+	resp, _ := sendEscMsg(c.bot, chatID, "How should I redirect visitors? "+
+		"Permanent redirect (301, 308) is cached by browsers forever, so repeated visits are not counted")
+
+	// the draft has no ID yet, so zero is used instead
+	renderRedirectTypeButtons(c.bot, chatID, resp.MessageID, 0)
+}
+
+// asks to choose the redirect type for existing short URL, for example /redirect5
+func (c *Command) askRedirectType(chatID int64, command string) {
+	shortUrl, ok := c.findShortUrlFromCommand(chatID, patternCommandRedirectType, command)
+	if !ok {
+		return
+	}
+
+	resp, _ := sendEscMsg(c.bot, chatID, "How should I redirect visitors of '"+shortUrl.ShortUrl+"'? "+
+		"Current value is "+redirectTypeName(shortUrl.RedirectType))
+	renderRedirectTypeButtons(c.bot, chatID, resp.MessageID, shortUrl.ID)
+}
+
+func (c *Command) saveRedirectType(session *db.Session, messageID int, strRedirectType, strShortUrlID string) {
+	chatID := session.ChatID
+	redirectType, err := strconv.Atoi(strRedirectType)
+	if err != nil || (redirectType != 0 && !db.IsValidRedirectType(redirectType)) {
+		sendMsg(c.bot, chatID, "Error parsing redirect type")
+		return
+	}
+
+	shortUrlID, err := strconv.Atoi(strShortUrlID)
+	if err != nil {
+		sendMsg(c.bot, chatID, "Error parsing short URL ID")
+		return
+	}
+
+	// we are in the middle of adding a new short URL, so save it to the draft and go to the next step
+	if shortUrlID == 0 {
+		if session.Step != RequestedRedirectType {
+			sendEscMsg(c.bot, chatID, "This link is not being added anymore, please start again with /add")
+			return
+		}
+
+		session.Draft.RedirectType = redirectType
+		c.bot.Send(tgbotapi.NewDeleteMessage(chatID, messageID))
+		c.requestExpiryDate(session)
+		return
+	}
+
+	shortUrl, err := c.db.GetUrlByID(shortUrlID)
+	if err != nil {
+		log.Println("can't find short URL, err: " + err.Error())
+		sendMsg(c.bot, chatID, "Cant find this url in a db")
+		return
+	}
+
+	if err := c.db.UpdateShortUrl(shortUrl.ShortUrl, "RedirectType", redirectType); err != nil {
+		sendEscMsg(c.bot, chatID, "Sorry, can't update the redirect type")
+		log.Println("Failed to update a short link, error " + err.Error())
+		return
+	}
+
+	// delete buttons
+	c.bot.Send(tgbotapi.NewDeleteMessage(chatID, messageID))
+	sendEscMsg(c.bot, chatID, "Done, the link '"+shortUrl.ShortUrl+"' uses "+redirectTypeName(redirectType)+" now")
+}
+
+func (c *Command) requestExpiryDate(session *db.Session) {
+	chatID := session.ChatID
+	c.setStep(session, RequestedExpiryDate, session.ShortUrl)
+	resp, _ := sendEscMsg(c.bot, chatID, "Should the link stop working after some date? "+
+		"Send me the date like 2021-01-31 or 2021-01-31 18:00 (UTC)")
+	renderSkipButton(c.bot, chatID, resp.MessageID, "♾️ Never expires")
+}
+
+func (c *Command) requestMaxClicks(session *db.Session) {
+	chatID := session.ChatID
+	c.setStep(session, RequestedMaxClicks, session.ShortUrl)
+	resp, _ := sendEscMsg(c.bot, chatID, "Should the link stop working after some number of clicks? Send me the number")
+	renderSkipButton(c.bot, chatID, resp.MessageID, "♾️ Unlimited")
+}
+
+func (c *Command) requestUTM(session *db.Session) {
+	chatID := session.ChatID
+	c.setStep(session, RequestedUTM, session.ShortUrl)
+	resp, _ := sendEscMsg(c.bot, chatID, "Should I add UTM tags to the target URL? Send me them like\n\n"+
+		"source=newsletter medium=email campaign=spring_sale\n\n"+
+		"Any of them can be omitted. The tags that are already in the target URL are kept as they are")
+	renderSkipButton(c.bot, chatID, resp.MessageID, "🏷️ No tags")
+}
+
+// shows the draft and asks whether to save it
+func (c *Command) requestConfirmation(session *db.Session) {
+	chatID := session.ChatID
+	c.setStep(session, RequestedConfirmation, "")
+	resp, _ := sendEscMsg(c.bot, chatID, "Here is the new link, should I save it?\n\n"+formatDraft(c.hostname, &session.Draft))
+	renderConfirmationButtons(c.bot, chatID, resp.MessageID)
+}
+
+// here, the draft is confirmed and the new short link is saved in one go
+func (c *Command) finishAdding(session *db.Session) {
+	chatID := session.ChatID
+	draft := session.Draft
+	if err := c.db.SaveShortUrlObject(&draft); err != nil {
+		c.endSession(session)
+		if err == storm.ErrAlreadyExists {
+			sendEscMsg(c.bot, chatID, "Sorry, the short URL '"+draft.ShortUrl+"' was taken meanwhile. "+
+				"Can you start from beginning please?")
+			return
+		}
+		sendEscMsg(c.bot, chatID, "Sorry, I tried to save your short URL but failed. "+
+			"Can you start from beginning please?")
+		log.Println("Failed to save a new short link, error " + err.Error())
+		return
+	}
+
+	c.endSession(session)
+	sendEscMsg(c.bot, chatID, "New Short URL is saved: "+c.hostname+"/"+draft.ShortUrl)
+}
+
+// prints the new link before it is saved
+func formatDraft(hostname string, draft *db.ShortURL) string {
+	var sb strings.Builder
+	sb.WriteString("Short URL: " + hostname + "/" + draft.ShortUrl + "\n")
+	sb.WriteString("Target: " + draft.TargetUrl + "\n")
+	sb.WriteString("Description: " + draft.Description + "\n")
+	sb.WriteString(visibilityName(draft.IsPublic) + "\n")
+	sb.WriteString("Redirect: " + redirectTypeName(draft.RedirectType) + "\n")
+	if !draft.ExpiresAt.IsZero() {
+		sb.WriteString("Expires at: " + draft.ExpiresAt.Format("2006-01-02 15:04") + " UTC\n")
+	}
+	if draft.MaxClicks > 0 {
+		sb.WriteString("Clicks limit: " + strconv.Itoa(draft.MaxClicks) + "\n")
+	}
+	if !draft.UTM.IsEmpty() {
+		sb.WriteString("UTM tags: source=" + draft.UTM.Source + " medium=" + draft.UTM.Medium + " campaign=" + draft.UTM.Campaign + "\n")
 	}
+	return sb.String()
+}
+
+// lists links without the target URL. They could be left by the /add dialog of older versions,
+// which saved the link before the target URL was known
+func (c *Command) renderIncompleteLinks(chatID int64) {
+	links, err := c.db.GetIncompleteLinks()
+	if err != nil {
+		log.Println("Can't get incomplete links, error " + err.Error())
+		sendMsg(c.bot, chatID, "Cant get incomplete links")
+		return
+	}
+
+	if len(links) == 0 {
+		sendEscMsg(c.bot, chatID, "There are no incomplete links, all good")
+		return
+	}
+
+	var sb strings.Builder
+	sb.WriteString(markdownEscape("These links have no target URL, so visitors see the list of public links instead. " +
+		"You can delete them:"))
+	sb.WriteString("\n\n")
+	for _, link := range links {
+		sb.WriteString(markdownEscape(link.ShortUrl))
+		sb.WriteString(" /delete")
+		sb.WriteString(strconv.Itoa(link.ID))
+		sb.WriteString("\n")
+	}
+	sendMsg(c.bot, chatID, sb.String())
+}
+
+// parses expiry date sent by user. A date without time means the link works until the end of that day (UTC)
+func parseExpiryDate(text string, now time.Time) (time.Time, error) {
+	text = strings.TrimSpace(text)
+
+	expiresAt, err := time.Parse("2006-01-02 15:04", text)
+	if err != nil {
+		expiresAt, err = time.Parse(db.DayFormat, text)
+		if err != nil {
+			return time.Time{}, errors.New("I can't understand this date")
+		}
+		expiresAt = expiresAt.Add(24 * time.Hour)
+	}
+
+	if !expiresAt.After(now) {
+		return time.Time{}, errors.New("this date is in the past")
+	}
+	return expiresAt, nil
 }
 
 func (c *Command) ProcessButtonCallback(callbackQuery *tgbotapi.CallbackQuery) {
@@ -219,25 +878,68 @@ func (c *Command) ProcessButtonCallback(callbackQuery *tgbotapi.CallbackQuery) {
 		CallbackQueryID: callbackQuery.ID,
 	})
 
+	session := c.loadSession(callbackQuery.Message.Chat.ID, callbackQuery.From.ID)
+
 	// if that button was "Public" or "Private"
-	if c.step == RequestedButtonIsPrivateOrPublic {
+	if session.Step == RequestedButtonIsPrivateOrPublic {
+		session.Draft.IsPublic = callbackQuery.Data == public
 
-		if err := c.db.UpdateShortUrl(c.halfSavedShortID, "IsPublic", callbackQuery.Data == public); err != nil {
-			sendEscMsg(c.bot, callbackQuery.Message.Chat.ID, "Sorry, can't update short link "+
-				"Can you send me once again please?")
-			log.Println("Failed to update a short link, error " + err.Error())
-			return
-		}
+		// delete buttons
+		msg := tgbotapi.NewDeleteMessage(callbackQuery.Message.Chat.ID, callbackQuery.Message.MessageID)
+		c.bot.Send(msg)
+
+		c.requestRedirectType(session)
+		return
+	}
+
+	// if that button was "Generate" for the short URL
+	if callbackQuery.Data == ButtonGenerateSuffix && session.Step == RequestedShortenedUrl {
+
+		// delete buttons
+		c.bot.Send(tgbotapi.NewEditMessageReplyMarkup(callbackQuery.Message.Chat.ID, callbackQuery.Message.MessageID,
+			tgbotapi.InlineKeyboardMarkup{InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{}}))
+
+		c.generateSuffix(session)
+		return
+	}
 
-		// here, a new short link is ready to be used
-		c.step = None
-		c.halfSavedShortID = ""
+	// if that button was "skip" for one of the optional steps
+	if callbackQuery.Data == ButtonSkip && (session.Step == RequestedExpiryDate || session.Step == RequestedMaxClicks || session.Step == RequestedUTM) {
 
 		// delete buttons
 		msg := tgbotapi.NewDeleteMessage(callbackQuery.Message.Chat.ID, callbackQuery.Message.MessageID)
 		c.bot.Send(msg)
 
-		sendMsg(c.bot, callbackQuery.Message.Chat.ID, "New Short URL is saved")
+		switch session.Step {
+		case RequestedExpiryDate:
+			c.requestMaxClicks(session)
+		case RequestedMaxClicks:
+			c.requestUTM(session)
+		default:
+			c.requestConfirmation(session)
+		}
+		return
+	}
+
+	// if that button was "Save" or "Cancel" for the new link
+	if (callbackQuery.Data == ButtonSaveDraft || callbackQuery.Data == ButtonDiscardDraft) &&
+		(session.Step == RequestedConfirmation || isEditStep(session.Step)) {
+
+		// delete buttons
+		c.bot.Send(tgbotapi.NewEditMessageReplyMarkup(callbackQuery.Message.Chat.ID, callbackQuery.Message.MessageID,
+			tgbotapi.InlineKeyboardMarkup{InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{}}))
+
+		switch {
+		case callbackQuery.Data == ButtonDiscardDraft && isEditStep(session.Step):
+			c.cancelDialog(session, "Ok, the changes are not saved")
+		case callbackQuery.Data == ButtonDiscardDraft:
+			c.cancelDialog(session, "Ok, the link is not saved")
+		case session.Step == RequestedConfirmation:
+			c.finishAdding(session)
+		default:
+			c.saveEdit(session)
+		}
+		return
 	}
 
 	// expected data is "command # date", for example
@@ -254,6 +956,22 @@ func (c *Command) ProcessButtonCallback(callbackQuery *tgbotapi.CallbackQuery) {
 
 		// cancel deleting and remove message
 		c.deleteShortUrlAndStats(callbackQuery.Message.Chat.ID, parts[1], parts[2])
+	} else if parts[0] == ButtonRedirectType {
+
+		// save the chosen redirect type, expected data is "rt # type # short URL ID"
+		c.saveRedirectType(session, callbackQuery.Message.MessageID, parts[1], parts[2])
+	} else if parts[0] == ButtonClearRules {
+
+		// remove all the redirect rules, expected data is "cr # short URL ID"
+		c.clearRules(session, callbackQuery.Message.MessageID, parts[1])
+	} else if parts[0] == ButtonEditField {
+
+		// choose the field to edit, expected data is "ed # field"
+		c.chooseEditField(session, parts[1])
+	} else if parts[0] == ButtonClearVariants {
+
+		// stop the A/B split, expected data is "cv # short URL ID"
+		c.clearVariants(session, callbackQuery.Message.MessageID, parts[1])
 	}
 }
 
@@ -312,15 +1030,31 @@ func (c *Command) getStatisticOneURLOneDay(chatID int64, command string, message
 		return
 	}
 
-	shortURL, statsDay, err := c.db.GetStatisticForOneURLOneDay(shortUrlID, dayDate)
+	shortURL, statsDay, err := c.db.GetStatisticForOneURLOneDay(shortUrlID, dayDate, c.includeBots(chatID))
 	if err != nil {
 		log.Printf("Cant get stats for the short ID=%d from the %s command, error is %s", shortUrlID, command, err.Error())
 		sendMsg(c.bot, chatID, "Cant get stats")
 		return
 	}
 
+	rollups, err := c.db.GetRollupsForOneURLOneDay(shortURL.ShortUrl, dayDate.Format(db.DayFormat), c.includeBots(chatID))
+	if err != nil {
+		log.Printf("Cant get rollups for the short ID=%d from the %s command, error is %s", shortUrlID, command, err.Error())
+		sendMsg(c.bot, chatID, "Cant get stats")
+		return
+	}
+
+	referrers, err := c.db.GetTopReferrers(shortURL.ShortUrl, dayDate.Format(db.DayFormat), c.includeBots(chatID), db.TopReferrersCount)
+	if err != nil {
+		log.Printf("Cant get referrers for the short ID=%d from the %s command, error is %s", shortUrlID, command, err.Error())
+		sendMsg(c.bot, chatID, "Cant get stats")
+		return
+	}
+
 	statsData := StatsForURLOneDay{
 		Views:        statsDay,
+		Rollups:      rollups,
+		Referrers:    referrers,
 		ShortURL:     *shortURL,
 		SelectedDate: dayDate.Format(db.DayFormat),
 	}
@@ -352,16 +1086,40 @@ func (c *Command) getStatisticOneURL(chatID int64, command string, messageIDtoRe
 	}
 
 	// find statistics
-	sURL, views, err := c.db.GetStatisticsForOneURL(shortUrlID)
+	sURL, views, err := c.db.GetStatisticsForOneURL(shortUrlID, c.includeBots(chatID))
 	if err != nil {
 		log.Printf("Cant get statistics for %s command (short ID = %d), error is %s", command, shortUrlID, err.Error())
 		sendMsg(c.bot, chatID, "Cant get statistics")
 		return
 	}
 
+	variants, err := c.db.GetVariantStatisticsForOneURL(shortUrlID, c.includeBots(chatID))
+	if err != nil {
+		log.Printf("Cant get variant statistics for %s command (short ID = %d), error is %s", command, shortUrlID, err.Error())
+		sendMsg(c.bot, chatID, "Cant get statistics")
+		return
+	}
+
+	referrers, err := c.db.GetTopReferrers(sURL.ShortUrl, "", c.includeBots(chatID), db.TopReferrersCount)
+	if err != nil {
+		log.Printf("Cant get referrers for %s command (short ID = %d), error is %s", command, shortUrlID, err.Error())
+		sendMsg(c.bot, chatID, "Cant get statistics")
+		return
+	}
+
+	clients, err := c.db.GetClientBreakdown(sURL.ShortUrl, "", c.includeBots(chatID))
+	if err != nil {
+		log.Printf("Cant get client breakdown for %s command (short ID = %d), error is %s", command, shortUrlID, err.Error())
+		sendMsg(c.bot, chatID, "Cant get statistics")
+		return
+	}
+
 	statsData := StatsForOneURL{
-		Stats:    views,
-		ShortURL: *sURL,
+		Stats:     views,
+		Variants:  variants,
+		Referrers: referrers,
+		Clients:   clients,
+		ShortURL:  *sURL,
 	}
 	output, ok := renderTemplate(c.bot, chatID, "stats.one.url.md", statsData)
 	if !ok {
@@ -377,7 +1135,7 @@ func (c *Command) getStatisticOneURL(chatID int64, command string, messageIDtoRe
 
 func (c *Command) printStatisticSummary(chatID int64, messageIDtoReplace int) {
 
-	stats, err := c.db.GetAllStatisticsGroupedByURLs()
+	stats, err := c.db.GetAllStatisticsGroupedByURLs(c.includeBots(chatID))
 	if err != nil {
 		log.Printf("Error getting grouped stats, err is %s", err.Error())
 		sendMsg(c.bot, chatID, "Error getting grouped stats")
@@ -387,6 +1145,7 @@ func (c *Command) printStatisticSummary(chatID int64, messageIDtoReplace int) {
 	statsData := StatsGroupedByURLData{
 		Stats:    stats,
 		Hostname: c.hostname,
+		Dropped:  c.stats.Dropped(),
 	}
 	output, ok := renderTemplate(c.bot, chatID, "stats.md", statsData)
 	if !ok {
@@ -401,6 +1160,77 @@ func (c *Command) printStatisticSummary(chatID int64, messageIDtoReplace int) {
 	}
 }
 
+// returns TRUE if views of bots should be shown in the statistics of this chat
+func (c *Command) includeBots(chatID int64) bool {
+	settings, err := c.db.GetChatSettings(chatID)
+	if err != nil {
+		log.Println("Can't get chat settings, error " + err.Error())
+		return false
+	}
+	return settings.IncludeBots
+}
+
+// switches between statistics with and without views of bots, the choice is remembered for the chat
+func (c *Command) toggleIncludeBots(chatID int64) {
+	settings, err := c.db.GetChatSettings(chatID)
+	if err != nil {
+		log.Println("Can't get chat settings, error " + err.Error())
+		sendMsg(c.bot, chatID, "Cant get settings")
+		return
+	}
+
+	settings.IncludeBots = !settings.IncludeBots
+	if err := c.db.SaveChatSettings(settings); err != nil {
+		log.Println("Can't save chat settings, error " + err.Error())
+		sendMsg(c.bot, chatID, "Cant save settings")
+		return
+	}
+
+	if settings.IncludeBots {
+		sendEscMsg(c.bot, chatID, "🤖 Views of bots, crawlers and link previews are counted in the statistics now. Call /bots to hide them again")
+	} else {
+		sendEscMsg(c.bot, chatID, "Views of bots, crawlers and link previews are not counted in the statistics anymore. Call /bots to show them")
+	}
+}
+
+// rebuildCounters counts all the views again, in case the summaries went wrong
+func (c *Command) rebuildCounters(chatID int64) {
+	sendEscMsg(c.bot, chatID, "Rebuilding statistics counters from all the views, it can take a while...")
+
+	count, err := c.db.RebuildCounters()
+	if err != nil {
+		log.Println("Can't rebuild statistics counters, error " + err.Error())
+		sendMsg(c.bot, chatID, "Cant rebuild statistics counters")
+		return
+	}
+	sendEscMsg(c.bot, chatID, "Done! Statistics counters are rebuilt from "+strconv.Itoa(count)+" views. Call /stats to see them")
+}
+
+// renderRetentionDryRun tells which views would be rolled up right now, without changing anything
+func (c *Command) renderRetentionDryRun(chatID int64) {
+	if !c.retention.IsEnabled() {
+		sendEscMsg(c.bot, chatID, "Views are kept forever. Set STATS_RETENTION_DAYS to roll up old views into daily numbers")
+		return
+	}
+
+	report, err := c.retention.DryRun(time.Now())
+	if err != nil {
+		log.Println("Can't make the retention dry run, error " + err.Error())
+		sendMsg(c.bot, chatID, "Cant check old views")
+		return
+	}
+
+	output, ok := renderTemplate(c.bot, chatID, "retention.md", RetentionData{
+		Report:      *report,
+		Days:        c.retention.Days,
+		RollupEvery: c.rollupEvery.String(),
+	})
+	if !ok {
+		return
+	}
+	sendMsg(c.bot, chatID, output)
+}
+
 func (c *Command) renderAreYouSureDelete(command string, chatID int64) {
 
 	// get Short URL from the db
@@ -460,6 +1290,79 @@ func renderPublicPrivateButtons(bot *tgbotapi.BotAPI, chatID int64, messageID in
 	bot.Send(keyboardMsg)
 }
 
+func renderRedirectTypeButtons(bot *tgbotapi.BotAPI, chatID int64, messageID, shortUrlID int) {
+	strShortID := strconv.Itoa(shortUrlID)
+	buttonRows := make([][]tgbotapi.InlineKeyboardButton, 2)
+
+	buttonRows[0] = []tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardButtonData("Default", ButtonRedirectType+Separator+"0"+Separator+strShortID),
+		tgbotapi.NewInlineKeyboardButtonData("📄 Page", ButtonRedirectType+Separator+strconv.Itoa(db.RedirectInterstitial)+Separator+strShortID),
+	}
+	for _, redirectType := range db.RedirectTypes {
+		if redirectType != db.RedirectInterstitial {
+			buttonRows[1] = append(buttonRows[1], tgbotapi.NewInlineKeyboardButtonData(strconv.Itoa(redirectType),
+				ButtonRedirectType+Separator+strconv.Itoa(redirectType)+Separator+strShortID))
+		}
+	}
+
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(buttonRows...)
+	keyboardMsg := tgbotapi.NewEditMessageReplyMarkup(chatID, messageID, keyboard)
+	bot.Send(keyboardMsg)
+}
+
+// human readable name of the redirect type
+func redirectTypeName(redirectType int) string {
+	switch redirectType {
+	case 0:
+		return "the default redirect"
+	case db.RedirectInterstitial:
+		return "the redirect page"
+	default:
+		return "HTTP " + strconv.Itoa(redirectType) + " redirect"
+	}
+}
+
+func renderClearRulesButton(bot *tgbotapi.BotAPI, chatID int64, messageID, shortUrlID int) {
+	keyboard := tgbotapi.NewInlineKeyboardMarkup([]tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardButtonData("🗑️ Remove all rules", ButtonClearRules+Separator+strconv.Itoa(shortUrlID)),
+	})
+	keyboardMsg := tgbotapi.NewEditMessageReplyMarkup(chatID, messageID, keyboard)
+	bot.Send(keyboardMsg)
+}
+
+func renderClearVariantsButton(bot *tgbotapi.BotAPI, chatID int64, messageID, shortUrlID int) {
+	keyboard := tgbotapi.NewInlineKeyboardMarkup([]tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardButtonData("🗑️ Stop the split", ButtonClearVariants+Separator+strconv.Itoa(shortUrlID)),
+	})
+	keyboardMsg := tgbotapi.NewEditMessageReplyMarkup(chatID, messageID, keyboard)
+	bot.Send(keyboardMsg)
+}
+
+func renderConfirmationButtons(bot *tgbotapi.BotAPI, chatID int64, messageID int) {
+	keyboard := tgbotapi.NewInlineKeyboardMarkup([]tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardButtonData("✅ Save", ButtonSaveDraft),
+		tgbotapi.NewInlineKeyboardButtonData("❌ Cancel", ButtonDiscardDraft),
+	})
+	keyboardMsg := tgbotapi.NewEditMessageReplyMarkup(chatID, messageID, keyboard)
+	bot.Send(keyboardMsg)
+}
+
+func renderGenerateSuffixButton(bot *tgbotapi.BotAPI, chatID int64, messageID int) {
+	keyboard := tgbotapi.NewInlineKeyboardMarkup([]tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardButtonData("🎲 Generate", ButtonGenerateSuffix),
+	})
+	keyboardMsg := tgbotapi.NewEditMessageReplyMarkup(chatID, messageID, keyboard)
+	bot.Send(keyboardMsg)
+}
+
+func renderSkipButton(bot *tgbotapi.BotAPI, chatID int64, messageID int, label string) {
+	keyboard := tgbotapi.NewInlineKeyboardMarkup([]tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardButtonData(label, ButtonSkip),
+	})
+	keyboardMsg := tgbotapi.NewEditMessageReplyMarkup(chatID, messageID, keyboard)
+	bot.Send(keyboardMsg)
+}
+
 func renderShortenedURLsList(bot *tgbotapi.BotAPI, chatID int64, database *db.Database, hostname string) {
 	shortenedUrls, err := database.GetAll()
 	if err != nil {
@@ -479,13 +1382,26 @@ func renderShortenedURLsList(bot *tgbotapi.BotAPI, chatID int64, database *db.Da
 		sb.WriteString(markdownEscape(k.ShortUrl))
 		sb.WriteString("](")
 		sb.WriteString(markdownEscapeUrl(k.TargetUrl))
-		sb.WriteString(") /delete")
+		sb.WriteString(")")
+		if k.IsProtected() {
+			sb.WriteString(" 🔒")
+		}
+		sb.WriteString(" /delete")
 		sb.WriteString(strconv.Itoa(k.ID))
 		sb.WriteString("\n")
 	}
 	sendMsg(bot, chatID, sb.String())
 }
 
+// extracts ID from a command using the pattern with only one group, for example "password5"
+func extractIDFromCommand(pattern *regexp.Regexp, command string) (int, error) {
+	arrParts := pattern.FindStringSubmatch(command)
+	if len(arrParts) != 2 {
+		return 0, errors.New("command doesn't match the pattern")
+	}
+	return strconv.Atoi(arrParts[1])
+}
+
 func extractIDFromDeleteCommand(deleteCommand string) (string, int) {
 	strID := deleteCommand[6:]
 	if intID, err := strconv.Atoi(strID); err != nil {
@@ -518,6 +1434,44 @@ func sendEscMsg(bot *tgbotapi.BotAPI, chatID int64, textMarkdown string) (tgbota
 	return sendMsg(bot, chatID, markdownEscape(textMarkdown))
 }
 
+// sends a long text in several messages, because Telegram rejects messages longer than 4096 characters.
+// The text is split between lines, so the Markdown of one line is never broken
+func sendLongMsg(bot *tgbotapi.BotAPI, chatID int64, textMarkdown string) {
+	for _, part := range splitMessage(textMarkdown, maxMessageLength) {
+		sendMsg(bot, chatID, part)
+	}
+}
+
+// splits the text into parts of at most limit characters between lines; a longer line is cut
+func splitMessage(text string, limit int) []string {
+	var parts []string
+	var current strings.Builder
+	currentLength := 0
+	for _, line := range strings.SplitAfter(text, "\n") {
+		runes := []rune(line)
+		for len(runes) > limit {
+			if currentLength > 0 {
+				parts = append(parts, current.String())
+				current.Reset()
+				currentLength = 0
+			}
+			parts = append(parts, string(runes[:limit]))
+			runes = runes[limit:]
+		}
+		if currentLength+len(runes) > limit {
+			parts = append(parts, current.String())
+			current.Reset()
+			currentLength = 0
+		}
+		current.WriteString(string(runes))
+		currentLength += len(runes)
+	}
+	if currentLength > 0 {
+		parts = append(parts, current.String())
+	}
+	return parts
+}
+
 // simply send a message to bot in Markdown format
 func sendMsg(bot *tgbotapi.BotAPI, chatID int64, textMarkdown string) (tgbotapi.Message, error) {
 	msg := tgbotapi.NewMessage(chatID, textMarkdown)
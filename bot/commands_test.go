@@ -2,6 +2,8 @@ package bot
 
 import (
 	"github.com/stretchr/testify/assert"
+	"github.com/w32blaster/shortana/db"
+	"strings"
 	"testing"
 	"time"
 )
@@ -39,3 +41,104 @@ func TestCommandExtractIdFromDeleteBigNumber(t *testing.T) {
 	assert.Equal(t, "678904", strID)
 	assert.Equal(t, 678904, intID)
 }
+
+func TestParseExpiryDateWithoutTime(t *testing.T) {
+
+	// Given:
+	now := time.Date(2020, time.December, 1, 10, 0, 0, 0, time.UTC)
+
+	// When:
+	expiresAt, err := parseExpiryDate(" 2020-12-31 ", now)
+
+	// Then:
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC), expiresAt)
+}
+
+func TestParseExpiryDateWithTime(t *testing.T) {
+
+	// Given:
+	now := time.Date(2020, time.December, 1, 10, 0, 0, 0, time.UTC)
+
+	// When:
+	expiresAt, err := parseExpiryDate("2020-12-01 18:30", now)
+
+	// Then:
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2020, time.December, 1, 18, 30, 0, 0, time.UTC), expiresAt)
+}
+
+func TestParseExpiryDateRejectsWrongValues(t *testing.T) {
+
+	// Given:
+	now := time.Date(2020, time.December, 1, 10, 0, 0, 0, time.UTC)
+
+	// When:
+	_, errPast := parseExpiryDate("2020-11-30", now)
+	_, errGarbage := parseExpiryDate("next friday", now)
+
+	// Then:
+	assert.NotNil(t, errPast)
+	assert.NotNil(t, errGarbage)
+}
+
+func TestCommandExtractIdFromPasswordCommands(t *testing.T) {
+
+	// When:
+	idSet, errSet := extractIDFromCommand(patternCommandPassword, "password12")
+	idRemove, errRemove := extractIDFromCommand(patternCommandRemovePassword, "nopassword7")
+	_, errWrong := extractIDFromCommand(patternCommandPassword, "passwordX")
+
+	// Then:
+	assert.Nil(t, errSet)
+	assert.Equal(t, 12, idSet)
+	assert.Nil(t, errRemove)
+	assert.Equal(t, 7, idRemove)
+	assert.NotNil(t, errWrong)
+}
+
+func TestFormatDraft(t *testing.T) {
+
+	// Given:
+	draft := &db.ShortURL{
+		ShortUrl:     "yeti",
+		TargetUrl:    "https://example.com",
+		Description:  "Yeti mic",
+		IsPublic:     true,
+		RedirectType: 301,
+		ExpiresAt:    time.Date(2021, 1, 31, 18, 0, 0, 0, time.UTC),
+	}
+
+	// When:
+	text := formatDraft("https://sho.rt", draft)
+
+	// Then:
+	assert.Equal(t, "Short URL: https://sho.rt/yeti\n"+
+		"Target: https://example.com\n"+
+		"Description: Yeti mic\n"+
+		"Public\n"+
+		"Redirect: "+redirectTypeName(301)+"\n"+
+		"Expires at: 2021-01-31 18:00 UTC\n", text)
+}
+
+func TestSplitMessageBetweenLines(t *testing.T) {
+
+	// When:
+	parts := splitMessage("first\nsecond\nthird\n", 13)
+
+	// Then:
+	assert.Equal(t, []string{"first\nsecond\n", "third\n"}, parts)
+}
+
+func TestSplitMessageCutsLongLines(t *testing.T) {
+
+	// When:
+	parts := splitMessage("ok\n"+strings.Repeat("✅", 10)+"\nend", 4)
+
+	// Then:
+	assert.Equal(t, []string{"ok\n", "✅✅✅✅", "✅✅✅✅", "✅✅\n", "end"}, parts)
+}
+
+func TestShortMessageIsNotSplit(t *testing.T) {
+	assert.Equal(t, []string{"short"}, splitMessage("short", maxMessageLength))
+}
@@ -0,0 +1,171 @@
+package bot
+
+import (
+	"log"
+	"strings"
+
+	"github.com/asdine/storm/v3"
+	"github.com/w32blaster/shortana/db"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// fields that can be changed with /edit, they are sent in the button data "ed # field"
+const (
+	editTarget      = "target"
+	editDescription = "description"
+	editVisibility  = "visibility"
+	editSuffix      = "suffix"
+)
+
+// starts editing the existing short URL, for example /edit5. The changes are collected in the session
+// draft, so nothing is saved until user sees the difference and confirms it
+func (c *Command) initiateEditing(session *db.Session, command string) {
+	shortUrl, ok := c.findShortUrlFromCommand(session.ChatID, patternCommandEdit, command)
+	if !ok {
+		return
+	}
+
+	session.Draft = *shortUrl
+	c.setStep(session, RequestedEditField, shortUrl.ShortUrl)
+	resp, _ := sendEscMsg(c.bot, session.ChatID, "What should I change?\n\n"+formatDraft(c.hostname, shortUrl))
+	renderEditButtons(c.bot, session.ChatID, resp.MessageID)
+}
+
+// handles the buttons of the edit dialog, expected data is "ed # field". There is no link ID
+// in the data, because the session knows which link is being edited
+func (c *Command) chooseEditField(session *db.Session, field string) {
+	chatID := session.ChatID
+	if !isEditStep(session.Step) {
+		sendEscMsg(c.bot, chatID, "This link is not being edited anymore, please start again with /edit<ID>")
+		return
+	}
+
+	switch field {
+	case editTarget:
+		c.setStep(session, RequestedEditTarget, session.ShortUrl)
+		sendEscMsg(c.bot, chatID, "Send me the new target URL please")
+	case editDescription:
+		c.setStep(session, RequestedEditDescription, session.ShortUrl)
+		sendEscMsg(c.bot, chatID, "Send me the new description please")
+	case editSuffix:
+		c.setStep(session, RequestedEditSuffix, session.ShortUrl)
+		sendEscMsg(c.bot, chatID, "Send me the new short URL (just suffix without a hostname) please. "+
+			"The old one will stop working, but the statistics will be kept")
+	case editVisibility:
+		session.Draft.IsPublic = !session.Draft.IsPublic
+		c.previewEdit(session)
+	}
+}
+
+// applies the value sent by user to the draft, a wrong value is requested once again
+func (c *Command) applyEditValue(session *db.Session, text string) {
+	chatID := session.ChatID
+	text = strings.TrimSpace(text)
+
+	switch session.Step {
+	case RequestedEditTarget:
+		if err := c.targets.Check(text); err != nil {
+			sendEscMsg(c.bot, chatID, "Sorry, "+err.Error()+". Can you send me another one please?")
+			return
+		}
+		session.Draft.TargetUrl = text
+
+	case RequestedEditDescription:
+		session.Draft.Description = text
+
+	case RequestedEditSuffix:
+		if err := c.validateSuffix(text, session.Draft.ID); err != nil {
+			sendEscMsg(c.bot, chatID, "Sorry, "+err.Error()+". Can you send me another one please?")
+			return
+		}
+		session.Draft.ShortUrl = text
+	}
+
+	c.previewEdit(session)
+}
+
+// shows what is going to be changed and offers to change more, save or cancel
+func (c *Command) previewEdit(session *db.Session) {
+	chatID := session.ChatID
+	original, err := c.db.GetUrlByID(session.Draft.ID)
+	if err != nil {
+		log.Println("can't find short URL, err: " + err.Error())
+		c.cancelDialog(session, "Sorry, this link doesn't exist anymore")
+		return
+	}
+
+	c.setStep(session, RequestedEditField, session.ShortUrl)
+	resp, _ := sendEscMsg(c.bot, chatID, "These changes will be saved:\n\n"+formatEditDiff(original, &session.Draft))
+	renderEditButtons(c.bot, chatID, resp.MessageID)
+}
+
+// saves the edited link, the suffix change renames the statistics as well
+func (c *Command) saveEdit(session *db.Session) {
+	chatID := session.ChatID
+	draft := session.Draft
+	if err := c.db.EditShortUrl(&draft); err != nil {
+		if err == storm.ErrAlreadyExists {
+			sendEscMsg(c.bot, chatID, "Sorry, the short URL '"+draft.ShortUrl+"' was taken meanwhile. "+
+				"Please choose another one")
+			return
+		}
+		log.Println("Failed to edit a short link, error " + err.Error())
+		c.cancelDialog(session, "Sorry, I tried to save the changes but failed")
+		return
+	}
+
+	c.endSession(session)
+	sendEscMsg(c.bot, chatID, "Done, the link is saved: "+c.hostname+"/"+draft.ShortUrl)
+}
+
+// prints only the fields that differ, as "old → new"
+func formatEditDiff(original, edited *db.ShortURL) string {
+	var sb strings.Builder
+	writeDiff := func(name, before, after string) {
+		if before != after {
+			sb.WriteString(name + ": " + before + " → " + after + "\n")
+		}
+	}
+
+	writeDiff("Short URL", original.ShortUrl, edited.ShortUrl)
+	writeDiff("Target", original.TargetUrl, edited.TargetUrl)
+	writeDiff("Description", original.Description, edited.Description)
+	writeDiff("Visibility", visibilityName(original.IsPublic), visibilityName(edited.IsPublic))
+
+	if sb.Len() == 0 {
+		return "Nothing is changed yet\n"
+	}
+	return sb.String()
+}
+
+func visibilityName(isPublic bool) string {
+	if isPublic {
+		return "Public"
+	}
+	return "Private"
+}
+
+func isEditStep(step int) bool {
+	return step == RequestedEditField || step == RequestedEditTarget ||
+		step == RequestedEditDescription || step == RequestedEditSuffix
+}
+
+func renderEditButtons(bot *tgbotapi.BotAPI, chatID int64, messageID int) {
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(
+		[]tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardButtonData("🎯 Target", ButtonEditField+Separator+editTarget),
+			tgbotapi.NewInlineKeyboardButtonData("📝 Description", ButtonEditField+Separator+editDescription),
+		},
+		[]tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardButtonData("👁️ Public/Private", ButtonEditField+Separator+editVisibility),
+			tgbotapi.NewInlineKeyboardButtonData("🔤 Short URL", ButtonEditField+Separator+editSuffix),
+		},
+		[]tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardButtonData("✅ Save", ButtonSaveDraft),
+			tgbotapi.NewInlineKeyboardButtonData("❌ Cancel", ButtonDiscardDraft),
+		},
+	)
+	keyboardMsg := tgbotapi.NewEditMessageReplyMarkup(chatID, messageID, keyboard)
+	bot.Send(keyboardMsg)
+}
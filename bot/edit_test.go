@@ -0,0 +1,35 @@
+package bot
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/w32blaster/shortana/db"
+)
+
+func TestFormatEditDiff(t *testing.T) {
+
+	// Given:
+	original := &db.ShortURL{ShortUrl: "yeti", TargetUrl: "https://example.com", Description: "Yeti mic", IsPublic: true}
+	edited := *original
+	edited.ShortUrl = "mic"
+	edited.IsPublic = false
+
+	// When:
+	diff := formatEditDiff(original, &edited)
+
+	// Then:
+	assert.Equal(t, "Short URL: yeti → mic\nVisibility: Public → Private\n", diff)
+}
+
+func TestFormatEditDiffWithoutChanges(t *testing.T) {
+
+	// Given:
+	original := &db.ShortURL{ShortUrl: "yeti", TargetUrl: "https://example.com"}
+
+	// When:
+	diff := formatEditDiff(original, original)
+
+	// Then:
+	assert.Equal(t, "Nothing is changed yet\n", diff)
+}
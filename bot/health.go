@@ -0,0 +1,109 @@
+package bot
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/w32blaster/shortana/db"
+)
+
+// prints the last check of every link, broken links go first, for example /health
+func (c *Command) renderLinksHealth(chatID int64) {
+	links, err := c.db.GetAll()
+	if err != nil {
+		log.Println("Can't get links, error " + err.Error())
+		sendMsg(c.bot, chatID, "Cant get links")
+		return
+	}
+	checks, err := c.db.GetAllLinkHealth()
+	if err != nil {
+		log.Println("Can't get health of links, error " + err.Error())
+		sendMsg(c.bot, chatID, "Cant get health of links")
+		return
+	}
+
+	var broken, working, unchecked strings.Builder
+	for _, link := range links {
+		if len(link.TargetUrl) == 0 {
+			continue
+		}
+
+		line := markdownEscape(link.ShortUrl) + " /health" + strconv.Itoa(link.ID) + "\n"
+		health, found := checks[link.ID]
+		switch {
+		case !found:
+			unchecked.WriteString("❔ " + line)
+		case health.IsBroken():
+			broken.WriteString("❌ " + markdownEscape(formatHealthStatus(health)) + " " + line)
+		default:
+			working.WriteString("✅ " + markdownEscape(formatHealthStatus(health)) + " " + line)
+		}
+	}
+
+	text := broken.String() + working.String() + unchecked.String()
+	if len(text) == 0 {
+		sendEscMsg(c.bot, chatID, "There are no links to check yet")
+		return
+	}
+	sendLongMsg(c.bot, chatID, text)
+}
+
+// checks the target of one link right now and prints the result, for example /health5
+func (c *Command) checkLinkHealth(chatID int64, command string) {
+	shortUrl, ok := c.findShortUrlFromCommand(chatID, patternCommandHealth, command)
+	if !ok {
+		return
+	}
+	if len(shortUrl.TargetUrl) == 0 {
+		sendEscMsg(c.bot, chatID, "This link has no target URL, there is nothing to check")
+		return
+	}
+
+	health, _ := c.linkChecker.CheckOne(shortUrl, time.Now())
+	sendEscMsg(c.bot, chatID, formatHealth(&health))
+}
+
+// ReportBrokenLinks sends the list of links that became broken to the admin chat
+func (c *Command) ReportBrokenLinks(chatID int64, broken []db.LinkHealth) {
+	var sb strings.Builder
+	sb.WriteString(markdownEscape("⚠️ These links are broken now:"))
+	sb.WriteString("\n\n")
+	for _, health := range broken {
+		sb.WriteString(markdownEscape(health.ShortUrl + " → " + health.TargetUrl + " (" + formatHealthStatus(health) + ")"))
+		sb.WriteString(" /health")
+		sb.WriteString(strconv.Itoa(health.LinkID))
+		sb.WriteString("\n")
+	}
+
+	if chatID == 0 {
+		log.Println(sb.String())
+		return
+	}
+	sendLongMsg(c.bot, chatID, sb.String())
+}
+
+// prints the result of one check in details
+func formatHealth(health *db.LinkHealth) string {
+	var sb strings.Builder
+	if health.IsBroken() {
+		sb.WriteString("❌ Broken since " + health.BrokenSince.Format(time.RFC822) + "\n")
+	} else {
+		sb.WriteString("✅ Works\n")
+	}
+	sb.WriteString("Short URL: " + health.ShortUrl + "\n")
+	sb.WriteString("Target: " + health.TargetUrl + "\n")
+	sb.WriteString("Result: " + formatHealthStatus(*health) + "\n")
+	sb.WriteString("Response time: " + health.Latency.Round(time.Millisecond).String() + "\n")
+	sb.WriteString("Checked at: " + health.CheckedAt.Format(time.RFC822))
+	return sb.String()
+}
+
+// prints the status code, or the network error if there was no response
+func formatHealthStatus(health db.LinkHealth) string {
+	if health.StatusCode == 0 {
+		return "no response: " + health.Error
+	}
+	return "HTTP " + strconv.Itoa(health.StatusCode)
+}
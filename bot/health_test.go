@@ -0,0 +1,43 @@
+package bot
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/w32blaster/shortana/db"
+)
+
+func TestFormatHealth(t *testing.T) {
+
+	// Given:
+	checkedAt := time.Date(2021, 1, 2, 3, 4, 0, 0, time.UTC)
+	working := db.LinkHealth{
+		ShortUrl:   "yeti",
+		TargetUrl:  "https://example.com",
+		StatusCode: 200,
+		Latency:    123456789 * time.Nanosecond,
+		CheckedAt:  checkedAt,
+	}
+	broken := db.LinkHealth{
+		ShortUrl:    "gone",
+		TargetUrl:   "https://example.org",
+		Error:       "connection refused",
+		CheckedAt:   checkedAt,
+		BrokenSince: checkedAt.Add(-time.Hour),
+	}
+
+	// When:
+	workingText := formatHealth(&working)
+	brokenText := formatHealth(&broken)
+
+	// Then:
+	assert.Contains(t, workingText, "✅ Works")
+	assert.Contains(t, workingText, "Result: HTTP 200")
+	assert.Contains(t, workingText, "Response time: 123ms")
+	assert.Contains(t, workingText, "Checked at: 02 Jan 21 03:04 UTC")
+
+	// and:
+	assert.Contains(t, brokenText, "❌ Broken since 02 Jan 21 02:04 UTC")
+	assert.Contains(t, brokenText, "Result: no response: connection refused")
+}
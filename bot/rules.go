@@ -0,0 +1,161 @@
+package bot
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/w32blaster/shortana/db"
+)
+
+// parses redirect rules sent by user, one rule per line, where conditions go first and the target is the last:
+//
+//	country=DE,AT,CH https://example.de
+//	os=iOS device=mobile,tablet https://apps.apple.com/app/id123
+//
+// please refer to unit tests for examples
+func parseRules(text string, targets db.TargetChecker) ([]db.RedirectRule, error) {
+	var rules []db.RedirectRule
+	for i, line := range strings.Split(text, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		lineNumber := strconv.Itoa(i + 1)
+		if len(fields) < 2 {
+			return nil, errors.New("line " + lineNumber + " should have conditions and the target URL")
+		}
+
+		rule := db.RedirectRule{
+			TargetUrl: fields[len(fields)-1],
+		}
+		for _, condition := range fields[:len(fields)-1] {
+			parts := strings.SplitN(condition, "=", 2)
+			if len(parts) != 2 || len(parts[1]) == 0 {
+				return nil, errors.New("line " + lineNumber + " has wrong condition '" + condition + "', expected something like country=DE,AT")
+			}
+
+			values := strings.Split(parts[1], ",")
+			switch strings.ToLower(parts[0]) {
+			case "country":
+				rule.Countries = append(rule.Countries, values...)
+			case "os":
+				rule.OS = append(rule.OS, values...)
+			case "device":
+				rule.Devices = append(rule.Devices, values...)
+			default:
+				return nil, errors.New("line " + lineNumber + " has unknown condition '" + parts[0] + "'")
+			}
+		}
+		rules = append(rules, rule)
+	}
+
+	rules = db.NormalizeRules(rules)
+	if err := db.ValidateRules(rules, targets); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// prints rules in the same format as parseRules expects
+func formatRules(rules []db.RedirectRule) string {
+	var sb strings.Builder
+	for _, rule := range rules {
+		writeCondition(&sb, "country", rule.Countries)
+		writeCondition(&sb, "os", rule.OS)
+		writeCondition(&sb, "device", rule.Devices)
+		sb.WriteString(rule.TargetUrl)
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+func writeCondition(sb *strings.Builder, name string, values []string) {
+	if len(values) == 0 {
+		return
+	}
+	sb.WriteString(name)
+	sb.WriteString("=")
+
+	// OS names may contain spaces, but they can be typed without them
+	sb.WriteString(strings.Replace(strings.Join(values, ","), " ", "", -1))
+	sb.WriteString(" ")
+}
+
+// parses A/B split variants sent by user, one variant per line, where the weight goes first:
+//
+//	70 https://example.com/landing-a
+//	30 https://example.com/landing-b
+func parseVariants(text string, targets db.TargetChecker) ([]db.Variant, error) {
+	var variants []db.Variant
+	for i, line := range strings.Split(text, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		lineNumber := strconv.Itoa(i + 1)
+		if len(fields) != 2 {
+			return nil, errors.New("line " + lineNumber + " should have the weight and the target URL")
+		}
+
+		weight, err := strconv.Atoi(strings.TrimSuffix(fields[0], "%"))
+		if err != nil {
+			return nil, errors.New("line " + lineNumber + " has wrong weight '" + fields[0] + "', expected a number")
+		}
+
+		variants = append(variants, db.Variant{
+			TargetUrl: fields[1],
+			Weight:    weight,
+		})
+	}
+
+	if len(variants) == 0 {
+		return nil, errors.New("there are no variants")
+	}
+	if err := db.ValidateVariants(variants, targets); err != nil {
+		return nil, err
+	}
+	return variants, nil
+}
+
+// prints variants in the same format as parseVariants expects
+func formatVariants(variants []db.Variant) string {
+	var sb strings.Builder
+	for _, variant := range variants {
+		sb.WriteString(strconv.Itoa(variant.Weight))
+		sb.WriteString(" ")
+		sb.WriteString(variant.TargetUrl)
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// parses UTM tags sent by user, such as "source=newsletter medium=email campaign=spring_sale".
+// The names can be given with the "utm_" prefix as well
+func parseUTM(text string) (db.UTM, error) {
+	var tags db.UTM
+	for _, field := range strings.Fields(text) {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 || len(parts[1]) == 0 {
+			return db.UTM{}, errors.New("wrong tag '" + field + "', expected something like source=newsletter")
+		}
+
+		switch strings.TrimPrefix(strings.ToLower(parts[0]), "utm_") {
+		case "source":
+			tags.Source = parts[1]
+		case "medium":
+			tags.Medium = parts[1]
+		case "campaign":
+			tags.Campaign = parts[1]
+		default:
+			return db.UTM{}, errors.New("unknown tag '" + parts[0] + "', expected source, medium or campaign")
+		}
+	}
+
+	if tags.IsEmpty() {
+		return db.UTM{}, errors.New("there are no tags")
+	}
+	return tags, nil
+}
@@ -0,0 +1,158 @@
+package bot
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/w32blaster/shortana/db"
+	"github.com/w32blaster/shortana/urlcheck"
+)
+
+func TestParseRules(t *testing.T) {
+
+	// When:
+	rules, err := parseRules("country=DE,at,CH https://example.de\n\n  country=FR   https://example.fr  ", urlcheck.Checker{})
+
+	// Then:
+	assert.Nil(t, err)
+	assert.Equal(t, []db.RedirectRule{
+		{Countries: []string{"DE", "AT", "CH"}, TargetUrl: "https://example.de"},
+		{Countries: []string{"FR"}, TargetUrl: "https://example.fr"},
+	}, rules)
+}
+
+func TestParseRulesWithDevices(t *testing.T) {
+
+	// When:
+	rules, err := parseRules("os=ios https://apps.apple.com/app\nos=android device=Mobile https://play.google.com/app\nos=chromeos,windowsphone country=us https://example.com", urlcheck.Checker{})
+
+	// Then:
+	assert.Nil(t, err)
+	assert.Equal(t, []db.RedirectRule{
+		{OS: []string{"iOS"}, TargetUrl: "https://apps.apple.com/app"},
+		{OS: []string{"Android"}, Devices: []string{"mobile"}, TargetUrl: "https://play.google.com/app"},
+		{OS: []string{"Chrome OS", "Windows Phone"}, Countries: []string{"US"}, TargetUrl: "https://example.com"},
+	}, rules)
+}
+
+func TestParseRulesErrors(t *testing.T) {
+
+	cases := []string{
+		"https://example.de",
+		"DE,AT https://example.de",
+		"country= https://example.de",
+		"planet=mars https://example.de",
+		"country=DEU https://example.de",
+		"country=DE example.de",
+		"os=beos https://example.de",
+		"device=fridge https://example.de",
+	}
+
+	for _, text := range cases {
+
+		// When:
+		_, err := parseRules(text, urlcheck.Checker{})
+
+		// Then:
+		assert.NotNil(t, err, text)
+	}
+}
+
+func TestParseRulesAndVariantsCheckTargets(t *testing.T) {
+
+	// Given:
+	targets := urlcheck.Checker{Hostname: "https://sho.rt", Schemes: []string{"https"}}
+
+	// When:
+	_, errRuleScheme := parseRules("country=DE http://example.de", targets)
+	_, errRuleLoop := parseRules("country=DE https://sho.rt/yeti", targets)
+	_, errVariant := parseVariants("50 https://example.com/a\n50 http://example.com/b", targets)
+	_, errValid := parseRules("country=DE https://example.de", targets)
+
+	// Then:
+	assert.NotNil(t, errRuleScheme)
+	assert.NotNil(t, errRuleLoop)
+	assert.NotNil(t, errVariant)
+	assert.Nil(t, errValid)
+}
+
+func TestFormatRulesCanBeParsedBack(t *testing.T) {
+
+	// Given:
+	rules := []db.RedirectRule{
+		{Countries: []string{"DE", "AT"}, TargetUrl: "https://example.de"},
+		{Countries: []string{"US"}, TargetUrl: "https://example.com"},
+		{OS: []string{"Chrome OS"}, Devices: []string{"desktop"}, TargetUrl: "https://example.org"},
+	}
+
+	// When:
+	parsed, err := parseRules(formatRules(rules), urlcheck.Checker{})
+
+	// Then:
+	assert.Nil(t, err)
+	assert.Equal(t, rules, parsed)
+}
+
+func TestParseVariants(t *testing.T) {
+
+	// When:
+	variants, err := parseVariants("70 https://example.com/a\n\n 30% https://example.com/b ", urlcheck.Checker{})
+
+	// Then:
+	assert.Nil(t, err)
+	assert.Equal(t, []db.Variant{
+		{TargetUrl: "https://example.com/a", Weight: 70},
+		{TargetUrl: "https://example.com/b", Weight: 30},
+	}, variants)
+	assert.Equal(t, "70 https://example.com/a\n30 https://example.com/b\n", formatVariants(variants))
+}
+
+func TestParseVariantsErrors(t *testing.T) {
+
+	cases := []string{
+		"",
+		"70 https://example.com/a",
+		"70 https://example.com/a\nhttps://example.com/b",
+		"seventy https://example.com/a\n30 https://example.com/b",
+		"70 https://example.com/a\n0 https://example.com/b",
+		"70 https://example.com/a\n30 example.com/b",
+	}
+
+	for _, text := range cases {
+
+		// When:
+		_, err := parseVariants(text, urlcheck.Checker{})
+
+		// Then:
+		assert.NotNil(t, err, text)
+	}
+}
+
+func TestParseUTM(t *testing.T) {
+
+	// When:
+	tags, err := parseUTM(" source=newsletter  UTM_Medium=email ")
+
+	// Then:
+	assert.Nil(t, err)
+	assert.Equal(t, db.UTM{Source: "newsletter", Medium: "email"}, tags)
+}
+
+func TestParseUTMErrors(t *testing.T) {
+
+	cases := []string{
+		"",
+		"newsletter",
+		"source=",
+		"content=banner",
+	}
+
+	for _, text := range cases {
+
+		// When:
+		_, err := parseUTM(text)
+
+		// Then:
+		assert.NotNil(t, err, text)
+	}
+}
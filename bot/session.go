@@ -0,0 +1,69 @@
+package bot
+
+import (
+	"log"
+	"time"
+
+	"github.com/w32blaster/shortana/db"
+)
+
+// a dialog that was idle for this time is cancelled
+const sessionTimeout = 30 * time.Minute
+
+// loads the dialog state of the user in the chat. If the previous dialog was idle for too long,
+// then it is cancelled and the user gets a fresh session
+func (c *Command) loadSession(chatID int64, userID int) *db.Session {
+	session, err := c.db.GetSession(chatID, userID)
+	if err != nil {
+		log.Println("Can't load the session, error " + err.Error())
+		return &db.Session{ID: db.SessionID(chatID, userID), ChatID: chatID, Step: None}
+	}
+
+	if session.Step == 0 {
+		session.Step = None
+	}
+
+	if session.Step != None && time.Since(session.UpdatedAt) > sessionTimeout {
+		c.cancelDialog(session, "The previous dialog was cancelled, because it was idle for too long")
+	}
+	return session
+}
+
+// moves the dialog to the given step and remembers which existing link it is about
+func (c *Command) setStep(session *db.Session, step int, shortUrl string) {
+	session.Step = step
+	session.ShortUrl = shortUrl
+	if err := c.db.SaveSession(session); err != nil {
+		log.Println("Can't save the session, error " + err.Error())
+	}
+}
+
+// finishes the dialog
+func (c *Command) endSession(session *db.Session) {
+	session.Step = None
+	session.ShortUrl = ""
+	session.Draft = db.ShortURL{}
+	if err := c.db.DeleteSession(session.ID); err != nil {
+		log.Println("Can't delete the session, error " + err.Error())
+	}
+}
+
+// cancels the dialog and tells user why. The draft of a new link is just forgotten
+func (c *Command) cancelDialog(session *db.Session, reason string) {
+	c.endSession(session)
+	sendEscMsg(c.bot, session.ChatID, reason)
+}
+
+// CancelIdleSessions cancels all the dialogs that were idle for too long, it is called periodically
+func (c *Command) CancelIdleSessions(now time.Time) {
+	sessions, err := c.db.GetSessionsUpdatedBefore(now.Add(-sessionTimeout))
+	if err != nil {
+		log.Println("Can't get idle sessions, error " + err.Error())
+		return
+	}
+
+	for i := range sessions {
+		c.cancelDialog(&sessions[i], "The dialog was cancelled, because it was idle for too long. "+
+			"You can start it again at any time")
+	}
+}
@@ -1,44 +1,124 @@
 package bot
 
 import (
+	"context"
 	"github.com/w32blaster/shortana/db"
 	"github.com/w32blaster/shortana/geoip"
+	"github.com/w32blaster/shortana/health"
+	"github.com/w32blaster/shortana/retention"
 	"github.com/w32blaster/shortana/stats"
+	"github.com/w32blaster/shortana/suffix"
+	"github.com/w32blaster/shortana/urlcheck"
 	"log"
 	"net/http"
 	"strconv"
+	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
 )
 
-func Start(database *db.Database, statistics *stats.Statistics, geoIP *geoip.GeoIP, botToken string, port, acceptFromUser int, hostname string, isDebug bool) {
+// Config holds the bot settings
+type Config struct {
+	BotToken       string
+	Port           int    // for the webhook
+	AcceptFromUser int    // the only user allowed to speak to the bot; zero means everyone
+	AdminChatID    int64  // broken links are reported to this chat; zero means they are only logged
+	Hostname       string // address of the web server, to print full short URLs
+	IsDebug        bool
+	Suffixes       suffix.Generator
+	SuffixPolicy   suffix.Policy
+	Targets        urlcheck.Checker
+	HealthInterval time.Duration // how often targets of all the links are checked; zero disables the checks
+	Retention      retention.Policy
+	RollupInterval time.Duration // how often old views are rolled up, to tell it in /retention
+}
+
+// Start runs the bot until the stop channel is closed. Then the webhook listener is shut down and the done channel
+// is closed, when the update in progress is processed, so the database can be closed after that
+func Start(database *db.Database, statistics *stats.Statistics, geoIP *geoip.GeoIP, linkChecker *health.Checker, cfg Config,
+	stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
 
-	bot, err := tgbotapi.NewBotAPI(botToken)
+	bot, err := tgbotapi.NewBotAPI(cfg.BotToken)
 	if err != nil {
 		panic("Bot doesn't work. Reason: " + err.Error())
 	}
 
-	bot.Debug = isDebug
+	bot.Debug = cfg.IsDebug
 
 	cmd := Command{
-		db:       database,
-		bot:      bot,
-		hostname: hostname,
-		stats:    statistics,
-		geoIP:    geoIP,
-		step:     None,
+		db:           database,
+		bot:          bot,
+		hostname:     cfg.Hostname,
+		stats:        statistics,
+		geoIP:        geoIP,
+		suffixes:     cfg.Suffixes,
+		suffixPolicy: cfg.SuffixPolicy,
+		targets:      cfg.Targets,
+		linkChecker:  linkChecker,
+		retention:    cfg.Retention,
+		rollupEvery:  cfg.RollupInterval,
 	}
 
 	log.Printf("Authorized on account %s", bot.Self.UserName)
-	updates := bot.ListenForWebhook("/" + botToken)
 
-	go http.ListenAndServe(":"+strconv.Itoa(port), nil)
+	// links without target could be left by the /add dialog of older versions
+	if links, err := database.GetIncompleteLinks(); err != nil {
+		log.Println("Can't check incomplete links, error " + err.Error())
+	} else if len(links) > 0 {
+		log.Printf("There are %d links without the target URL, call /incomplete in the bot to review them", len(links))
+	}
+
+	// the checks are slow, so they run aside and only the report is sent from there. The bot is done
+	// only after the checker, because the checker saves the results
+	checksDone := make(chan struct{})
+	if cfg.HealthInterval > 0 {
+		go linkChecker.Run(cfg.HealthInterval, stop, checksDone, func(broken []db.LinkHealth) {
+			cmd.ReportBrokenLinks(cfg.AdminChatID, broken)
+		})
+	} else {
+		close(checksDone)
+	}
+	defer func() { <-checksDone }()
+
+	updates := bot.ListenForWebhook("/" + cfg.BotToken)
 
-	for update := range updates {
+	// the webhook is registered in the default mux
+	webhookServer := &http.Server{Addr: ":" + strconv.Itoa(cfg.Port)}
+	go func() {
+		if err := webhookServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Println("Webhook listener failed, error " + err.Error())
+		}
+	}()
+
+	// idle dialogs are checked in the same loop as updates, so they are never processed concurrently
+	idleSessionsTicker := time.NewTicker(time.Minute)
+	defer idleSessionsTicker.Stop()
+
+	for {
+		var update tgbotapi.Update
+		var ok bool
+		select {
+		case <-stop:
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			if err := webhookServer.Shutdown(ctx); err != nil {
+				log.Println("Webhook listener didn't stop gracefully: " + err.Error())
+			}
+			cancel()
+			return
+		case now := <-idleSessionsTicker.C:
+			cmd.CancelIdleSessions(now)
+			continue
+		case update, ok = <-updates:
+			if !ok {
+				log.Println("The channel of bot updates is closed, stop processing them")
+				return
+			}
+		}
 
 		if update.Message != nil {
 
-			if !isUserAllowedToSpeakToBot(update.Message.From.ID, acceptFromUser) {
+			if !isUserAllowedToSpeakToBot(update.Message.From.ID, cfg.AcceptFromUser) {
 
 				cmd.NotAllowedToSpeak(update.Message)
 
@@ -59,7 +139,7 @@ func Start(database *db.Database, statistics *stats.Statistics, geoIP *geoip.Geo
 
 		} else if update.CallbackQuery != nil {
 
-			if isUserAllowedToSpeakToBot(update.CallbackQuery.From.ID, acceptFromUser) {
+			if isUserAllowedToSpeakToBot(update.CallbackQuery.From.ID, cfg.AcceptFromUser) {
 
 				// this is the callback after a button click
 				cmd.ProcessButtonCallback(update.CallbackQuery)
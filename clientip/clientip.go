@@ -0,0 +1,148 @@
+package clientip
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Resolver finds the real address of the visitor. The proxy headers are taken into account only if
+// the request came from a trusted proxy, otherwise anyone could pretend to be anyone. The zero value
+// trusts nobody and always returns the address of the connection
+type Resolver struct {
+	trusted []*net.IPNet
+
+	// OnUntrustedProxy is called with the address of the connection, if the request has proxy headers, but
+	// the address is not trusted, so the headers are ignored. Optional, it helps to find a missing proxy network
+	OnUntrustedProxy func(remote string)
+}
+
+// New returns the resolver that trusts proxies from the given networks in CIDR notation
+func New(trustedProxies []string) (Resolver, error) {
+	var resolver Resolver
+	for _, cidr := range trustedProxies {
+		cidr = strings.TrimSpace(cidr)
+		if len(cidr) == 0 {
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return resolver, err
+		}
+		resolver.trusted = append(resolver.trusted, network)
+	}
+	return resolver, nil
+}
+
+// Middleware replaces the RemoteAddr of the request with the resolved client address without port,
+// so all the handlers can simply use RemoteAddr
+func (r Resolver) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if ip := r.Resolve(req); len(ip) > 0 {
+			req.RemoteAddr = ip
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// Resolve returns the normalized address of the client. The proxy chain from the "Forwarded" or "X-Forwarded-For"
+// header is read from right to left, every trusted proxy is skipped and the first untrusted address is the client.
+// "X-Real-IP" is used only if there is no chain at all
+func (r Resolver) Resolve(req *http.Request) string {
+	remote := Normalize(req.RemoteAddr)
+	if len(remote) == 0 || !r.isTrusted(remote) {
+		if r.OnUntrustedProxy != nil && len(remote) > 0 && hasProxyHeaders(req) {
+			r.OnUntrustedProxy(remote)
+		}
+		return remote
+	}
+
+	chain := forwardedFor(req.Header["Forwarded"])
+	if len(chain) == 0 {
+		chain = splitList(req.Header["X-Forwarded-For"])
+	}
+	if len(chain) == 0 {
+		if realIP := Normalize(req.Header.Get("X-Real-IP")); len(realIP) > 0 {
+			return realIP
+		}
+		return remote
+	}
+
+	client := remote
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip := Normalize(chain[i])
+		if len(ip) == 0 {
+			break // garbage or obfuscated identifier, nothing to the left of it can be trusted
+		}
+		client = ip
+		if !r.isTrusted(ip) {
+			break
+		}
+	}
+	return client
+}
+
+func hasProxyHeaders(req *http.Request) bool {
+	return len(req.Header["Forwarded"]) > 0 || len(req.Header["X-Forwarded-For"]) > 0 || len(req.Header["X-Real-Ip"]) > 0
+}
+
+func (r Resolver) isTrusted(ip string) bool {
+	parsed := net.ParseIP(ip)
+	for _, network := range r.trusted {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// Normalize returns the IP address without port, brackets and zone in its canonical form, so IPv4-mapped
+// IPv6 addresses become IPv4 and IPv6 addresses are always written the same way. It returns empty string
+// if the value is not an IP address
+func Normalize(address string) string {
+	address = strings.Trim(strings.TrimSpace(address), `"`)
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+	address = strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")
+	if idx := strings.Index(address, "%"); idx >= 0 {
+		address = address[:idx]
+	}
+
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return ""
+	}
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return ipv4.String()
+	}
+	return ip.String()
+}
+
+// forwardedFor takes "for" parameters from the "Forwarded" headers (RFC 7239), for example
+// `for=192.0.2.60;proto=http, for="[2001:db8:cafe::17]:4711"`
+func forwardedFor(headers []string) []string {
+	var chain []string
+	for _, element := range splitList(headers) {
+		for _, pair := range strings.Split(element, ";") {
+			kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+			if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+				chain = append(chain, kv[1])
+			}
+		}
+	}
+	return chain
+}
+
+// splitList splits all the header values by comma, several headers are the same as one joined by comma
+func splitList(headers []string) []string {
+	var values []string
+	for _, header := range headers {
+		for _, value := range strings.Split(header, ",") {
+			if value = strings.TrimSpace(value); len(value) > 0 {
+				values = append(values, value)
+			}
+		}
+	}
+	return values
+}
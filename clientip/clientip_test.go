@@ -0,0 +1,183 @@
+package clientip
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// the loopback and private networks, where a reverse proxy usually runs
+var privateNetworks = []string{
+	"127.0.0.0/8", "::1/128", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7",
+}
+
+func newRequest(remoteAddr string, headers map[string]string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/yeti", nil)
+	req.RemoteAddr = remoteAddr
+	for name, value := range headers {
+		req.Header.Add(name, value)
+	}
+	return req
+}
+
+func TestNormalize(t *testing.T) {
+	cases := map[string]string{
+		"1.2.3.4":                    "1.2.3.4",
+		"1.2.3.4:5678":               "1.2.3.4",
+		" 1.2.3.4 ":                  "1.2.3.4",
+		"[2001:DB8::0:1]:443":        "2001:db8::1",
+		"2001:0db8:0000::0001":       "2001:db8::1",
+		"[fe80::1%eth0]:80":          "fe80::1",
+		"::ffff:1.2.3.4":             "1.2.3.4",
+		`"[2001:db8:cafe::17]:4711"`: "2001:db8:cafe::17",
+		"unknown":                    "",
+		"_hidden":                    "",
+		"":                           "",
+	}
+
+	for address, expected := range cases {
+
+		// When:
+		normalized := Normalize(address)
+
+		// Then:
+		assert.Equal(t, expected, normalized, address)
+	}
+}
+
+func TestResolveIgnoresHeadersFromUntrustedClients(t *testing.T) {
+
+	// Given:
+	resolver, err := New(privateNetworks)
+	assert.Nil(t, err)
+	req := newRequest("8.8.8.8:1234", map[string]string{
+		"X-Forwarded-For": "1.1.1.1",
+		"X-Real-IP":       "1.1.1.1",
+	})
+
+	// When:
+	ip := resolver.Resolve(req)
+
+	// Then:
+	assert.Equal(t, "8.8.8.8", ip)
+}
+
+func TestResolveSkipsTrustedProxies(t *testing.T) {
+
+	// Given:
+	resolver, _ := New([]string{"172.16.0.0/12", "203.0.113.0/24"})
+
+	cases := map[string]*http.Request{
+		"the spoofed value is to the left": newRequest("172.18.0.2:1234", map[string]string{
+			"X-Forwarded-For": "6.6.6.6, 5.6.7.8, 203.0.113.10",
+		}),
+		"forwarded": newRequest("172.18.0.2:1234", map[string]string{
+			"Forwarded":       `for=6.6.6.6, for="5.6.7.8:1234";proto=https`,
+			"X-Forwarded-For": "9.9.9.9",
+		}),
+		"real ip": newRequest("172.18.0.2:1234", map[string]string{
+			"X-Real-IP": "5.6.7.8",
+		}),
+	}
+
+	for name, req := range cases {
+
+		// When:
+		ip := resolver.Resolve(req)
+
+		// Then:
+		assert.Equal(t, "5.6.7.8", ip, name)
+	}
+}
+
+func TestResolveIPv6Client(t *testing.T) {
+
+	// Given:
+	resolver, _ := New(privateNetworks)
+	req := newRequest("[::1]:1234", map[string]string{
+		"X-Forwarded-For": "2001:DB8:0::1",
+	})
+
+	// When:
+	ip := resolver.Resolve(req)
+
+	// Then:
+	assert.Equal(t, "2001:db8::1", ip)
+}
+
+func TestResolveStopsAtGarbage(t *testing.T) {
+
+	// Given:
+	resolver, _ := New(privateNetworks)
+	req := newRequest("10.0.0.1:1234", map[string]string{
+		"X-Forwarded-For": "6.6.6.6, unknown, 10.0.0.2",
+	})
+
+	// When:
+	ip := resolver.Resolve(req)
+
+	// Then:
+	assert.Equal(t, "10.0.0.2", ip)
+}
+
+func TestResolverWithoutProxiesTrustsNobody(t *testing.T) {
+
+	// Given:
+	resolver, err := New(nil)
+	assert.Nil(t, err)
+	req := newRequest("172.17.0.1:1234", map[string]string{
+		"X-Forwarded-For": "1.1.1.1",
+		"X-Real-IP":       "1.1.1.1",
+		"Forwarded":       "for=1.1.1.1",
+	})
+
+	// When:
+	ip := resolver.Resolve(req)
+
+	// Then:
+	assert.Equal(t, "172.17.0.1", ip)
+}
+
+func TestUntrustedProxyIsReported(t *testing.T) {
+
+	// Given:
+	var reported []string
+	resolver, _ := New([]string{"10.0.0.0/8"})
+	resolver.OnUntrustedProxy = func(remote string) {
+		reported = append(reported, remote)
+	}
+
+	// When:
+	resolver.Resolve(newRequest("172.17.0.1:1234", map[string]string{"X-Forwarded-For": "1.1.1.1"}))
+	resolver.Resolve(newRequest("10.0.0.1:1234", map[string]string{"X-Forwarded-For": "1.1.1.1"}))
+	resolver.Resolve(newRequest("8.8.8.8:1234", nil))
+
+	// Then:
+	assert.Equal(t, []string{"172.17.0.1"}, reported)
+}
+
+func TestMiddlewareSetsRemoteAddr(t *testing.T) {
+
+	// Given:
+	var remoteAddr string
+	handler := Resolver{}.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remoteAddr = r.RemoteAddr
+	}))
+
+	// When:
+	handler.ServeHTTP(httptest.NewRecorder(), newRequest("1.2.3.4:5678", map[string]string{"X-Real-IP": "6.6.6.6"}))
+
+	// Then:
+	assert.Equal(t, "1.2.3.4", remoteAddr)
+}
+
+func TestNewRejectsWrongNetworks(t *testing.T) {
+
+	// When:
+	_, err := New([]string{"10.0.0.0/8", "localhost"})
+
+	// Then:
+	assert.NotNil(t, err)
+}
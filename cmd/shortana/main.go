@@ -1,25 +1,57 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/w32blaster/shortana/bot"
+	"github.com/w32blaster/shortana/clientip"
 	"github.com/w32blaster/shortana/db"
 	"github.com/w32blaster/shortana/geoip"
+	"github.com/w32blaster/shortana/health"
+	"github.com/w32blaster/shortana/retention"
 	"github.com/w32blaster/shortana/shortener"
 	"github.com/w32blaster/shortana/stats"
+	"github.com/w32blaster/shortana/suffix"
+	"github.com/w32blaster/shortana/urlcheck"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/caarlos0/env"
 )
 
 type Opts struct {
-	Port              int    `env:"PORT" envDefault:"8444"`
-	Host              string `env:"HOST" envDefault:"http://localhost:3000"`
-	IsDebug           bool   `env:"IS_DEBUG"`
-	IsGeoIPReady      bool   `env:"IS_GEOIP_READY" envDefault:"false"`
-	BotToken          string `env:"BOT_TOKEN,required"`
-	AcceptFromUser    int    `env:"ACCEPT_FROM_USER"`
-	StoragePath       string `env:"STORAGE_PATH" envDefault:"."`
-	MaxmindLicenseKey string `env:"MAXMIND_LICENSE_KEY,required"`
+	Port              int           `env:"PORT" envDefault:"8444"`
+	Host              string        `env:"HOST" envDefault:"http://localhost:3000"`
+	IsDebug           bool          `env:"IS_DEBUG"`
+	IsGeoIPReady      bool          `env:"IS_GEOIP_READY" envDefault:"false"`
+	BotToken          string        `env:"BOT_TOKEN,required"`
+	AcceptFromUser    int           `env:"ACCEPT_FROM_USER"`
+	StoragePath       string        `env:"STORAGE_PATH" envDefault:"."`
+	MaxmindLicenseKey string        `env:"MAXMIND_LICENSE_KEY,required"`
+	ApiToken          string        `env:"API_TOKEN"`
+	DefaultRedirect   int           `env:"DEFAULT_REDIRECT" envDefault:"302"`
+	UtmSource         string        `env:"UTM_SOURCE"`
+	UtmMedium         string        `env:"UTM_MEDIUM"`
+	UtmCampaign       string        `env:"UTM_CAMPAIGN"`
+	SuffixStrategy    string        `env:"SUFFIX_STRATEGY" envDefault:"random"`
+	SuffixLength      int           `env:"SUFFIX_LENGTH" envDefault:"6"`
+	ReservedSuffixes  []string      `env:"RESERVED_SUFFIXES" envSeparator:","`
+	SuffixIgnoreCase  bool          `env:"SUFFIX_IGNORE_CASE"`
+	TargetSchemes     []string      `env:"TARGET_SCHEMES" envSeparator:"," envDefault:"http,https"`
+	AdminChatID       int64         `env:"ADMIN_CHAT_ID"`
+	HealthInterval    time.Duration `env:"HEALTH_CHECK_INTERVAL" envDefault:"6h"`
+	HealthTimeout     time.Duration `env:"HEALTH_CHECK_TIMEOUT" envDefault:"10s"`
+	CrawlerIPRanges   []string      `env:"CRAWLER_IP_RANGES" envSeparator:","`
+	TrustedProxies    []string      `env:"TRUSTED_PROXIES" envSeparator:","`
+	StatsWorkers      int           `env:"STATS_WORKERS" envDefault:"2"`
+	StatsQueueSize    int           `env:"STATS_QUEUE_SIZE" envDefault:"10000"`
+	StatsBatchSize    int           `env:"STATS_BATCH_SIZE" envDefault:"100"`
+	RetentionDays     int           `env:"STATS_RETENTION_DAYS" envDefault:"0"`
+	RollupInterval    time.Duration `env:"STATS_ROLLUP_INTERVAL" envDefault:"24h"`
+	FullReferrer      bool          `env:"STATS_FULL_REFERRER" envDefault:"false"`
 }
 
 func main() {
@@ -30,6 +62,18 @@ func main() {
 	if err := env.Parse(&opts); err != nil {
 		panic("Can't parse ENV VARS: " + err.Error())
 	}
+	if !db.IsValidRedirectType(opts.DefaultRedirect) {
+		panic(fmt.Sprintf("DEFAULT_REDIRECT must be one of %v", db.RedirectTypes))
+	}
+	suffixes, err := suffix.New(opts.SuffixStrategy, opts.SuffixLength)
+	if err != nil {
+		panic("Wrong SUFFIX_STRATEGY or SUFFIX_LENGTH: " + err.Error())
+	}
+	suffixPolicy := suffix.NewPolicy(opts.ReservedSuffixes, opts.SuffixIgnoreCase)
+	targets, err := urlcheck.New(opts.StoragePath, opts.Host, opts.TargetSchemes)
+	if err != nil {
+		panic("Can't load the " + urlcheck.BlocklistFile + ": " + err.Error())
+	}
 
 	// open the GeoIP database
 	geoIP := geoip.New(opts.StoragePath, opts.MaxmindLicenseKey, opts.IsGeoIPReady)
@@ -40,6 +84,14 @@ func main() {
 	defer database.Close()
 
 	statistics := stats.New(database, geoIP)
+	if err := statistics.SetCrawlerRanges(opts.CrawlerIPRanges); err != nil {
+		panic("Wrong CRAWLER_IP_RANGES: " + err.Error())
+	}
+	statistics.SetReferrerPolicy(opts.Host, opts.FullReferrer)
+	if opts.StatsWorkers <= 0 || opts.StatsQueueSize <= 0 || opts.StatsBatchSize <= 0 {
+		panic("STATS_WORKERS, STATS_QUEUE_SIZE and STATS_BATCH_SIZE must be positive")
+	}
+	statistics.Start(opts.StatsWorkers, opts.StatsQueueSize, opts.StatsBatchSize)
 
 	// for development only
 	if database.IsEmpty() {
@@ -50,11 +102,94 @@ func main() {
 		fmt.Println("Dummy data inserted")
 	}
 
+	// old views are rolled up in the background; the policy is given to the bot for the dry run
+	if opts.RetentionDays < 0 || opts.RollupInterval <= 0 {
+		panic("STATS_RETENTION_DAYS can't be negative and STATS_ROLLUP_INTERVAL must be positive")
+	}
+	retentionPolicy := retention.New(database, opts.RetentionDays)
+	stopRollups := make(chan struct{})
+	rollupsDone := make(chan struct{})
+	if retentionPolicy.IsEnabled() {
+		go retentionPolicy.Run(opts.RollupInterval, stopRollups, rollupsDone)
+	} else {
+		close(rollupsDone)
+	}
+
+	proxies, err := clientip.New(opts.TrustedProxies)
+	if err != nil {
+		panic("Wrong TRUSTED_PROXIES: " + err.Error())
+	}
+	if len(opts.TrustedProxies) == 0 {
+		fmt.Println("TRUSTED_PROXIES is not set, so the proxy headers are ignored and the address of the connection is used")
+	}
+
+	// behind a proxy that is not trusted all the visitors have the same address, so they share the rate limit,
+	// the password attempts and the statistics. It is logged once, because every request would have it
+	var untrustedProxyWarning sync.Once
+	proxies.OnUntrustedProxy = func(remote string) {
+		untrustedProxyWarning.Do(func() {
+			fmt.Println("WARNING! A request with X-Forwarded-For or other proxy headers came from " + remote +
+				", but it is not in TRUSTED_PROXIES, so the headers are ignored and all the visitors get this address. " +
+				"If it is your reverse proxy, add its network to TRUSTED_PROXIES")
+		})
+	}
+
 	// Run web server
-	go shortener.StartServer(database, statistics, opts.Host)
+	server := shortener.StartServer(database, statistics, geoIP, shortener.Config{
+		Hostname:            opts.Host,
+		ApiToken:            opts.ApiToken,
+		DefaultRedirectType: opts.DefaultRedirect,
+		DefaultUTM: db.UTM{
+			Source:   opts.UtmSource,
+			Medium:   opts.UtmMedium,
+			Campaign: opts.UtmCampaign,
+		},
+		Suffixes:     suffixes,
+		SuffixPolicy: suffixPolicy,
+		Targets:      targets,
+		Proxies:      proxies,
+	})
+
+	// broken links are reported to the only allowed user, if there is no special admin chat
+	adminChatID := opts.AdminChatID
+	if adminChatID == 0 {
+		adminChatID = int64(opts.AcceptFromUser)
+	}
 
 	// Run Telegram bot
-	bot.Start(database, statistics, geoIP, opts.BotToken, opts.Port, opts.AcceptFromUser, opts.Host, opts.IsDebug)
+	stopBot := make(chan struct{})
+	botDone := make(chan struct{})
+	go bot.Start(database, statistics, geoIP, health.New(database, opts.HealthTimeout), bot.Config{
+		BotToken:       opts.BotToken,
+		Port:           opts.Port,
+		AcceptFromUser: opts.AcceptFromUser,
+		AdminChatID:    adminChatID,
+		Hostname:       opts.Host,
+		IsDebug:        opts.IsDebug,
+		Suffixes:       suffixes,
+		SuffixPolicy:   suffixPolicy,
+		Targets:        targets,
+		HealthInterval: opts.HealthInterval,
+		Retention:      retentionPolicy,
+		RollupInterval: opts.RollupInterval,
+	}, stopBot, botDone)
+
+	// on shutdown stop accepting visits and bot updates first, then save the queued views, and only then close the database
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	fmt.Println("Stop the Shortana")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		fmt.Println("Web server didn't stop gracefully: " + err.Error())
+	}
+	close(stopBot)
+	<-botDone
+	close(stopRollups)
+	<-rollupsDone
+	statistics.Stop()
 }
 
 func saveDummyLink(database *db.Database, suffix, targetAddress, descr string, isPublic bool) {
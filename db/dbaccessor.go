@@ -1,19 +1,28 @@
 package db
 
 import (
+	"errors"
 	"github.com/asdine/storm/v3"
 	"github.com/asdine/storm/v3/codec/msgpack"
 	"github.com/asdine/storm/v3/q"
 	"go.etcd.io/bbolt"
 	"log"
+	"regexp"
+	"sort"
 	"strings"
 	"time"
 )
 
 const (
 	DayFormat = "2006-01-02"
+
+	MaxViewTimes = 100 // the latest view times kept per visitor and day, earlier views are only counted
+
+	TopReferrersCount = 10 // referrers shown in the statistics of one link
 )
 
+var ErrLinkExpired = errors.New("link is expired")
+
 type Database struct {
 	db           *storm.DB
 	licenseKey   string
@@ -28,9 +37,30 @@ func Init(storagePath string) *Database {
 		panic(err)
 	}
 
-	return &Database{
+	database := &Database{
 		db: boltdb,
 	}
+
+	// views saved by older versions have no key, so they couldn't be found to group the next visits
+	if database.hasViewsWithoutKeys() {
+		log.Println("Some views have no key, filling them in...")
+		if count, err := database.fillViewKeys(); err != nil {
+			log.Println("ERROR! Can't fill keys of the views: " + err.Error())
+		} else {
+			log.Printf("Keys are filled for %d views", count)
+		}
+	}
+
+	// databases created before the counters have only the views, so the counters are made once from them
+	if database.hasViewsWithoutCounters() {
+		log.Println("Statistics counters are missing, rebuilding them from the views...")
+		if count, err := database.RebuildCounters(); err != nil {
+			log.Println("ERROR! Can't rebuild statistics counters: " + err.Error())
+		} else {
+			log.Printf("Statistics counters are rebuilt from %d views", count)
+		}
+	}
+	return database
 }
 
 func (d Database) Close() {
@@ -62,12 +92,123 @@ func (d Database) UpdateShortUrl(id, fieldName string, value interface{}) error
 	return d.db.UpdateField(shortUrl, fieldName, value)
 }
 
+// EditShortUrl saves the target, description, visibility and suffix of the existing link in one transaction,
+// other fields (for example, clicks) are left as they are. When the suffix changes, the statistics are moved to
+// the new suffix as well. It returns storm.ErrAlreadyExists if the new suffix is taken
+func (d Database) EditShortUrl(edited *ShortURL) error {
+	tx, err := d.db.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var shortUrl ShortURL
+	if err := tx.One("ID", edited.ID, &shortUrl); err != nil {
+		return err
+	}
+
+	if shortUrl.ShortUrl != edited.ShortUrl {
+		var views []OneViewStatistic
+		if err := tx.Find("ShortUrl", shortUrl.ShortUrl, &views); err != nil && err != storm.ErrNotFound {
+			return err
+		}
+		for _, view := range views {
+			view.ShortUrl = edited.ShortUrl
+			view.Key = ViewKey(view.ShortUrl, view.Day, view.UserIpAddress, view.IsBot)
+			if err := tx.Update(&view); err != nil {
+				return err
+			}
+		}
+		if err := renameCounters(tx, shortUrl.ShortUrl, edited.ShortUrl); err != nil {
+			return err
+		}
+		if err := renameRollups(tx, shortUrl.ShortUrl, edited.ShortUrl); err != nil {
+			return err
+		}
+
+		var health LinkHealth
+		if err := tx.One("LinkID", shortUrl.ID, &health); err == nil {
+			if err := tx.UpdateField(&health, "ShortUrl", edited.ShortUrl); err != nil {
+				return err
+			}
+		} else if err != storm.ErrNotFound {
+			return err
+		}
+	}
+
+	shortUrl.ShortUrl = edited.ShortUrl
+	shortUrl.TargetUrl = edited.TargetUrl
+	shortUrl.Description = edited.Description
+	shortUrl.IsPublic = edited.IsPublic
+	if err := tx.Save(&shortUrl); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ModifyShortUrl loads the link, changes it with the given function and saves it in one transaction,
+// so either all the changes are saved or none. It returns the saved link
+func (d Database) ModifyShortUrl(ID int, modify func(link *ShortURL)) (*ShortURL, error) {
+	tx, err := d.db.Begin(true)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var shortUrl ShortURL
+	if err := tx.One("ID", ID, &shortUrl); err != nil {
+		return nil, err
+	}
+
+	modify(&shortUrl)
+	if err := tx.Save(&shortUrl); err != nil {
+		return nil, err
+	}
+	return &shortUrl, tx.Commit()
+}
+
+// RegisterClick counts one more click for a link with the limited click budget. The check and
+// the increment are made in one transaction, so concurrent visitors can't exceed the budget.
+// It returns ErrLinkExpired if the link can't be followed anymore
+func (d Database) RegisterClick(ID int) error {
+	tx, err := d.db.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var shortUrl ShortURL
+	if err := tx.One("ID", ID, &shortUrl); err != nil {
+		return err
+	}
+
+	if shortUrl.IsExpired(time.Now()) {
+		return ErrLinkExpired
+	}
+
+	if err := tx.UpdateField(&shortUrl, "Clicks", shortUrl.Clicks+1); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
 func (d Database) GetAll() ([]ShortURL, error) {
 	var shortUrls []ShortURL
 	err := d.db.All(&shortUrls)
 	return shortUrls, err
 }
 
+// GetIncompleteLinks returns links without the target URL
+func (d Database) GetIncompleteLinks() ([]ShortURL, error) {
+	var shortUrls []ShortURL
+	err := d.db.Select(q.Eq("TargetUrl", "")).Find(&shortUrls)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	return shortUrls, nil
+}
+
 func (d Database) IsEmpty() bool {
 	var shortUrls []ShortURL
 	d.db.All(&shortUrls)
@@ -91,6 +232,26 @@ func (d Database) GetUrl(suffix string) (*ShortURL, error) {
 	return &shortUrl, err
 }
 
+// FindUrl returns the link by its suffix. With ignoreCase the exact match is still preferred, so links
+// created before the case-insensitive mode was switched on keep working even if they differ only in case
+func (d Database) FindUrl(suffix string, ignoreCase bool) (*ShortURL, error) {
+	shortUrl, err := d.GetUrl(suffix)
+	if err != storm.ErrNotFound || !ignoreCase {
+		return shortUrl, err
+	}
+
+	var found ShortURL
+	err = d.db.Select(q.Re("ShortUrl", "(?i)^"+regexp.QuoteMeta(suffix)+"$")).First(&found)
+	return &found, err
+}
+
+// IsShortUrlTaken returns TRUE if some link already uses this suffix. Any unexpected error
+// is treated as "taken" to be on the safe side
+func (d Database) IsShortUrlTaken(suffix string, ignoreCase bool) bool {
+	_, err := d.FindUrl(suffix, ignoreCase)
+	return err != storm.ErrNotFound
+}
+
 func (d Database) GetUrlByID(ID int) (*ShortURL, error) {
 	var shortUrl ShortURL
 	err := d.db.One("ID", ID, &shortUrl)
@@ -123,6 +284,33 @@ func (d Database) DeleteShortURLandStats(ID int) error {
 		}
 	}
 
+	// delete the counters
+	var counters []ViewCounters
+	if err := tx.Find("ShortUrl", shortUrlPrefix, &counters); err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	for _, c := range counters {
+		if err := tx.DeleteStruct(&c); err != nil {
+			return err
+		}
+	}
+
+	// delete the rollups of old views
+	var rollups []DailyRollup
+	if err := tx.Find("ShortUrl", shortUrlPrefix, &rollups); err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	for _, rollup := range rollups {
+		if err := tx.DeleteStruct(&rollup); err != nil {
+			return err
+		}
+	}
+
+	// delete the result of the health check, if the link was ever checked
+	if err := tx.DeleteStruct(&LinkHealth{LinkID: shortUrl.ID}); err != nil && err != storm.ErrNotFound {
+		return err
+	}
+
 	// delete Short URL itself
 	if err := tx.DeleteStruct(&shortUrl); err != nil {
 		return err
@@ -133,135 +321,476 @@ func (d Database) DeleteShortURLandStats(ID int) error {
 	return tx.Commit()
 }
 
-func (d Database) GetStatisticsForOneURL(shortUrlID int) (*ShortURL, map[string]OneDaySummaryStatistics, error) {
+// GetStatisticsForOneURL returns views of one link grouped by day. Views of bots are counted only if includeBots is TRUE
+func (d Database) GetStatisticsForOneURL(shortUrlID int, includeBots bool) (*ShortURL, map[string]OneDaySummaryStatistics, error) {
 
 	sURL, err := d.GetUrlByID(shortUrlID)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	var views []OneViewStatistic
-	if err := d.db.Find("ShortUrl", sURL.ShortUrl, &views); err != nil {
+	var counters []ViewCounters
+	if err := d.db.Find("ShortUrl", sURL.ShortUrl, &counters); err != nil && err != storm.ErrNotFound {
 		return nil, nil, err
 	}
 
 	mapViews := make(map[string]OneDaySummaryStatistics)
-	for _, k := range views {
-		if existingView, found := mapViews[k.Day]; found {
-			existingView.TotalViews = existingView.TotalViews + len(k.ViewTimes)
-			existingView.UniqueViews++
-			mapViews[k.Day] = existingView
+	countries := make(map[string]map[string]bool)
+	for _, c := range counters {
+		if len(c.Day) == 0 || (c.IsBot && !includeBots) {
+			continue
+		}
 
-		} else {
-			mapViews[k.Day] = OneDaySummaryStatistics{
-				Date:               k.Day,
-				DateWithoutHyphens: strings.ReplaceAll(k.Day, "-", ""),
-				TotalViews:         len(k.ViewTimes),
-				UniqueViews:        1,
+		day, found := mapViews[c.Day]
+		if !found {
+			day = OneDaySummaryStatistics{
+				Date:               c.Day,
+				DateWithoutHyphens: strings.ReplaceAll(c.Day, "-", ""),
 			}
+			countries[c.Day] = make(map[string]bool)
 		}
+		day.TotalViews += c.Views
+		day.UniqueViews += c.Visitors
+		addCountries(countries[c.Day], c.Countries)
+		day.Countries = len(countries[c.Day])
+		mapViews[c.Day] = day
 	}
 
 	return sURL, mapViews, nil
 }
 
-func (d Database) GetStatisticForOneURLOneDay(shortUrlID int, dayDate time.Time) (*ShortURL, []OneViewStatistic, error) {
+// GetVariantStatisticsForOneURL returns views for every variant of the A/B split. Variants are
+// taken from the current link settings, so a variant without views is also in the list
+func (d Database) GetVariantStatisticsForOneURL(shortUrlID int, includeBots bool) ([]VariantSummaryStatistics, error) {
+
+	sURL, err := d.GetUrlByID(shortUrlID)
+	if err != nil {
+		return nil, err
+	}
+
+	totalWeight := 0
+	for _, variant := range sURL.Variants {
+		totalWeight += variant.Weight
+	}
+
+	summary := make([]VariantSummaryStatistics, len(sURL.Variants))
+	for i, variant := range sURL.Variants {
+		summary[i] = VariantSummaryStatistics{
+			Variant:   i + 1,
+			TargetUrl: variant.TargetUrl,
+			Weight:    variant.Weight,
+		}
+
+		// links saved before the weights were validated can have only zero weights
+		if totalWeight > 0 {
+			summary[i].Percent = variant.Weight * 100 / totalWeight
+		}
+	}
+
+	if len(summary) == 0 {
+		return summary, nil
+	}
+
+	views, err := d.findViews(sURL.ShortUrl, includeBots)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, view := range views {
+		if view.Variant > 0 && view.Variant <= len(summary) {
+			summary[view.Variant-1].TotalViews += view.ViewCount()
+			summary[view.Variant-1].UniqueViews++
+		}
+	}
+
+	// views older than the retention period exist only as rollups
+	rollups, err := d.findRollups(sURL.ShortUrl, includeBots)
+	if err != nil {
+		return nil, err
+	}
+	for _, rollup := range rollups {
+		if rollup.Variant > 0 && rollup.Variant <= len(summary) {
+			summary[rollup.Variant-1].TotalViews += rollup.Views
+			summary[rollup.Variant-1].UniqueViews += rollup.Visitors
+		}
+	}
+
+	return summary, nil
+}
+
+func (d Database) GetStatisticForOneURLOneDay(shortUrlID int, dayDate time.Time, includeBots bool) (*ShortURL, []OneViewStatistic, error) {
 
 	sURL, err := d.GetUrlByID(shortUrlID)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	query := d.db.Select(
-		q.And(
-			q.Eq("ShortUrl", sURL.ShortUrl),
-			q.Eq("Day", dayDate.Format(DayFormat)),
-		),
-	)
+	matchers := []q.Matcher{
+		q.Eq("ShortUrl", sURL.ShortUrl),
+		q.Eq("Day", dayDate.Format(DayFormat)),
+	}
+	if !includeBots {
+		matchers = append(matchers, q.Eq("IsBot", false))
+	}
+	query := d.db.Select(q.And(matchers...))
 
 	var foundViews []OneViewStatistic
-	err = query.Find(&foundViews)
-	return sURL, foundViews, err
+	if err = query.Find(&foundViews); err != nil && err != storm.ErrNotFound {
+		return nil, nil, err
+	}
+	return sURL, foundViews, nil
 }
 
-func (d Database) GetAllStatisticsGroupedByURLs() (map[string]OneURLSummaryStatistics, error) {
+// GetAllStatisticsGroupedByURLs returns summary for every link that has views. Views of bots are counted only if includeBots is TRUE
+func (d Database) GetAllStatisticsGroupedByURLs(includeBots bool) (map[string]OneURLSummaryStatistics, error) {
 	groupedStats := make(map[string]OneURLSummaryStatistics)
 
-	var stats []OneViewStatistic
-	err := d.db.All(&stats)
+	allShortUrls, err := d.GetAllMapped()
 	if err != nil {
 		return groupedStats, err
 	}
 
-	allShortUrls, err := d.GetAllMapped()
+	for _, link := range allShortUrls {
+		totals, err := d.getCounters(link.ShortUrl, "", includeBots)
+		if err != nil {
+			return groupedStats, err
+		}
+		if totals.Views == 0 {
+			continue
+		}
+
+		pDate, _ := time.Parse(DayFormat, link.PublishDate)
+		duration := time.Now().Sub(pDate)
+
+		countries := make(map[string]bool)
+		addCountries(countries, totals.Countries)
+
+		groupedStats[link.ShortUrl] = OneURLSummaryStatistics{
+			ID:               link.ID,
+			ShortUrlID:       link.ID,
+			ShortUrl:         link.ShortUrl,
+			PublishDate:      link.PublishDate,
+			TotalDaysActive:  int(duration.Hours() / 24),
+			TotalViews:       totals.Views,
+			TotalUniqueUsers: totals.Visitors,
+			TotalCountries:   len(countries),
+		}
+	}
+
+	return groupedStats, nil
+}
+
+// getCounters returns the counters of the link for the day or, if the day is empty, for the whole time.
+// Views of bots are added only if includeBots is TRUE
+func (d Database) getCounters(shortUrl, day string, includeBots bool) (ViewCounters, error) {
+	var totals ViewCounters
+	kinds := []bool{false}
+	if includeBots {
+		kinds = append(kinds, true)
+	}
+
+	for _, isBot := range kinds {
+		var c ViewCounters
+		err := d.db.One("ID", CountersID(shortUrl, day, isBot), &c)
+		if err == storm.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return totals, err
+		}
+
+		totals.add(&c)
+	}
+	return totals, nil
+}
+
+// GetClientBreakdown splits the visitors of the link by device class, operating system and browser for the day or,
+// if the day is empty, for the whole time. Visitors of bots are counted only if includeBots is TRUE
+func (d Database) GetClientBreakdown(shortUrl, day string, includeBots bool) (*ClientBreakdown, error) {
+	counters, err := d.getCounters(shortUrl, day, includeBots)
 	if err != nil {
-		return groupedStats, err
+		return nil, err
 	}
 
-	for _, k := range stats {
-		if oneShortUrl, found := groupedStats[k.ShortUrl]; found {
+	return &ClientBreakdown{
+		Devices:  shares(counters.Devices, counters.Visitors),
+		OS:       shares(counters.OS, counters.Visitors),
+		Browsers: shares(counters.Browsers, counters.Visitors),
+	}, nil
+}
+
+// GetTopReferrers returns domains that brought the most visitors to the link for the day or, if the day is empty,
+// for the whole time. Direct visits have the empty domain. Visitors of bots are counted only if includeBots is TRUE
+func (d Database) GetTopReferrers(shortUrl, day string, includeBots bool, limit int) ([]ReferrerStatistics, error) {
+	counters, err := d.getCounters(shortUrl, day, includeBots)
+	if err != nil {
+		return nil, err
+	}
 
-			// update record that is already in the map
-			oneShortUrl.TotalViews = oneShortUrl.TotalViews + len(k.ViewTimes)
-			oneShortUrl.TotalUniqueUsers++
-			groupedStats[k.ShortUrl] = oneShortUrl
+	referrers := make([]ReferrerStatistics, 0, len(counters.Referrers))
+	for domain, visitors := range counters.Referrers {
+		referrers = append(referrers, ReferrerStatistics{Domain: domain, Visitors: visitors})
+	}
+	sort.Slice(referrers, func(i, j int) bool {
+		if referrers[i].Visitors != referrers[j].Visitors {
+			return referrers[i].Visitors > referrers[j].Visitors
+		}
+		return referrers[i].Domain < referrers[j].Domain
+	})
 
-		} else {
+	if len(referrers) > limit {
+		referrers = referrers[:limit]
+	}
+	return referrers, nil
+}
 
-			publishDate := allShortUrls[k.ShortUrl].PublishDate
-			pDate, _ := time.Parse(DayFormat, publishDate)
-			duration := time.Now().Sub(pDate)
-
-			// add a new record to the map
-			groupedStats[k.ShortUrl] = OneURLSummaryStatistics{
-				ID:               k.ID,
-				ShortUrlID:       allShortUrls[k.ShortUrl].ID,
-				ShortUrl:         k.ShortUrl,
-				PublishDate:      publishDate,
-				TotalDaysActive:  int(duration.Hours() / 24),
-				TotalViews:       len(k.ViewTimes),
-				TotalUniqueUsers: 1,
-			}
+// addCountries adds known country codes to the set, the unknown one is skipped
+func addCountries(set map[string]bool, countries map[string]int) {
+	for code := range countries {
+		if len(code) > 0 {
+			set[code] = true
 		}
 	}
+}
+
+// SaveStatisticForOneView saves one visit. All the visits of the same user to the same URL
+// during one day are grouped into one record
+func (d Database) SaveStatisticForOneView(view *OneViewStatistic) error {
+	views := []OneViewStatistic{*view}
+	err := d.SaveStatisticsForViews(views)
+	*view = views[0]
+	return err
+}
+
+// SaveStatisticsForViews saves many visits in one transaction. The time of the visit is taken from
+// the ViewTimes, if it is set, otherwise it is the current time
+func (d Database) SaveStatisticsForViews(views []OneViewStatistic) error {
+	tx, err := d.db.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-	return groupedStats, err
+	for i := range views {
+		if err := saveView(tx, &views[i]); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
-func (d Database) SaveStatisticForOneView(ipAddress, requestedUrl, countryCode, countryName, city, userAgent string) error {
+func saveView(tx storm.Node, view *OneViewStatistic) error {
 
 	now := time.Now().UTC()
+	if len(view.ViewTimes) > 0 {
+		now = view.ViewTimes[0].UTC()
+	}
 	day := now.Format(DayFormat)
 
-	// firstly, find whether this user has already accessed this URL
-	query := d.db.Select(
-		q.And(
-			q.Eq("UserIpAddress", ipAddress),
-			q.Eq("ShortUrl", requestedUrl),
-			q.Eq("Day", day),
-		),
-	)
-
+	// firstly, find whether this user has already accessed this URL. A bot is never grouped
+	// with a person, even if they have the same IP address
+	key := ViewKey(view.ShortUrl, day, view.UserIpAddress, view.IsBot)
 	var foundView OneViewStatistic
-	err := query.First(&foundView)
-	if err != nil {
+	err := tx.One("Key", key, &foundView)
+	if err == storm.ErrNotFound {
 
 		// not found, create a fresh record
-		return d.db.Save(&OneViewStatistic{
-			UserIpAddress: ipAddress,
-			ShortUrl:      requestedUrl,
-			CountryCode:   countryCode,
-			CountryName:   countryName,
-			City:          city,
-			Day:           day,
-			UserAgent:     userAgent,
-			ViewTimes:     []time.Time{now},
-		})
-	}
-
-	// update existing one
+		view.Key = key
+		view.Day = day
+		view.ViewTimes = []time.Time{now}
+		view.Views = 1
+		if err := tx.Save(view); err != nil {
+			return err
+		}
+		return countView(tx, view, true)
+	}
+	if err != nil {
+		return err
+	}
+
+	// update existing one; the referrer is of the first visit, so the visitor is counted only once
+	// the popular visitors, such as monitoring tools, would make the record grow forever, so only the count is kept for them
+	foundView.Views = foundView.ViewCount() + 1
 	foundView.ViewTimes = append(foundView.ViewTimes, now)
-	return d.db.Update(&foundView)
+	if len(foundView.ViewTimes) > MaxViewTimes {
+		foundView.ViewTimes = foundView.ViewTimes[len(foundView.ViewTimes)-MaxViewTimes:]
+	}
+	if err := tx.Update(&foundView); err != nil {
+		return err
+	}
+	return countView(tx, &foundView, false)
+}
+
+// countView adds one view to the counters of the link for its day and for the whole time
+func countView(tx storm.Node, view *OneViewStatistic, isNewVisitor bool) error {
+	for _, day := range []string{view.Day, ""} {
+		counters := ViewCounters{
+			ID:       CountersID(view.ShortUrl, day, view.IsBot),
+			ShortUrl: view.ShortUrl,
+			Day:      day,
+			IsBot:    view.IsBot,
+		}
+		if err := tx.One("ID", counters.ID, &counters); err != nil && err != storm.ErrNotFound {
+			return err
+		}
+
+		counters.countView(view, 1, isNewVisitor)
+		if err := tx.Save(&counters); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renameCounters moves the counters to the new suffix of the link. The suffix is a part of the ID, so they are saved again
+func renameCounters(tx storm.Node, oldShortUrl, newShortUrl string) error {
+	var counters []ViewCounters
+	if err := tx.Find("ShortUrl", oldShortUrl, &counters); err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	for _, c := range counters {
+		if err := tx.DeleteStruct(&c); err != nil {
+			return err
+		}
+		c.ShortUrl = newShortUrl
+		c.ID = CountersID(c.ShortUrl, c.Day, c.IsBot)
+		if err := tx.Save(&c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RebuildCounters makes all the counters again from the saved views in one transaction,
+// in case they were lost or went wrong. It returns the number of OneViewStatistic records that were counted
+func (d Database) RebuildCounters() (int, error) {
+	tx, err := d.db.Begin(true)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if err := tx.Drop(&ViewCounters{}); err != nil && err != bbolt.ErrBucketNotFound {
+		return 0, err
+	}
+
+	allCounters := make(map[string]*ViewCounters)
+	countersOf := func(shortUrl, day string, isBot bool) []*ViewCounters {
+		var found []*ViewCounters
+		for _, counterDay := range []string{day, ""} {
+			id := CountersID(shortUrl, counterDay, isBot)
+			counters, ok := allCounters[id]
+			if !ok {
+				counters = &ViewCounters{ID: id, ShortUrl: shortUrl, Day: counterDay, IsBot: isBot}
+				allCounters[id] = counters
+			}
+			found = append(found, counters)
+		}
+		return found
+	}
+
+	count := 0
+	err = tx.Select().Each(new(OneViewStatistic), func(record interface{}) error {
+		view := record.(*OneViewStatistic)
+		count++
+		for _, counters := range countersOf(view.ShortUrl, view.Day, view.IsBot) {
+			counters.countView(view, view.ViewCount(), true)
+		}
+		return nil
+	})
+	if err != nil && err != storm.ErrNotFound {
+		return 0, err
+	}
+
+	// views older than the retention period exist only as rollups
+	err = tx.Select().Each(new(DailyRollup), func(record interface{}) error {
+		rollup := record.(*DailyRollup)
+		for _, counters := range countersOf(rollup.ShortUrl, rollup.Day, rollup.IsBot) {
+			counters.countRollup(rollup)
+		}
+		return nil
+	})
+	if err != nil && err != storm.ErrNotFound {
+		return 0, err
+	}
+
+	for _, counters := range allCounters {
+		if err := tx.Save(counters); err != nil {
+			return 0, err
+		}
+	}
+	return count, tx.Commit()
+}
+
+// hasViewsWithoutCounters returns TRUE if there are views, but no counters were ever saved
+func (d Database) hasViewsWithoutCounters() bool {
+	var view OneViewStatistic
+	if err := d.db.Select().First(&view); err != nil {
+		return false
+	}
+	var counters ViewCounters
+	return d.db.Select().First(&counters) == storm.ErrNotFound
+}
+
+// hasViewsWithoutKeys returns TRUE if any view has no key, so it was saved by an older version
+func (d Database) hasViewsWithoutKeys() bool {
+	var view OneViewStatistic
+	return d.db.Select(q.Eq("Key", "")).First(&view) == nil
+}
+
+// fillViewKeys sets the key of every view that has none. If the key is taken already, then the view is left
+// without it, it is still counted, but the next visits are grouped with the other one
+func (d Database) fillViewKeys() (int, error) {
+	tx, err := d.db.Begin(true)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var views []OneViewStatistic
+	if err := tx.Select(q.Eq("Key", "")).Find(&views); err != nil && err != storm.ErrNotFound {
+		return 0, err
+	}
+
+	count := 0
+	for _, view := range views {
+		view.Key = ViewKey(view.ShortUrl, view.Day, view.UserIpAddress, view.IsBot)
+		var other OneViewStatistic
+		if err := tx.One("Key", view.Key, &other); err == nil {
+			continue
+		} else if err != storm.ErrNotFound {
+			return 0, err
+		}
+		if err := tx.Update(&view); err != nil {
+			return 0, err
+		}
+		count++
+	}
+	return count, tx.Commit()
+}
+
+// findViews returns all the views of the link
+func (d Database) findViews(shortUrl string, includeBots bool) ([]OneViewStatistic, error) {
+	var views []OneViewStatistic
+	if err := d.db.Find("ShortUrl", shortUrl, &views); err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	return withoutBots(views, includeBots), nil
+}
+
+// withoutBots filters out views of bots, unless they are included
+func withoutBots(views []OneViewStatistic, includeBots bool) []OneViewStatistic {
+	if includeBots {
+		return views
+	}
+
+	filtered := views[:0]
+	for _, view := range views {
+		if !view.IsBot {
+			filtered = append(filtered, view)
+		}
+	}
+	return filtered
 }
 
 func (d Database) GetViewByID(ID int) (*OneViewStatistic, error) {
@@ -269,3 +798,82 @@ func (d Database) GetViewByID(ID int) (*OneViewStatistic, error) {
 	err := d.db.One("ID", ID, &view)
 	return &view, err
 }
+
+// GetSession returns the dialog state of the user in the chat, or a new empty session if there is no dialog
+func (d Database) GetSession(chatID int64, userID int) (*Session, error) {
+	var session Session
+	err := d.db.One("ID", SessionID(chatID, userID), &session)
+	if err == storm.ErrNotFound {
+		return &Session{ID: SessionID(chatID, userID), ChatID: chatID}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// SaveSession saves the dialog state and refreshes its timestamp
+func (d Database) SaveSession(session *Session) error {
+	session.UpdatedAt = time.Now()
+	return d.db.Save(session)
+}
+
+// DeleteSession removes the dialog state, it is fine if there is no such session
+func (d Database) DeleteSession(ID string) error {
+	err := d.db.DeleteStruct(&Session{ID: ID})
+	if err == storm.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// GetSessionsUpdatedBefore returns the dialogs that were idle since the given time
+func (d Database) GetSessionsUpdatedBefore(before time.Time) ([]Session, error) {
+	var sessions []Session
+	err := d.db.Select(q.Lt("UpdatedAt", before)).Find(&sessions)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// SaveLinkHealth saves the result of the last check of the link
+func (d Database) SaveLinkHealth(health *LinkHealth) error {
+	return d.db.Save(health)
+}
+
+// GetLinkHealth returns the last check of the link, storm.ErrNotFound means it was never checked
+func (d Database) GetLinkHealth(linkID int) (*LinkHealth, error) {
+	var health LinkHealth
+	err := d.db.One("LinkID", linkID, &health)
+	return &health, err
+}
+
+// GetAllLinkHealth returns the last checks of all the links, mapped by the link ID
+func (d Database) GetAllLinkHealth() (map[int]LinkHealth, error) {
+	var checks []LinkHealth
+	if err := d.db.All(&checks); err != nil {
+		return nil, err
+	}
+
+	mapped := make(map[int]LinkHealth, len(checks))
+	for _, health := range checks {
+		mapped[health.LinkID] = health
+	}
+	return mapped, nil
+}
+
+// GetChatSettings returns preferences of the chat, or the default ones if they were never changed
+func (d Database) GetChatSettings(chatID int64) (*ChatSettings, error) {
+	var settings ChatSettings
+	err := d.db.One("ChatID", chatID, &settings)
+	if err == storm.ErrNotFound {
+		return &ChatSettings{ChatID: chatID}, nil
+	}
+	return &settings, err
+}
+
+// SaveChatSettings saves preferences of the chat
+func (d Database) SaveChatSettings(settings *ChatSettings) error {
+	return d.db.Save(settings)
+}
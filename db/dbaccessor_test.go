@@ -0,0 +1,439 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/asdine/storm/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestDatabase(t *testing.T) *Database {
+	dir, err := ioutil.TempDir("", "shortana")
+	assert.Nil(t, err)
+
+	database := Init(dir)
+	t.Cleanup(func() {
+		database.Close()
+		os.RemoveAll(dir)
+	})
+	return database
+}
+
+func TestSessionIsKeptPerChatAndUser(t *testing.T) {
+
+	// Given:
+	database := newTestDatabase(t)
+	session, err := database.GetSession(100, 1)
+	assert.Nil(t, err)
+	session.Step = 3
+	session.ShortUrl = "abc"
+	assert.Nil(t, database.SaveSession(session))
+
+	// When:
+	sameSession, err := database.GetSession(100, 1)
+	assert.Nil(t, err)
+	otherUserSession, err := database.GetSession(100, 2)
+	assert.Nil(t, err)
+
+	// Then:
+	assert.Equal(t, 3, sameSession.Step)
+	assert.Equal(t, "abc", sameSession.ShortUrl)
+	assert.Equal(t, int64(100), sameSession.ChatID)
+	assert.Equal(t, 0, otherUserSession.Step)
+	assert.Equal(t, "100:2", otherUserSession.ID)
+}
+
+func TestIdleSessions(t *testing.T) {
+
+	// Given:
+	database := newTestDatabase(t)
+	session, _ := database.GetSession(100, 1)
+	assert.Nil(t, database.SaveSession(session))
+
+	// When:
+	idleBefore, err := database.GetSessionsUpdatedBefore(time.Now().Add(-time.Minute))
+	assert.Nil(t, err)
+	idleAfter, err := database.GetSessionsUpdatedBefore(time.Now().Add(time.Minute))
+	assert.Nil(t, err)
+
+	// Then:
+	assert.Len(t, idleBefore, 0)
+	assert.Len(t, idleAfter, 1)
+
+	// and:
+	assert.Nil(t, database.DeleteSession(session.ID))
+	assert.Nil(t, database.DeleteSession(session.ID))
+	idleAfter, _ = database.GetSessionsUpdatedBefore(time.Now().Add(time.Minute))
+	assert.Len(t, idleAfter, 0)
+}
+
+func TestGetIncompleteLinks(t *testing.T) {
+
+	// Given:
+	database := newTestDatabase(t)
+	assert.Nil(t, database.SaveShortUrl("ok", "https://example.com", "", true))
+	assert.Nil(t, database.SaveShortUrlObject(&ShortURL{ShortUrl: "half"}))
+
+	// When:
+	links, err := database.GetIncompleteLinks()
+
+	// Then:
+	assert.Nil(t, err)
+	assert.Len(t, links, 1)
+	assert.Equal(t, "half", links[0].ShortUrl)
+}
+
+func TestEditShortUrlMovesStatistics(t *testing.T) {
+
+	// Given:
+	database := newTestDatabase(t)
+	assert.Nil(t, database.SaveShortUrl("old", "https://example.com", "", true))
+	assert.Nil(t, database.SaveShortUrl("taken", "https://example.org", "", true))
+	assert.Nil(t, database.SaveStatisticForOneView(&OneViewStatistic{UserIpAddress: "1.2.3.4", ShortUrl: "old"}))
+	assert.Nil(t, database.SaveLinkHealth(&LinkHealth{LinkID: 1, ShortUrl: "old", TargetUrl: "https://example.com", StatusCode: 200}))
+	assert.Nil(t, database.RegisterClick(1))
+
+	// When:
+	err := database.EditShortUrl(&ShortURL{ID: 1, ShortUrl: "new", TargetUrl: "https://example.com/new", Description: "New one"})
+
+	// Then:
+	assert.Nil(t, err)
+	link, err := database.GetUrl("new")
+	assert.Nil(t, err)
+	assert.Equal(t, "https://example.com/new", link.TargetUrl)
+	assert.Equal(t, "New one", link.Description)
+	assert.False(t, link.IsPublic)
+	assert.Equal(t, 1, link.Clicks)
+	_, err = database.GetUrl("old")
+	assert.NotNil(t, err)
+
+	// and:
+	_, days, err := database.GetStatisticsForOneURL(1, false)
+	assert.Nil(t, err)
+	assert.Len(t, days, 1)
+
+	// and:
+	health, err := database.GetLinkHealth(1)
+	assert.Nil(t, err)
+	assert.Equal(t, "new", health.ShortUrl)
+
+	// and: the next visit is grouped with the moved one
+	assert.Nil(t, database.SaveStatisticForOneView(&OneViewStatistic{UserIpAddress: "1.2.3.4", ShortUrl: "new"}))
+	grouped, err := database.GetAllStatisticsGroupedByURLs(false)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, grouped["new"].TotalViews)
+	assert.Equal(t, 1, grouped["new"].TotalUniqueUsers)
+
+	// and:
+	err = database.EditShortUrl(&ShortURL{ID: 1, ShortUrl: "taken", TargetUrl: "https://example.com/new"})
+	assert.Equal(t, storm.ErrAlreadyExists, err)
+}
+
+func TestFindUrlIgnoringCase(t *testing.T) {
+
+	// Given:
+	database := newTestDatabase(t)
+	assert.Nil(t, database.SaveShortUrl("yeti", "https://example.com/lower", "", true))
+	assert.Nil(t, database.SaveShortUrl("Yeti", "https://example.com/upper", "", true))
+	assert.Nil(t, database.SaveShortUrl("a.b", "https://example.com/dot", "", true))
+
+	// When:
+	exact, errExact := database.FindUrl("Yeti", true)
+	folded, errFolded := database.FindUrl("YETI", true)
+	_, errCaseSensitive := database.FindUrl("YETI", false)
+	_, errPattern := database.FindUrl("a_b", true)
+
+	// Then:
+	assert.Nil(t, errExact)
+	assert.Equal(t, "https://example.com/upper", exact.TargetUrl)
+	assert.Nil(t, errFolded)
+	assert.Contains(t, folded.TargetUrl, "https://example.com/")
+	assert.Equal(t, storm.ErrNotFound, errCaseSensitive)
+	assert.Equal(t, storm.ErrNotFound, errPattern)
+
+	// and:
+	assert.True(t, database.IsShortUrlTaken("YETI", true))
+	assert.False(t, database.IsShortUrlTaken("YETI", false))
+}
+
+func TestStatisticsExcludeBots(t *testing.T) {
+
+	// Given:
+	database := newTestDatabase(t)
+	assert.Nil(t, database.SaveShortUrl("yeti", "https://example.com", "", true))
+	assert.Nil(t, database.SaveStatisticForOneView(&OneViewStatistic{UserIpAddress: "1.2.3.4", ShortUrl: "yeti"}))
+	assert.Nil(t, database.SaveStatisticForOneView(&OneViewStatistic{UserIpAddress: "1.2.3.4", ShortUrl: "yeti", IsBot: true}))
+	assert.Nil(t, database.SaveStatisticForOneView(&OneViewStatistic{UserIpAddress: "5.6.7.8", ShortUrl: "yeti", IsBot: true}))
+	today := time.Now().UTC()
+
+	// When:
+	grouped, errGrouped := database.GetAllStatisticsGroupedByURLs(false)
+	groupedWithBots, _ := database.GetAllStatisticsGroupedByURLs(true)
+	_, days, errDays := database.GetStatisticsForOneURL(1, false)
+	_, views, errViews := database.GetStatisticForOneURLOneDay(1, today, false)
+	_, viewsWithBots, _ := database.GetStatisticForOneURLOneDay(1, today, true)
+
+	// Then:
+	assert.Nil(t, errGrouped)
+	assert.Equal(t, 1, grouped["yeti"].TotalUniqueUsers)
+	assert.Equal(t, 3, groupedWithBots["yeti"].TotalUniqueUsers, "a bot is not grouped with a person from the same IP")
+
+	// and:
+	assert.Nil(t, errDays)
+	assert.Equal(t, 1, days[today.Format(DayFormat)].TotalViews)
+	assert.Nil(t, errViews)
+	assert.Len(t, views, 1)
+	assert.False(t, views[0].IsBot)
+	assert.Len(t, viewsWithBots, 3)
+}
+
+func TestSaveStatisticsForViewsGroupsBatchInOneTransaction(t *testing.T) {
+
+	// Given:
+	database := newTestDatabase(t)
+	assert.Nil(t, database.SaveShortUrl("yeti", "https://example.com", "", true))
+	morning := time.Date(2020, 12, 1, 9, 0, 0, 0, time.UTC)
+	views := []OneViewStatistic{
+		{UserIpAddress: "1.2.3.4", ShortUrl: "yeti", ViewTimes: []time.Time{morning}},
+		{UserIpAddress: "1.2.3.4", ShortUrl: "yeti", ViewTimes: []time.Time{morning.Add(time.Hour)}},
+		{UserIpAddress: "5.6.7.8", ShortUrl: "yeti", ViewTimes: []time.Time{morning.Add(24 * time.Hour)}},
+	}
+
+	// When:
+	err := database.SaveStatisticsForViews(views)
+
+	// Then:
+	assert.Nil(t, err)
+	_, days, err := database.GetStatisticsForOneURL(1, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, days["2020-12-01"].TotalViews, "the same visitor on the same day is grouped, even within one batch")
+	assert.Equal(t, 1, days["2020-12-01"].UniqueViews)
+	assert.Equal(t, 1, days["2020-12-02"].TotalViews)
+}
+
+func TestCountersAreUpdatedWithViews(t *testing.T) {
+
+	// Given:
+	database := newTestDatabase(t)
+	assert.Nil(t, database.SaveShortUrl("yeti", "https://example.com", "", true))
+	assert.Nil(t, database.SaveShortUrl("quiet", "https://example.org", "", true))
+	day := time.Date(2020, 12, 1, 9, 0, 0, 0, time.UTC)
+
+	// When:
+	assert.Nil(t, database.SaveStatisticsForViews([]OneViewStatistic{
+		{UserIpAddress: "1.2.3.4", ShortUrl: "yeti", CountryCode: "DE", ViewTimes: []time.Time{day}},
+		{UserIpAddress: "1.2.3.4", ShortUrl: "yeti", CountryCode: "DE", ViewTimes: []time.Time{day}},
+		{UserIpAddress: "5.6.7.8", ShortUrl: "yeti", CountryCode: "FR", ViewTimes: []time.Time{day}},
+		{UserIpAddress: "1.2.3.4", ShortUrl: "yeti", CountryCode: "DE", ViewTimes: []time.Time{day.AddDate(0, 0, 1)}},
+		{UserIpAddress: "9.9.9.9", ShortUrl: "yeti", ViewTimes: []time.Time{day.AddDate(0, 0, 1)}},
+	}))
+
+	// Then:
+	grouped, err := database.GetAllStatisticsGroupedByURLs(false)
+	assert.Nil(t, err)
+	assert.Len(t, grouped, 1, "links without views are not in the summary")
+	assert.Equal(t, 5, grouped["yeti"].TotalViews)
+	assert.Equal(t, 4, grouped["yeti"].TotalUniqueUsers)
+	assert.Equal(t, 2, grouped["yeti"].TotalCountries, "the unknown country is not counted")
+
+	// and:
+	_, days, err := database.GetStatisticsForOneURL(1, false)
+	assert.Nil(t, err)
+	assert.Equal(t, OneDaySummaryStatistics{Date: "2020-12-01", DateWithoutHyphens: "20201201", TotalViews: 3, UniqueViews: 2, Countries: 2}, days["2020-12-01"])
+	assert.Equal(t, OneDaySummaryStatistics{Date: "2020-12-02", DateWithoutHyphens: "20201202", TotalViews: 2, UniqueViews: 2, Countries: 1}, days["2020-12-02"])
+}
+
+func TestRebuildCounters(t *testing.T) {
+
+	// Given:
+	database := newTestDatabase(t)
+	assert.Nil(t, database.SaveShortUrl("yeti", "https://example.com", "", true))
+	assert.Nil(t, database.SaveStatisticForOneView(&OneViewStatistic{UserIpAddress: "1.2.3.4", ShortUrl: "yeti", CountryCode: "DE"}))
+	assert.Nil(t, database.SaveStatisticForOneView(&OneViewStatistic{UserIpAddress: "1.2.3.4", ShortUrl: "yeti", CountryCode: "DE"}))
+	assert.Nil(t, database.SaveStatisticForOneView(&OneViewStatistic{UserIpAddress: "5.6.7.8", ShortUrl: "yeti", IsBot: true}))
+	expected, _ := database.GetAllStatisticsGroupedByURLs(true)
+
+	// and: the counters went wrong
+	assert.Nil(t, database.db.Save(&ViewCounters{ID: CountersID("yeti", "", false), ShortUrl: "yeti", Views: 100}))
+
+	// When:
+	count, err := database.RebuildCounters()
+
+	// Then:
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count, "two views of the same visitor are one record")
+	grouped, err := database.GetAllStatisticsGroupedByURLs(true)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, grouped)
+	assert.Equal(t, 3, grouped["yeti"].TotalViews)
+}
+
+func TestDeleteShortURLDeletesCounters(t *testing.T) {
+
+	// Given:
+	database := newTestDatabase(t)
+	assert.Nil(t, database.SaveShortUrl("yeti", "https://example.com", "", true))
+	assert.Nil(t, database.SaveStatisticForOneView(&OneViewStatistic{UserIpAddress: "1.2.3.4", ShortUrl: "yeti"}))
+
+	// When:
+	err := database.DeleteShortURLandStats(1)
+
+	// Then:
+	assert.Nil(t, err)
+	var counters []ViewCounters
+	assert.Nil(t, database.db.All(&counters))
+	assert.Empty(t, counters)
+}
+
+func TestClientBreakdown(t *testing.T) {
+
+	// Given:
+	database := newTestDatabase(t)
+	assert.Nil(t, database.SaveShortUrl("yeti", "https://example.com", "", true))
+	iPhone := "Mozilla/5.0 (iPhone; CPU iPhone OS 14_2 like Mac OS X) AppleWebKit/605.1.15 Version/14.0 Mobile/15E148 Safari/604.1"
+	assert.Nil(t, database.SaveStatisticsForViews([]OneViewStatistic{
+		{UserIpAddress: "1.1.1.1", ShortUrl: "yeti", Browser: "Safari", OS: "iOS", Device: "mobile"},
+		{UserIpAddress: "1.1.1.1", ShortUrl: "yeti", Browser: "Safari", OS: "iOS", Device: "mobile"},
+		{UserIpAddress: "2.2.2.2", ShortUrl: "yeti", Browser: "Chrome", OS: "Android", Device: "mobile"},
+		{UserIpAddress: "3.3.3.3", ShortUrl: "yeti", Browser: "Firefox", OS: "Windows", Device: "desktop"},
+		{UserIpAddress: "4.4.4.4", ShortUrl: "yeti", UserAgent: iPhone}, // saved by older versions without the parsed fields
+		{UserIpAddress: "5.5.5.5", ShortUrl: "yeti", Browser: "Other", OS: "Other", Device: "bot", IsBot: true},
+	}))
+
+	// When:
+	breakdown, err := database.GetClientBreakdown("yeti", "", false)
+
+	// Then:
+	assert.Nil(t, err)
+	assert.Equal(t, []Share{{"mobile", 3, 75}, {"desktop", 1, 25}}, breakdown.Devices)
+	assert.Equal(t, []Share{{"iOS", 2, 50}, {"Android", 1, 25}, {"Windows", 1, 25}}, breakdown.OS)
+	assert.Equal(t, []Share{{"Safari", 2, 50}, {"Chrome", 1, 25}, {"Firefox", 1, 25}}, breakdown.Browsers)
+
+	// and:
+	withBots, err := database.GetClientBreakdown("yeti", time.Now().UTC().Format(DayFormat), true)
+	assert.Nil(t, err)
+	assert.Equal(t, []Share{{"mobile", 3, 60}, {"bot", 1, 20}, {"desktop", 1, 20}}, withBots.Devices)
+}
+
+func TestModifyShortUrlSavesAllChangesAtOnce(t *testing.T) {
+
+	// Given:
+	database := newTestDatabase(t)
+	assert.Nil(t, database.SaveShortUrlObject(&ShortURL{ShortUrl: "yeti", TargetUrl: "https://example.com", MaxClicks: 10}))
+	assert.Nil(t, database.RegisterClick(1))
+
+	// When:
+	saved, err := database.ModifyShortUrl(1, func(link *ShortURL) {
+		link.TargetUrl = "https://example.org"
+		link.Description = "New one"
+	})
+
+	// Then:
+	assert.Nil(t, err)
+	assert.Equal(t, "https://example.org", saved.TargetUrl)
+	link, err := database.GetUrl("yeti")
+	assert.Nil(t, err)
+	assert.Equal(t, "New one", link.Description)
+	assert.Equal(t, 1, link.Clicks, "fields that are not changed are kept")
+
+	// and:
+	_, err = database.ModifyShortUrl(42, func(link *ShortURL) {})
+	assert.Equal(t, storm.ErrNotFound, err)
+}
+
+func TestVariantStatisticsWithZeroWeights(t *testing.T) {
+
+	// Given:
+	database := newTestDatabase(t)
+	assert.Nil(t, database.SaveShortUrlObject(&ShortURL{
+		ShortUrl:  "yeti",
+		TargetUrl: "https://example.com",
+		Variants:  []Variant{{TargetUrl: "https://example.com/a"}, {TargetUrl: "https://example.com/b"}},
+	}))
+	assert.Nil(t, database.SaveStatisticsForViews([]OneViewStatistic{
+		{UserIpAddress: "1.1.1.1", ShortUrl: "yeti", Variant: 1},
+	}))
+
+	// When:
+	variants, err := database.GetVariantStatisticsForOneURL(1, false)
+
+	// Then:
+	assert.Nil(t, err)
+	if assert.Len(t, variants, 2) {
+		assert.Equal(t, 0, variants[0].Percent)
+		assert.Equal(t, 1, variants[0].TotalViews)
+		assert.Equal(t, 0, variants[1].TotalViews)
+	}
+}
+
+func TestViewsOfOlderVersionsGetKeys(t *testing.T) {
+
+	// Given: views saved without the key
+	database := newTestDatabase(t)
+	assert.Nil(t, database.SaveShortUrl("yeti", "https://example.com", "", true))
+	day := time.Date(2020, 12, 1, 9, 0, 0, 0, time.UTC)
+	assert.Nil(t, database.db.Save(&OneViewStatistic{UserIpAddress: "1.2.3.4", ShortUrl: "yeti", Day: "2020-12-01", ViewTimes: []time.Time{day}}))
+	assert.Nil(t, database.db.Save(&OneViewStatistic{UserIpAddress: "5.6.7.8", ShortUrl: "yeti", Day: "2020-12-01", ViewTimes: []time.Time{day}}))
+	assert.True(t, database.hasViewsWithoutKeys())
+
+	// When:
+	count, err := database.fillViewKeys()
+
+	// Then:
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+	assert.False(t, database.hasViewsWithoutKeys())
+
+	// and: the next visit of the same visitor is grouped with the old one
+	assert.Nil(t, database.SaveStatisticForOneView(&OneViewStatistic{UserIpAddress: "1.2.3.4", ShortUrl: "yeti", ViewTimes: []time.Time{day.Add(time.Hour)}}))
+	var view OneViewStatistic
+	assert.Nil(t, database.db.One("Key", ViewKey("yeti", "2020-12-01", "1.2.3.4", false), &view))
+	assert.Equal(t, 1, view.ID)
+	assert.Len(t, view.ViewTimes, 2)
+}
+
+func TestOlderViewWithoutKeyIsFound(t *testing.T) {
+
+	// Given: an old view without the key and a newer one with it
+	database := newTestDatabase(t)
+	assert.Nil(t, database.SaveShortUrl("yeti", "https://example.com", "", true))
+	day := time.Date(2020, 12, 1, 9, 0, 0, 0, time.UTC)
+	assert.Nil(t, database.db.Save(&OneViewStatistic{UserIpAddress: "1.2.3.4", ShortUrl: "yeti", Day: "2020-12-01", ViewTimes: []time.Time{day}}))
+	assert.Nil(t, database.SaveStatisticForOneView(&OneViewStatistic{UserIpAddress: "5.6.7.8", ShortUrl: "yeti", ViewTimes: []time.Time{day.Add(time.Hour)}}))
+
+	// When:
+	found := database.hasViewsWithoutKeys()
+
+	// Then:
+	assert.True(t, found)
+}
+
+func TestViewTimesAreLimited(t *testing.T) {
+
+	// Given:
+	database := newTestDatabase(t)
+	assert.Nil(t, database.SaveShortUrl("yeti", "https://example.com", "", true))
+	morning := time.Date(2020, 12, 1, 9, 0, 0, 0, time.UTC)
+	views := make([]OneViewStatistic, MaxViewTimes+50)
+	for i := range views {
+		views[i] = OneViewStatistic{UserIpAddress: "1.2.3.4", ShortUrl: "yeti", ViewTimes: []time.Time{morning.Add(time.Duration(i) * time.Second)}}
+	}
+
+	// When:
+	assert.Nil(t, database.SaveStatisticsForViews(views))
+
+	// Then:
+	var view OneViewStatistic
+	assert.Nil(t, database.db.One("Key", ViewKey("yeti", "2020-12-01", "1.2.3.4", false), &view))
+	assert.Equal(t, MaxViewTimes+50, view.ViewCount())
+	assert.Len(t, view.ViewTimes, MaxViewTimes)
+	assert.True(t, morning.Add(time.Duration(MaxViewTimes+49)*time.Second).Equal(view.ViewTimes[MaxViewTimes-1]), "the latest are kept")
+
+	// and:
+	grouped, err := database.GetAllStatisticsGroupedByURLs(false)
+	assert.Nil(t, err)
+	assert.Equal(t, MaxViewTimes+50, grouped["yeti"].TotalViews)
+}
@@ -0,0 +1,181 @@
+package db
+
+import (
+	"time"
+
+	"github.com/asdine/storm/v3"
+	"github.com/asdine/storm/v3/q"
+)
+
+// RollupViewsBefore replaces the views of the days before the given one (format is 2006-01-02) with daily rollups
+// per link, country, device class, rule and A/B variant. Every day is rolled up in its own transaction, so only
+// the views of one day are in memory. The counters are not changed, because the rollups have the same numbers.
+// In the dry run nothing is changed, the report tells what would be done
+func (d Database) RollupViewsBefore(before string, dryRun bool) (*RollupReport, error) {
+	lastDay, err := addDays(before, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &RollupReport{Before: before, DryRun: dryRun}
+	links := make(map[string]bool)
+	for day := ""; ; {
+
+		// the index of days is sorted, so the oldest day with views is the first one
+		var oldest []OneViewStatistic
+		if err := d.db.Range("Day", day, lastDay, &oldest, storm.Limit(1)); err != nil && err != storm.ErrNotFound {
+			return nil, err
+		}
+		if len(oldest) == 0 {
+			break
+		}
+
+		day = oldest[0].Day
+		if err := d.rollupDay(day, dryRun, report, links); err != nil {
+			return nil, err
+		}
+		if day, err = addDays(day, 1); err != nil {
+			return nil, err
+		}
+	}
+	report.Links = len(links)
+	return report, nil
+}
+
+// rollupDay replaces the views of one day with the rollups in one transaction and adds the numbers to the report
+func (d Database) rollupDay(day string, dryRun bool, report *RollupReport, links map[string]bool) error {
+	tx, err := d.db.Begin(!dryRun)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var views []OneViewStatistic
+	if err := tx.Find("Day", day, &views); err != nil && err != storm.ErrNotFound {
+		return err
+	}
+
+	rollups := make(map[string]*DailyRollup)
+	for _, view := range views {
+		device := view.client().Device
+		id := RollupID(view.ShortUrl, view.Day, view.CountryCode, device, view.IsBot, view.MatchedRule, view.Variant)
+		rollup, found := rollups[id]
+		if !found {
+			rollup = &DailyRollup{
+				ID:          id,
+				ShortUrl:    view.ShortUrl,
+				Day:         view.Day,
+				CountryCode: view.CountryCode,
+				Device:      device,
+				IsBot:       view.IsBot,
+				MatchedRule: view.MatchedRule,
+				Variant:     view.Variant,
+			}
+			rollups[id] = rollup
+		}
+		rollup.countView(&view)
+
+		report.Records++
+		report.Views += view.ViewCount()
+		links[view.ShortUrl] = true
+	}
+	if len(views) == 0 {
+		return nil
+	}
+
+	report.Days++
+	report.Rollups += len(rollups)
+	if len(report.FirstDay) == 0 {
+		report.FirstDay = day
+	}
+	report.LastDay = day
+
+	if dryRun {
+		return nil
+	}
+
+	// the same day could be rolled up before, for example if the retention period was made shorter
+	for _, rollup := range rollups {
+		var existing DailyRollup
+		if err := tx.One("ID", rollup.ID, &existing); err == nil {
+			rollup.add(&existing)
+		} else if err != storm.ErrNotFound {
+			return err
+		}
+		if err := tx.Save(rollup); err != nil {
+			return err
+		}
+	}
+
+	for _, view := range views {
+		if err := tx.DeleteStruct(&view); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// addDays returns the day (format is 2006-01-02) that is the given number of days later
+func addDays(day string, days int) (string, error) {
+	date, err := time.Parse(DayFormat, day)
+	if err != nil {
+		return "", err
+	}
+	return date.AddDate(0, 0, days).Format(DayFormat), nil
+}
+
+// findRollups returns all the rollups of the link
+func (d Database) findRollups(shortUrl string, includeBots bool) ([]DailyRollup, error) {
+	var rollups []DailyRollup
+	if err := d.db.Find("ShortUrl", shortUrl, &rollups); err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	if includeBots {
+		return rollups, nil
+	}
+
+	filtered := rollups[:0]
+	for _, rollup := range rollups {
+		if !rollup.IsBot {
+			filtered = append(filtered, rollup)
+		}
+	}
+	return filtered, nil
+}
+
+// GetRollupsForOneURLOneDay returns the rollups of the link for the day, if its views were rolled up.
+// Rollups of bots are returned only if includeBots is TRUE
+func (d Database) GetRollupsForOneURLOneDay(shortUrl, day string, includeBots bool) ([]DailyRollup, error) {
+	matchers := []q.Matcher{
+		q.Eq("ShortUrl", shortUrl),
+		q.Eq("Day", day),
+	}
+	if !includeBots {
+		matchers = append(matchers, q.Eq("IsBot", false))
+	}
+
+	var rollups []DailyRollup
+	if err := d.db.Select(q.And(matchers...)).OrderBy("Views").Reverse().Find(&rollups); err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	return rollups, nil
+}
+
+// renameRollups moves the rollups to the new suffix of the link. The suffix is a part of the ID, so they are saved again
+func renameRollups(tx storm.Node, oldShortUrl, newShortUrl string) error {
+	var rollups []DailyRollup
+	if err := tx.Find("ShortUrl", oldShortUrl, &rollups); err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	for _, rollup := range rollups {
+		if err := tx.DeleteStruct(&rollup); err != nil {
+			return err
+		}
+		rollup.ShortUrl = newShortUrl
+		rollup.ID = RollupID(rollup.ShortUrl, rollup.Day, rollup.CountryCode, rollup.Device, rollup.IsBot, rollup.MatchedRule, rollup.Variant)
+		if err := tx.Save(&rollup); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,45 +1,525 @@
 package db
 
-import "time"
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/w32blaster/shortana/useragent"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// RedirectInterstitial means that visitor gets a page that redirects with meta-refresh and JS
+// instead of HTTP redirect, so browsers never cache it
+const RedirectInterstitial = 200
+
+// RedirectTypes are all the supported ways to redirect a visitor: HTTP status codes or the interstitial page
+var RedirectTypes = []int{301, 302, 307, 308, RedirectInterstitial}
 
 type (
 	ShortURL struct {
-		ID          int    `storm:"id,increment"`
-		ShortUrl    string `storm:"unique"` // unique primary key
-		TargetUrl   string
-		Description string
-		IsPublic    bool
-		PublishDate string // format is 2006-01-02
+		ID           int    `storm:"id,increment"`
+		ShortUrl     string `storm:"unique"` // unique primary key
+		TargetUrl    string
+		Description  string
+		IsPublic     bool
+		PublishDate  string         // format is 2006-01-02
+		ExpiresAt    time.Time      // the link stops working after this moment; zero value means it never expires
+		MaxClicks    int            // the link stops working after this number of clicks; zero means unlimited
+		Clicks       int            // clicks counted against MaxClicks
+		PasswordHash string         // bcrypt hash of the password; empty means the link is not protected
+		RedirectType int            // one of the RedirectTypes; zero means the global default
+		Rules        []RedirectRule // evaluated in order before the redirect, the first matching rule wins
+		Variants     []Variant      // visitors that didn't match any rule are split between variants by weight
+		Passthrough  bool           // append the rest of the requested path and the query string to the target
+		UTM          UTM            // tags added to the target URL, unless it already has them
+	}
+
+	// Session is the state of the dialog between the bot and one user in one chat, for example adding
+	// a new short URL takes a few messages. It is saved in DB, so the dialog survives restarts
+	Session struct {
+		ID        string `storm:"id"` // see SessionID
+		ChatID    int64
+		Step      int       // one of the bot steps, such as "requested the target URL"
+		ShortUrl  string    // suffix of the existing link the dialog is about
+		Draft     ShortURL  // the new link collected by the /add dialog, it is saved only on confirmation
+		UpdatedAt time.Time `storm:"index"`
+	}
+
+	// LinkHealth is the result of the last check of the link target. It is kept apart from ShortURL,
+	// so the background checker never overwrites changes made by user at the same time
+	LinkHealth struct {
+		LinkID      int `storm:"id"` // ID of the ShortURL
+		ShortUrl    string
+		TargetUrl   string        // the target that was checked
+		StatusCode  int           // zero if there was no response at all
+		Error       string        // network error, if there was no response
+		Latency     time.Duration // time until the response headers
+		CheckedAt   time.Time
+		BrokenSince time.Time // the first failed check in a row; zero value means the link works
+	}
+
+	// UTM is the set of analytics tags added to the target URL
+	UTM struct {
+		Source   string
+		Medium   string
+		Campaign string
+	}
+
+	// Variant is one of the targets of the A/B split
+	Variant struct {
+		TargetUrl string
+		Weight    int
+	}
+
+	// RedirectRule sends visitors to another target if they match all the conditions. Empty condition matches everyone
+	RedirectRule struct {
+		Countries []string // ISO country codes in upper case, such as "DE"
+		OS        []string // operating systems as useragent.Parse returns them
+		Devices   []string // device classes as useragent.Parse returns them
+		TargetUrl string
+	}
+
+	// Visitor is what we know about the visitor at the moment of the redirect
+	Visitor struct {
+		IpAddress   string
+		UserAgent   string
+		CountryCode string
+		OS          string
+		Device      string
 	}
 
 	OneViewStatistic struct {
-		ID            int    `storm:"id,increment"`
-		UserIpAddress string `storm:"index"`
-		ShortUrl      string `storm:"index"` // shortened URL suffix
-		Day           string `storm:"index"` // just a date sortable in format of 2020-01-02, to be able to select all the views for a day
-		CountryCode   string
-		CountryName   string
-		City          string
-		UserAgent     string
-		ViewTimes     []time.Time // one view is one time record, UTC
+		ID             int    `storm:"id,increment"`
+		Key            string `storm:"unique"` // see ViewKey; empty for views saved by older versions until Init fills it
+		UserIpAddress  string `storm:"index"`
+		ShortUrl       string `storm:"index"` // shortened URL suffix
+		Day            string `storm:"index"` // just a date sortable in format of 2020-01-02, to be able to select all the views for a day
+		CountryCode    string
+		CountryName    string
+		City           string
+		UserAgent      string
+		ViewTimes      []time.Time // the latest views, one time record per view, UTC; see MaxViewTimes
+		Views          int         // number of all the views; zero for views saved by older versions, see ViewCount
+		MatchedRule    int         // number of the ShortURL rule that chose the target, starting from 1; zero is the default target
+		Variant        int         // number of the ShortURL variant chosen for the visitor, starting from 1; zero if there was no split
+		IsBot          bool        // crawler, link preview or monitoring tool; such views are not counted by default
+		ReferrerDomain string      `storm:"index"` // domain of the page with the link on the first visit of the day; empty for direct visits
+		Referrer       string      // the full URL of that page, if it is kept
+		Browser        string      `storm:"index"` // the parsed UserAgent, see useragent.Info; empty for views saved by older versions
+		BrowserVersion string
+		OS             string `storm:"index"`
+		Device         string `storm:"index"`
+	}
+
+	// ViewCounters are the running totals of the views of one link for one day or, if the Day is empty, for the whole
+	// time. They are updated together with the views, so the summaries don't read every view. Bots are counted apart
+	ViewCounters struct {
+		ID        string `storm:"id"` // see CountersID
+		ShortUrl  string `storm:"index"`
+		Day       string // format is 2006-01-02; empty for the whole time
+		IsBot     bool
+		Views     int
+		Visitors  int            // the same visitor is counted once per day, as in OneViewStatistic
+		Countries map[string]int // visitors per country code; the code is empty if GeoIP didn't know it
+		Referrers map[string]int // visitors per referrer domain; the domain is empty for direct visits
+		Devices   map[string]int // visitors per device class
+		OS        map[string]int // visitors per operating system
+		Browsers  map[string]int // visitors per browser, without the version
+	}
+
+	// DailyRollup is what is left of the views older than the retention period: the number of views and
+	// visitors of one link for one day from one country and device class, that got the same rule or A/B variant
+	DailyRollup struct {
+		ID          string `storm:"id"` // see RollupID
+		ShortUrl    string `storm:"index"`
+		Day         string `storm:"index"` // format is 2006-01-02
+		CountryCode string
+		Device      string // device class as useragent.Parse returns it
+		IsBot       bool
+		MatchedRule int // as in OneViewStatistic, so the numbers per rule and per A/B variant are kept
+		Variant     int
+		Views       int
+		Visitors    int            // the same visitor is counted once per day, as in OneViewStatistic
+		Referrers   map[string]int // visitors per referrer domain; the domain is empty for direct visits
+		OS          map[string]int // visitors per operating system
+		Browsers    map[string]int // visitors per browser, without the version
+	}
+
+	// ChatSettings are preferences of one chat with the bot
+	ChatSettings struct {
+		ChatID      int64 `storm:"id"`
+		IncludeBots bool  // show views of bots in the statistics
 	}
 
 	// representation only
 	OneURLSummaryStatistics struct {
-		ID               int
-		ShortUrlID       int
-		ShortUrl         string
-		PublishDate      string // format is 2006-01-02
-		TotalDaysActive  int
-		TotalViews       int
-		TotalUniqueUsers int
-		// TotalCountries  int later
+		ID               int    `json:"-"`
+		ShortUrlID       int    `json:"shortUrlId"`
+		ShortUrl         string `json:"shortUrl"`
+		PublishDate      string `json:"publishDate"` // format is 2006-01-02
+		TotalDaysActive  int    `json:"totalDaysActive"`
+		TotalViews       int    `json:"totalViews"`
+		TotalUniqueUsers int    `json:"totalUniqueUsers"`
+		TotalCountries   int    `json:"totalCountries"`
+	}
+
+	VariantSummaryStatistics struct {
+		Variant     int    `json:"variant"` // starting from 1
+		TargetUrl   string `json:"targetUrl"`
+		Weight      int    `json:"weight"`
+		Percent     int    `json:"percent"` // expected share of visitors
+		TotalViews  int    `json:"totalViews"`
+		UniqueViews int    `json:"uniqueViews"`
+	}
+
+	// RollupReport describes views that are rolled up, or would be rolled up in the dry run
+	RollupReport struct {
+		Before   string // views of the days before this one are rolled up, format is 2006-01-02
+		Records  int    // OneViewStatistic records, one per visitor per day
+		Views    int
+		Links    int
+		Days     int
+		FirstDay string // the oldest rolled up day; empty if there was nothing to roll up
+		LastDay  string
+		Rollups  int // DailyRollup records that are created or updated
+		DryRun   bool
+	}
+
+	// ReferrerStatistics is the number of visitors that came from one domain
+	ReferrerStatistics struct {
+		Domain   string `json:"domain"` // empty for direct visits
+		Visitors int    `json:"visitors"`
+	}
+
+	// Share is the part of the visitors with the same device class, operating system or browser
+	Share struct {
+		Name     string `json:"name"`
+		Visitors int    `json:"visitors"`
+		Percent  int    `json:"percent"`
+	}
+
+	// ClientBreakdown splits the visitors by device class, operating system and browser, the biggest shares go first
+	ClientBreakdown struct {
+		Devices  []Share `json:"devices"`
+		OS       []Share `json:"os"`
+		Browsers []Share `json:"browsers"`
 	}
 
 	OneDaySummaryStatistics struct {
-		Date               string // format is 2006-01-02
-		DateWithoutHyphens string // format is 20060102
-		TotalViews         int
-		UniqueViews        int
+		Date               string `json:"date"` // format is 2006-01-02
+		DateWithoutHyphens string `json:"-"`    // format is 20060102
+		TotalViews         int    `json:"totalViews"`
+		UniqueViews        int    `json:"uniqueViews"`
+		Countries          int    `json:"countries"`
 	}
 )
+
+// IsBroken returns TRUE if the last check failed
+func (h LinkHealth) IsBroken() bool {
+	return !h.BrokenSince.IsZero()
+}
+
+// IsExpired returns TRUE if the link is past its expiry date or its click budget is exhausted
+func (s ShortURL) IsExpired(now time.Time) bool {
+	if !s.ExpiresAt.IsZero() && !now.Before(s.ExpiresAt) {
+		return true
+	}
+	return s.MaxClicks > 0 && s.Clicks >= s.MaxClicks
+}
+
+// IsProtected returns TRUE if a visitor should enter the password before the redirect
+func (s ShortURL) IsProtected() bool {
+	return len(s.PasswordHash) > 0
+}
+
+// CheckPassword returns TRUE if the given password matches the saved hash
+func (s ShortURL) CheckPassword(password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(s.PasswordHash), []byte(password)) == nil
+}
+
+// HashPassword returns bcrypt hash for the given password, or empty string if there is no password
+func HashPassword(password string) (string, error) {
+	if len(password) == 0 {
+		return "", nil
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// IsValidRedirectType returns TRUE if the value is one of RedirectTypes
+func IsValidRedirectType(redirectType int) bool {
+	for _, t := range RedirectTypes {
+		if t == redirectType {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches returns TRUE if the visitor should be redirected by this rule
+func (r RedirectRule) Matches(visitor Visitor) bool {
+	return matchesAny(r.Countries, visitor.CountryCode) &&
+		matchesAny(r.OS, visitor.OS) &&
+		matchesAny(r.Devices, visitor.Device)
+}
+
+// NeedsCountry returns TRUE if any rule depends on the visitor's country, so it should be looked up
+func NeedsCountry(rules []RedirectRule) bool {
+	for _, rule := range rules {
+		if len(rule.Countries) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// empty list of allowed values matches everything
+func matchesAny(allowed []string, value string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, a := range allowed {
+		if a == value {
+			return true
+		}
+	}
+	return false
+}
+
+// NormalizeRules fixes the case of values typed by user, for example "de" becomes "DE" and "ios" becomes "iOS".
+// Unknown values stay as they are, so ValidateRules could report them
+func NormalizeRules(rules []RedirectRule) []RedirectRule {
+	for i := range rules {
+		for j, country := range rules[i].Countries {
+			rules[i].Countries[j] = strings.ToUpper(strings.TrimSpace(country))
+		}
+		for j, os := range rules[i].OS {
+			if canonicalOS, ok := useragent.CanonicalOS(os); ok {
+				rules[i].OS[j] = canonicalOS
+			}
+		}
+		for j, device := range rules[i].Devices {
+			if canonicalDevice, ok := useragent.CanonicalDevice(device); ok {
+				rules[i].Devices[j] = canonicalDevice
+			}
+		}
+	}
+	return rules
+}
+
+// TargetChecker validates target URLs the same way for the main target, rules and variants, see urlcheck.Checker
+type TargetChecker interface {
+	Check(target string) error
+}
+
+// ValidateRules checks that every rule has conditions and a valid target
+func ValidateRules(rules []RedirectRule, targets TargetChecker) error {
+	for _, rule := range rules {
+		if len(rule.Countries) == 0 && len(rule.OS) == 0 && len(rule.Devices) == 0 {
+			return errors.New("every rule must have at least one condition")
+		}
+		for _, country := range rule.Countries {
+			if len(country) != 2 || strings.ToUpper(country) != country {
+				return errors.New("country must be ISO code in upper case, such as DE, but got '" + country + "'")
+			}
+		}
+		for _, os := range rule.OS {
+			if canonicalOS, ok := useragent.CanonicalOS(os); !ok || canonicalOS != os {
+				return fmt.Errorf("unknown operating system '%s', expected one of %v", os, useragent.OperatingSystems)
+			}
+		}
+		for _, device := range rule.Devices {
+			if canonicalDevice, ok := useragent.CanonicalDevice(device); !ok || canonicalDevice != device {
+				return fmt.Errorf("unknown device '%s', expected one of %v", device, useragent.Devices)
+			}
+		}
+		if err := targets.Check(rule.TargetUrl); err != nil {
+			return errors.New("rule target is invalid: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// ValidateVariants checks that the split has at least two variants with positive weights and valid targets
+func ValidateVariants(variants []Variant, targets TargetChecker) error {
+	if len(variants) == 1 {
+		return errors.New("the split needs at least two variants")
+	}
+	for _, variant := range variants {
+		if variant.Weight <= 0 {
+			return errors.New("weight of every variant must be positive")
+		}
+		if err := targets.Check(variant.TargetUrl); err != nil {
+			return errors.New("variant target is invalid: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// IsEmpty returns TRUE if there are no tags at all
+func (u UTM) IsEmpty() bool {
+	return len(u.Source) == 0 && len(u.Medium) == 0 && len(u.Campaign) == 0
+}
+
+// WithDefaults fills in the missing tags from the defaults, for example from the global settings
+func (u UTM) WithDefaults(defaults UTM) UTM {
+	if len(u.Source) == 0 {
+		u.Source = defaults.Source
+	}
+	if len(u.Medium) == 0 {
+		u.Medium = defaults.Medium
+	}
+	if len(u.Campaign) == 0 {
+		u.Campaign = defaults.Campaign
+	}
+	return u
+}
+
+// CountersID returns ID of the counters of the link for the day; the day is empty for the whole time
+func CountersID(shortUrl, day string, isBot bool) string {
+	return shortUrl + "/" + day + "/" + strconv.FormatBool(isBot)
+}
+
+// ViewKey returns the key of the record that groups all the visits of the same visitor to the link during one day
+func ViewKey(shortUrl, day, ipAddress string, isBot bool) string {
+	return shortUrl + "/" + day + "/" + ipAddress + "/" + strconv.FormatBool(isBot)
+}
+
+// ViewCount returns the number of views of the visitor during the day. Older versions didn't count them,
+// but kept every view time
+func (v OneViewStatistic) ViewCount() int {
+	if v.Views > 0 {
+		return v.Views
+	}
+	return len(v.ViewTimes)
+}
+
+// client returns the parsed UserAgent of the visitor. Older versions didn't save it, so then it is parsed now
+func (v *OneViewStatistic) client() useragent.Info {
+	if len(v.Device) == 0 {
+		info := useragent.Parse(v.UserAgent)
+		if v.IsBot {
+			info.Device = useragent.DeviceBot
+		}
+		return info
+	}
+	return useragent.Info{
+		Browser:        v.Browser,
+		BrowserVersion: v.BrowserVersion,
+		OS:             v.OS,
+		Device:         v.Device,
+	}
+}
+
+// countView adds views of one visitor to the counters; the visitor itself is counted only once per day
+func (c *ViewCounters) countView(view *OneViewStatistic, views int, isNewVisitor bool) {
+	c.Views += views
+	if !isNewVisitor {
+		return
+	}
+
+	client := view.client()
+	c.Visitors++
+	c.Countries = increment(c.Countries, view.CountryCode, 1)
+	c.Referrers = increment(c.Referrers, view.ReferrerDomain, 1)
+	c.Devices = increment(c.Devices, client.Device, 1)
+	c.OS = increment(c.OS, client.OS, 1)
+	c.Browsers = increment(c.Browsers, client.Browser, 1)
+}
+
+// countRollup adds the rolled up views to the counters
+func (c *ViewCounters) countRollup(rollup *DailyRollup) {
+	c.Views += rollup.Views
+	c.Visitors += rollup.Visitors
+	c.Countries = increment(c.Countries, rollup.CountryCode, rollup.Visitors)
+	c.Devices = increment(c.Devices, rollup.Device, rollup.Visitors)
+	c.Referrers = incrementAll(c.Referrers, rollup.Referrers)
+	c.OS = incrementAll(c.OS, rollup.OS)
+	c.Browsers = incrementAll(c.Browsers, rollup.Browsers)
+}
+
+// add adds other counters to these ones
+func (c *ViewCounters) add(other *ViewCounters) {
+	c.Views += other.Views
+	c.Visitors += other.Visitors
+	c.Countries = incrementAll(c.Countries, other.Countries)
+	c.Referrers = incrementAll(c.Referrers, other.Referrers)
+	c.Devices = incrementAll(c.Devices, other.Devices)
+	c.OS = incrementAll(c.OS, other.OS)
+	c.Browsers = incrementAll(c.Browsers, other.Browsers)
+}
+
+// countView adds the visitor to the rollup
+func (r *DailyRollup) countView(view *OneViewStatistic) {
+	client := view.client()
+	r.Views += view.ViewCount()
+	r.Visitors++
+	r.Referrers = increment(r.Referrers, view.ReferrerDomain, 1)
+	r.OS = increment(r.OS, client.OS, 1)
+	r.Browsers = increment(r.Browsers, client.Browser, 1)
+}
+
+// add adds other rollup of the same link, day, country and device to this one
+func (r *DailyRollup) add(other *DailyRollup) {
+	r.Views += other.Views
+	r.Visitors += other.Visitors
+	r.Referrers = incrementAll(r.Referrers, other.Referrers)
+	r.OS = incrementAll(r.OS, other.OS)
+	r.Browsers = incrementAll(r.Browsers, other.Browsers)
+}
+
+// increment adds n to the count of the key, the map is created if needed
+func increment(counts map[string]int, key string, n int) map[string]int {
+	if n == 0 {
+		return counts
+	}
+	if counts == nil {
+		counts = make(map[string]int)
+	}
+	counts[key] += n
+	return counts
+}
+
+// incrementAll adds all the counts of other map
+func incrementAll(counts, other map[string]int) map[string]int {
+	for key, n := range other {
+		counts = increment(counts, key, n)
+	}
+	return counts
+}
+
+// shares turns the counts into shares of the total, the biggest go first
+func shares(counts map[string]int, total int) []Share {
+	result := make([]Share, 0, len(counts))
+	for name, visitors := range counts {
+		share := Share{Name: name, Visitors: visitors}
+		if total > 0 {
+			share.Percent = (visitors*100 + total/2) / total
+		}
+		result = append(result, share)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Visitors != result[j].Visitors {
+			return result[i].Visitors > result[j].Visitors
+		}
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// RollupID returns ID of the daily rollup of the link for the day, country, device class, kind of visitors,
+// the matched rule and the A/B variant
+func RollupID(shortUrl, day, countryCode, device string, isBot bool, matchedRule, variant int) string {
+	return shortUrl + "/" + day + "/" + countryCode + "/" + device + "/" + strconv.FormatBool(isBot) +
+		"/" + strconv.Itoa(matchedRule) + "/" + strconv.Itoa(variant)
+}
+
+// SessionID returns ID of the session for the user in the chat
+func SessionID(chatID int64, userID int) string {
+	return strconv.FormatInt(chatID, 10) + ":" + strconv.Itoa(userID)
+}
@@ -0,0 +1,133 @@
+package health
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/w32blaster/shortana/db"
+)
+
+const userAgent = "Shortana link checker"
+
+// Checker requests targets of all the links and remembers which of them are broken
+type Checker struct {
+	db     *db.Database
+	client *http.Client
+}
+
+// New returns a checker; every request is limited by the given timeout
+func New(database *db.Database, timeout time.Duration) *Checker {
+	return &Checker{
+		db:     database,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+// Run checks all the links every interval, until the stop channel is closed. Links that became broken since
+// the previous check are passed to onBroken, so nobody is notified twice about the same link. The done channel
+// is closed when the check in progress is finished
+func (c *Checker) Run(interval time.Duration, stop <-chan struct{}, done chan<- struct{}, onBroken func([]db.LinkHealth)) {
+	defer close(done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			broken, err := c.CheckAll(now)
+			if err != nil {
+				log.Println("Health check failed, error " + err.Error())
+				continue
+			}
+			if len(broken) > 0 {
+				onBroken(broken)
+			}
+		}
+	}
+}
+
+// CheckAll checks every link with the target URL and returns those that became broken with this check
+func (c *Checker) CheckAll(now time.Time) ([]db.LinkHealth, error) {
+	links, err := c.db.GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	var newlyBroken []db.LinkHealth
+	for i := range links {
+		if len(links[i].TargetUrl) == 0 {
+			continue
+		}
+
+		health, wasBroken := c.CheckOne(&links[i], now)
+		if health.IsBroken() && !wasBroken {
+			newlyBroken = append(newlyBroken, health)
+		}
+	}
+	return newlyBroken, nil
+}
+
+// CheckOne checks the link target and saves the result. It also returns TRUE if the link was broken before this check
+func (c *Checker) CheckOne(link *db.ShortURL, now time.Time) (db.LinkHealth, bool) {
+	previous, err := c.db.GetLinkHealth(link.ID)
+	wasBroken := err == nil && previous.IsBroken()
+
+	health := c.request(link.TargetUrl)
+	health.LinkID = link.ID
+	health.ShortUrl = link.ShortUrl
+	health.CheckedAt = now
+
+	if isBroken(health) {
+		health.BrokenSince = now
+		if wasBroken {
+			health.BrokenSince = previous.BrokenSince
+		}
+	}
+
+	if err := c.db.SaveLinkHealth(&health); err != nil {
+		log.Println("Can't save the health of " + link.ShortUrl + ", error " + err.Error())
+	}
+	return health, wasBroken
+}
+
+// request makes the HEAD request first, because it is cheaper. Some servers don't support it,
+// so in case of any error response the GET request is made as well
+func (c *Checker) request(target string) db.LinkHealth {
+	health := c.do(http.MethodHead, target)
+	if isBroken(health) {
+		health = c.do(http.MethodGet, target)
+	}
+	health.TargetUrl = target
+	return health
+}
+
+func (c *Checker) do(method, target string) db.LinkHealth {
+	var health db.LinkHealth
+
+	req, err := http.NewRequest(method, target, nil)
+	if err != nil {
+		health.Error = err.Error()
+		return health
+	}
+	req.Header.Set("User-Agent", userAgent)
+
+	start := time.Now()
+	resp, err := c.client.Do(req)
+	health.Latency = time.Since(start)
+	if err != nil {
+		health.Error = err.Error()
+		return health
+	}
+	resp.Body.Close()
+
+	health.StatusCode = resp.StatusCode
+	return health
+}
+
+// a link is broken if the target doesn't respond or responds with an error; redirects are followed by the client
+func isBroken(health db.LinkHealth) bool {
+	return len(health.Error) > 0 || health.StatusCode >= http.StatusBadRequest
+}
@@ -0,0 +1,135 @@
+package health
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/w32blaster/shortana/db"
+)
+
+func newTestChecker(t *testing.T) (*Checker, *db.Database) {
+	dir, err := ioutil.TempDir("", "shortana-health")
+	assert.Nil(t, err)
+
+	database := db.Init(dir)
+	t.Cleanup(func() {
+		database.Close()
+		os.RemoveAll(dir)
+	})
+	return New(database, time.Second), database
+}
+
+// the test server answers 200 on /ok, 404 on /gone, supports only GET on /get-only
+func newTestServer(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/ok":
+			w.WriteHeader(http.StatusOK)
+		case r.URL.Path == "/get-only" && r.Method == http.MethodGet:
+			w.WriteHeader(http.StatusOK)
+		case r.URL.Path == "/get-only":
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestCheckAllRecordsResults(t *testing.T) {
+
+	// Given:
+	checker, database := newTestChecker(t)
+	server := newTestServer(t)
+	assert.Nil(t, database.SaveShortUrl("ok", server.URL+"/ok", "", true))
+	assert.Nil(t, database.SaveShortUrl("gone", server.URL+"/gone", "", true))
+	assert.Nil(t, database.SaveShortUrl("get", server.URL+"/get-only", "", true))
+	assert.Nil(t, database.SaveShortUrl("half", "", "", true))
+	now := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	// When:
+	broken, err := checker.CheckAll(now)
+
+	// Then:
+	assert.Nil(t, err)
+	assert.Len(t, broken, 1)
+	assert.Equal(t, "gone", broken[0].ShortUrl)
+	assert.Equal(t, http.StatusNotFound, broken[0].StatusCode)
+
+	// and:
+	checks, err := database.GetAllLinkHealth()
+	assert.Nil(t, err)
+	assert.Len(t, checks, 3)
+	assert.Equal(t, http.StatusOK, checks[1].StatusCode)
+	assert.False(t, checks[1].IsBroken())
+	assert.Equal(t, now, checks[1].CheckedAt.UTC())
+	assert.Equal(t, http.StatusOK, checks[3].StatusCode, "GET is used when HEAD is not allowed")
+}
+
+func TestBrokenLinkIsReportedOnce(t *testing.T) {
+
+	// Given:
+	checker, database := newTestChecker(t)
+	server := newTestServer(t)
+	assert.Nil(t, database.SaveShortUrl("gone", server.URL+"/gone", "", true))
+	first := time.Date(2021, 1, 2, 3, 0, 0, 0, time.UTC)
+
+	// When:
+	brokenFirst, _ := checker.CheckAll(first)
+	brokenSecond, _ := checker.CheckAll(first.Add(time.Hour))
+
+	// Then:
+	assert.Len(t, brokenFirst, 1)
+	assert.Empty(t, brokenSecond)
+
+	// and:
+	health, err := database.GetLinkHealth(1)
+	assert.Nil(t, err)
+	assert.Equal(t, first, health.BrokenSince.UTC())
+	assert.Equal(t, first.Add(time.Hour), health.CheckedAt.UTC())
+}
+
+func TestUnreachableTargetIsBroken(t *testing.T) {
+
+	// Given:
+	checker, database := newTestChecker(t)
+	server := newTestServer(t)
+	target := server.URL + "/ok"
+	server.Close()
+	link := db.ShortURL{ShortUrl: "down", TargetUrl: target}
+	assert.Nil(t, database.SaveShortUrlObject(&link))
+
+	// When:
+	health, wasBroken := checker.CheckOne(&link, time.Now())
+
+	// Then:
+	assert.False(t, wasBroken)
+	assert.True(t, health.IsBroken())
+	assert.Zero(t, health.StatusCode)
+	assert.NotEmpty(t, health.Error)
+}
+
+func TestRunStopsWhenAsked(t *testing.T) {
+
+	// Given:
+	checker, _ := newTestChecker(t)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go checker.Run(time.Hour, stop, done, func([]db.LinkHealth) {})
+
+	// When:
+	close(stop)
+
+	// Then:
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't stop")
+	}
+}
@@ -0,0 +1,110 @@
+package qr
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// image formats
+const (
+	FormatPNG = "png"
+	FormatSVG = "svg"
+)
+
+// limits for the image size in pixels
+const (
+	DefaultSize = 256
+	MinSize     = 64
+	MaxSize     = 2048
+)
+
+// levels are error-correction levels by their standard names. The higher level
+// is more robust to damage (or a logo in the middle), but gives a denser image
+var levels = map[string]qrcode.RecoveryLevel{
+	"L": qrcode.Low,     // 7% of the code can be restored
+	"M": qrcode.Medium,  // 15%
+	"Q": qrcode.High,    // 25%
+	"H": qrcode.Highest, // 30%
+}
+
+// Options are the image settings, the zero values mean the defaults
+type Options struct {
+	Format string // png or svg
+	Size   int    // width and height in pixels
+	Level  string // L, M, Q or H
+}
+
+// Normalize fills in the defaults and checks the values
+func (o Options) Normalize() (Options, error) {
+	o.Format = strings.ToLower(o.Format)
+	if len(o.Format) == 0 {
+		o.Format = FormatPNG
+	}
+	if o.Format != FormatPNG && o.Format != FormatSVG {
+		return o, errors.New("format must be png or svg")
+	}
+
+	if o.Size == 0 {
+		o.Size = DefaultSize
+	}
+	if o.Size < MinSize || o.Size > MaxSize {
+		return o, fmt.Errorf("size must be between %d and %d", MinSize, MaxSize)
+	}
+
+	o.Level = strings.ToUpper(o.Level)
+	if len(o.Level) == 0 {
+		o.Level = "M"
+	}
+	if _, ok := levels[o.Level]; !ok {
+		return o, errors.New("level must be one of L, M, Q or H")
+	}
+	return o, nil
+}
+
+// ContentType returns the MIME type of the image
+func (o Options) ContentType() string {
+	if o.Format == FormatSVG {
+		return "image/svg+xml"
+	}
+	return "image/png"
+}
+
+// Render encodes the content, usually the full short URL, as a QR code image. Options must be normalized
+func Render(content string, opts Options) ([]byte, error) {
+	code, err := qrcode.New(content, levels[opts.Level])
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Format == FormatSVG {
+		return svg(code.Bitmap(), opts.Size), nil
+	}
+	return code.PNG(opts.Size)
+}
+
+// svg draws every horizontal run of dark modules as one rectangle, so the file stays small.
+// The view box is measured in modules and scaled to the requested size
+func svg(bitmap [][]bool, size int) []byte {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`,
+		size, size, len(bitmap), len(bitmap))
+	sb.WriteString(`<rect width="100%" height="100%" fill="#ffffff"/>`)
+	sb.WriteString(`<path fill="#000000" d="`)
+	for y, row := range bitmap {
+		for x := 0; x < len(row); x++ {
+			if !row[x] {
+				continue
+			}
+			start := x
+			for x < len(row) && row[x] {
+				x++
+			}
+			fmt.Fprintf(&sb, "M%d %dh%dv1h-%dz", start, y, x-start, x-start)
+		}
+	}
+	sb.WriteString(`"/></svg>`)
+	return []byte(sb.String())
+}
@@ -0,0 +1,83 @@
+package qr
+
+import (
+	"bytes"
+	"image/png"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeDefaults(t *testing.T) {
+
+	// When:
+	opts, err := Options{}.Normalize()
+
+	// Then:
+	assert.Nil(t, err)
+	assert.Equal(t, Options{Format: FormatPNG, Size: DefaultSize, Level: "M"}, opts)
+	assert.Equal(t, "image/png", opts.ContentType())
+}
+
+func TestNormalizeErrors(t *testing.T) {
+
+	cases := []Options{
+		{Format: "gif"},
+		{Size: 10},
+		{Size: 100000},
+		{Level: "X"},
+	}
+
+	for _, c := range cases {
+
+		// When:
+		_, err := c.Normalize()
+
+		// Then:
+		assert.NotNil(t, err, c)
+	}
+}
+
+func TestRenderPNG(t *testing.T) {
+
+	// Given:
+	opts, _ := Options{Size: 300, Level: "h"}.Normalize()
+
+	// When:
+	data, err := Render("https://sho.rt/abc", opts)
+
+	// Then:
+	assert.Nil(t, err)
+	img, err := png.Decode(bytes.NewReader(data))
+	assert.Nil(t, err)
+	assert.Equal(t, 300, img.Bounds().Dx())
+}
+
+func TestRenderSVG(t *testing.T) {
+
+	// Given:
+	opts, _ := Options{Format: "SVG", Size: 128}.Normalize()
+
+	// When:
+	data, err := Render("https://sho.rt/abc", opts)
+
+	// Then:
+	assert.Nil(t, err)
+	assert.Equal(t, "image/svg+xml", opts.ContentType())
+	assert.True(t, strings.HasPrefix(string(data), `<svg xmlns="http://www.w3.org/2000/svg" width="128" height="128"`))
+	assert.Contains(t, string(data), "M")
+}
+
+func TestSVGJoinsHorizontalRuns(t *testing.T) {
+
+	// When:
+	data := svg([][]bool{
+		{true, true, false},
+		{false, true, false},
+		{false, false, false},
+	}, 64)
+
+	// Then:
+	assert.Contains(t, string(data), `d="M0 0h2v1h-2zM1 1h1v1h-1z"`)
+}
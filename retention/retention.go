@@ -0,0 +1,73 @@
+package retention
+
+import (
+	"log"
+	"time"
+
+	"github.com/w32blaster/shortana/db"
+)
+
+// Policy keeps the views of every visitor only for the given number of days, older views are rolled up
+// into daily numbers per link, country, device class, rule and A/B variant. The zero value keeps the views forever
+type Policy struct {
+	db   *db.Database
+	Days int
+}
+
+// New returns the policy; zero days means the views are kept forever
+func New(database *db.Database, days int) Policy {
+	return Policy{
+		db:   database,
+		Days: days,
+	}
+}
+
+// IsEnabled returns TRUE if old views are rolled up
+func (p Policy) IsEnabled() bool {
+	return p.db != nil && p.Days > 0
+}
+
+// Before returns the first day that is kept at the given moment, views of the earlier days are rolled up
+func (p Policy) Before(now time.Time) string {
+	return now.UTC().AddDate(0, 0, -p.Days).Format(db.DayFormat)
+}
+
+// Run rolls up old views right away and then every interval, until the stop channel is closed. The done channel
+// is closed when the rollup in progress is finished, so the database can be closed after that
+func (p Policy) Run(interval time.Duration, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	p.rollup(time.Now())
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			p.rollup(now)
+		}
+	}
+}
+
+// Apply rolls up the views that are older than the retention period
+func (p Policy) Apply(now time.Time) (*db.RollupReport, error) {
+	return p.db.RollupViewsBefore(p.Before(now), false)
+}
+
+// DryRun tells what Apply would do at the given moment, without changing anything
+func (p Policy) DryRun(now time.Time) (*db.RollupReport, error) {
+	return p.db.RollupViewsBefore(p.Before(now), true)
+}
+
+func (p Policy) rollup(now time.Time) {
+	report, err := p.Apply(now)
+	if err != nil {
+		log.Println("Statistics rollup failed, error " + err.Error())
+		return
+	}
+	if report.Records > 0 {
+		log.Printf("Rolled up %d views of %d links for %s..%s into %d daily records",
+			report.Views, report.Links, report.FirstDay, report.LastDay, report.Rollups)
+	}
+}
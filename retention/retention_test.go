@@ -0,0 +1,195 @@
+package retention
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/w32blaster/shortana/db"
+)
+
+const (
+	iPhone  = "Mozilla/5.0 (iPhone; CPU iPhone OS 14_2 like Mac OS X) AppleWebKit/605.1.15 Version/14.0 Mobile/15E148 Safari/604.1"
+	desktop = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) Gecko/20100101 Firefox/84.0"
+)
+
+var now = time.Date(2020, 12, 31, 12, 0, 0, 0, time.UTC)
+
+func newTestPolicy(t *testing.T, days int) (Policy, *db.Database) {
+	dir, err := ioutil.TempDir("", "shortana-retention")
+	assert.Nil(t, err)
+
+	database := db.Init(dir)
+	t.Cleanup(func() {
+		database.Close()
+		os.RemoveAll(dir)
+	})
+	assert.Nil(t, database.SaveShortUrl("yeti", "https://example.com", "", true))
+	return New(database, days), database
+}
+
+func saveViews(t *testing.T, database *db.Database) {
+	old := now.AddDate(0, 0, -40)
+	assert.Nil(t, database.SaveStatisticsForViews([]db.OneViewStatistic{
+		{UserIpAddress: "1.1.1.1", ShortUrl: "yeti", CountryCode: "DE", UserAgent: iPhone, ViewTimes: []time.Time{old}},
+		{UserIpAddress: "1.1.1.1", ShortUrl: "yeti", CountryCode: "DE", UserAgent: iPhone, ViewTimes: []time.Time{old}},
+		{UserIpAddress: "2.2.2.2", ShortUrl: "yeti", CountryCode: "DE", UserAgent: iPhone, ViewTimes: []time.Time{old}},
+		{UserIpAddress: "3.3.3.3", ShortUrl: "yeti", CountryCode: "FR", UserAgent: desktop, ViewTimes: []time.Time{old}, ReferrerDomain: "example.org"},
+		{UserIpAddress: "1.1.1.1", ShortUrl: "yeti", CountryCode: "DE", UserAgent: iPhone, ViewTimes: []time.Time{now}},
+	}))
+}
+
+func TestDryRunChangesNothing(t *testing.T) {
+
+	// Given:
+	policy, database := newTestPolicy(t, 30)
+	saveViews(t, database)
+
+	// When:
+	report, err := policy.DryRun(now)
+
+	// Then:
+	assert.Nil(t, err)
+	assert.Equal(t, db.RollupReport{
+		Before:   "2020-12-01",
+		Records:  3,
+		Views:    4,
+		Links:    1,
+		Days:     1,
+		FirstDay: "2020-11-21",
+		LastDay:  "2020-11-21",
+		Rollups:  2,
+		DryRun:   true,
+	}, *report)
+
+	// and:
+	_, views, err := database.GetStatisticForOneURLOneDay(1, now.AddDate(0, 0, -40), false)
+	assert.Nil(t, err)
+	assert.Len(t, views, 3)
+}
+
+func TestOldViewsAreRolledUp(t *testing.T) {
+
+	// Given:
+	policy, database := newTestPolicy(t, 30)
+	saveViews(t, database)
+	before, _ := database.GetAllStatisticsGroupedByURLs(false)
+	referrersBefore, _ := database.GetTopReferrers("yeti", "", false, db.TopReferrersCount)
+
+	// When:
+	report, err := policy.Apply(now)
+
+	// Then:
+	assert.Nil(t, err)
+	assert.Equal(t, 3, report.Records)
+	assert.False(t, report.DryRun)
+
+	// and: raw views of the old day are gone, but the rollups are left
+	_, views, err := database.GetStatisticForOneURLOneDay(1, now.AddDate(0, 0, -40), false)
+	assert.Nil(t, err)
+	assert.Empty(t, views)
+	rollups, err := database.GetRollupsForOneURLOneDay("yeti", "2020-11-21", false)
+	assert.Nil(t, err)
+	if assert.Len(t, rollups, 2) {
+		assert.Equal(t, "DE", rollups[0].CountryCode)
+		assert.Equal(t, "mobile", rollups[0].Device)
+		assert.Equal(t, 3, rollups[0].Views)
+		assert.Equal(t, 2, rollups[0].Visitors)
+		assert.Equal(t, "FR", rollups[1].CountryCode)
+		assert.Equal(t, "desktop", rollups[1].Device)
+	}
+
+	// and: recent views are kept
+	_, views, err = database.GetStatisticForOneURLOneDay(1, now, false)
+	assert.Nil(t, err)
+	assert.Len(t, views, 1)
+
+	// and: summaries are the same, even after the counters are rebuilt
+	after, _ := database.GetAllStatisticsGroupedByURLs(false)
+	assert.Equal(t, before, after)
+	_, err = database.RebuildCounters()
+	assert.Nil(t, err)
+	rebuilt, _ := database.GetAllStatisticsGroupedByURLs(false)
+	assert.Equal(t, before, rebuilt)
+	referrersRebuilt, _ := database.GetTopReferrers("yeti", "", false, db.TopReferrersCount)
+	assert.Equal(t, referrersBefore, referrersRebuilt)
+	assert.Len(t, referrersRebuilt, 2)
+
+	// and: there is nothing to do the second time
+	report, err = policy.Apply(now)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, report.Records)
+}
+
+func TestRollupsKeepVariantsOfEveryDay(t *testing.T) {
+
+	// Given:
+	policy, database := newTestPolicy(t, 30)
+	assert.Nil(t, database.SaveShortUrlObject(&db.ShortURL{
+		ShortUrl:  "split",
+		TargetUrl: "https://example.com",
+		Variants:  []db.Variant{{TargetUrl: "https://example.com/a", Weight: 1}, {TargetUrl: "https://example.com/b", Weight: 1}},
+	}))
+	assert.Nil(t, database.SaveStatisticsForViews([]db.OneViewStatistic{
+		{UserIpAddress: "1.1.1.1", ShortUrl: "split", Variant: 1, UserAgent: iPhone, ViewTimes: []time.Time{now.AddDate(0, 0, -45)}},
+		{UserIpAddress: "1.1.1.1", ShortUrl: "split", Variant: 1, UserAgent: iPhone, ViewTimes: []time.Time{now.AddDate(0, 0, -45)}},
+		{UserIpAddress: "2.2.2.2", ShortUrl: "split", Variant: 2, UserAgent: iPhone, ViewTimes: []time.Time{now.AddDate(0, 0, -45)}},
+		{UserIpAddress: "3.3.3.3", ShortUrl: "split", Variant: 2, UserAgent: iPhone, ViewTimes: []time.Time{now.AddDate(0, 0, -40)}},
+		{UserIpAddress: "4.4.4.4", ShortUrl: "split", Variant: 1, UserAgent: iPhone, ViewTimes: []time.Time{now}},
+	}))
+	before, err := database.GetVariantStatisticsForOneURL(2, false)
+	assert.Nil(t, err)
+
+	// When:
+	report, err := policy.Apply(now)
+
+	// Then:
+	assert.Nil(t, err)
+	assert.Equal(t, 3, report.Records)
+	assert.Equal(t, 2, report.Days)
+	assert.Equal(t, "2020-11-16", report.FirstDay)
+	assert.Equal(t, "2020-11-21", report.LastDay)
+	assert.Equal(t, 3, report.Rollups)
+
+	// and:
+	after, err := database.GetVariantStatisticsForOneURL(2, false)
+	assert.Nil(t, err)
+	assert.Equal(t, before, after)
+	if assert.Len(t, after, 2) {
+		assert.Equal(t, 3, after[0].TotalViews)
+		assert.Equal(t, 2, after[0].UniqueViews)
+		assert.Equal(t, 2, after[1].TotalViews)
+	}
+}
+
+func TestRunStopsAfterRollup(t *testing.T) {
+
+	// Given:
+	policy, database := newTestPolicy(t, 30)
+	saveViews(t, database)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	// When:
+	go policy.Run(time.Hour, stop, done)
+	close(stop)
+
+	// Then:
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't stop")
+	}
+
+	// and: the first rollup is finished before Run is done
+	rollups, err := database.GetRollupsForOneURLOneDay("yeti", "2020-11-21", false)
+	assert.Nil(t, err)
+	assert.Len(t, rollups, 2)
+}
+
+func TestZeroPolicyIsDisabled(t *testing.T) {
+	assert.False(t, Policy{}.IsEnabled())
+	assert.False(t, New(nil, 30).IsEnabled())
+}
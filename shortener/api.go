@@ -0,0 +1,493 @@
+package shortener
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/w32blaster/shortana/db"
+	"github.com/w32blaster/shortana/stats"
+	"github.com/w32blaster/shortana/suffix"
+	"github.com/w32blaster/shortana/urlcheck"
+
+	"github.com/asdine/storm/v3"
+	"github.com/go-chi/chi"
+)
+
+const maxRequestBodySize = 1 << 20 // 1 MB is more than enough for one link
+
+type (
+	// LinkResponse is the JSON representation of one short URL
+	LinkResponse struct {
+		ID           int           `json:"id"`
+		ShortUrl     string        `json:"shortUrl"`
+		FullUrl      string        `json:"fullUrl"`
+		TargetUrl    string        `json:"targetUrl"`
+		Description  string        `json:"description"`
+		IsPublic     bool          `json:"isPublic"`
+		PublishDate  string        `json:"publishDate"`
+		ExpiresAt    *time.Time    `json:"expiresAt,omitempty"`
+		MaxClicks    int           `json:"maxClicks"`
+		Clicks       int           `json:"clicks"`
+		HasPassword  bool          `json:"hasPassword"`
+		RedirectType int           `json:"redirectType"` // zero means the global default
+		Rules        []RuleJSON    `json:"rules"`
+		Variants     []VariantJSON `json:"variants"`
+		Passthrough  bool          `json:"passthrough"`
+		UTM          UTMJSON       `json:"utm"`
+	}
+
+	// RuleJSON is the JSON representation of the db.RedirectRule
+	RuleJSON struct {
+		Countries []string `json:"countries,omitempty"`
+		OS        []string `json:"os,omitempty"`
+		Devices   []string `json:"devices,omitempty"`
+		TargetUrl string   `json:"targetUrl"`
+	}
+
+	// UTMJSON is the JSON representation of the db.UTM
+	UTMJSON struct {
+		Source   string `json:"source"`
+		Medium   string `json:"medium"`
+		Campaign string `json:"campaign"`
+	}
+
+	// VariantJSON is the JSON representation of the db.Variant
+	VariantJSON struct {
+		TargetUrl string `json:"targetUrl"`
+		Weight    int    `json:"weight"`
+	}
+
+	// LinkRequest is the payload to create or update a short URL. On update only
+	// the fields that are present in the payload will be changed
+	LinkRequest struct {
+		ShortUrl     *string        `json:"shortUrl"` // generated on create if it is missing
+		TargetUrl    *string        `json:"targetUrl"`
+		Description  *string        `json:"description"`
+		IsPublic     *bool          `json:"isPublic"`
+		ExpiresAt    *string        `json:"expiresAt"`    // RFC3339, empty string removes the expiry date
+		MaxClicks    *int           `json:"maxClicks"`    // zero means unlimited
+		Password     *string        `json:"password"`     // empty string removes the password
+		RedirectType *int           `json:"redirectType"` // 301, 302, 307, 308, 200 for the redirect page or 0 for the default
+		Rules        *[]RuleJSON    `json:"rules"`        // replace all the rules, empty list removes them
+		Variants     *[]VariantJSON `json:"variants"`     // replace the A/B split, empty list stops it
+		Passthrough  *bool          `json:"passthrough"`  // append the rest of the path and the query to the target
+		UTM          *UTMJSON       `json:"utm"`          // replace all the tags, empty values remove them
+	}
+
+	ErrorResponse struct {
+		Error string `json:"error"`
+	}
+
+	linksAPI struct {
+		db           *db.Database
+		stats        *stats.Statistics
+		hostname     string
+		suffixes     suffix.Generator
+		suffixPolicy suffix.Policy
+		targets      urlcheck.Checker
+	}
+)
+
+// apiRouter returns REST API handlers to manage short URLs and read their statistics. All the endpoints require the
+// header "Authorization: Bearer <token>"
+func apiRouter(database *db.Database, statistics *stats.Statistics, cfg Config) http.Handler {
+	api := linksAPI{
+		db:           database,
+		stats:        statistics,
+		hostname:     cfg.Hostname,
+		suffixes:     cfg.Suffixes,
+		suffixPolicy: cfg.SuffixPolicy,
+		targets:      cfg.Targets,
+	}
+
+	r := chi.NewRouter()
+	r.Use(bearerAuth(cfg.ApiToken))
+
+	r.Route("/links", func(r chi.Router) {
+		r.Get("/", api.list)
+		r.Post("/", api.create)
+		r.Get("/{id}", api.get)
+		r.Patch("/{id}", api.update)
+		r.Delete("/{id}", api.delete)
+		r.Get("/{id}/stats", api.oneURLStats)
+		r.Get("/{id}/stats/{day}", api.oneURLOneDayStats)
+	})
+	r.Get("/stats", api.allStats)
+
+	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		writeJSONError(w, http.StatusNotFound, "resource not found")
+	})
+	r.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	})
+
+	return r
+}
+
+// bearerAuth rejects all the requests without the valid token
+func bearerAuth(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			header := r.Header.Get("Authorization")
+			const prefix = "Bearer "
+			if !strings.HasPrefix(header, prefix) ||
+				subtle.ConstantTimeCompare([]byte(header[len(prefix):]), []byte(token)) != 1 {
+
+				w.Header().Set("WWW-Authenticate", `Bearer realm="shortana"`)
+				writeJSONError(w, http.StatusUnauthorized, "invalid or missing bearer token")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (a linksAPI) list(w http.ResponseWriter, r *http.Request) {
+	links, err := a.db.GetAll()
+	if err != nil {
+		log.Println("API: can't read links, error " + err.Error())
+		writeJSONError(w, http.StatusInternalServerError, "can't read links")
+		return
+	}
+
+	resp := make([]LinkResponse, 0, len(links))
+	for _, link := range links {
+		resp = append(resp, a.toResponse(&link))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (a linksAPI) get(w http.ResponseWriter, r *http.Request) {
+	link, ok := a.findLink(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, a.toResponse(link))
+}
+
+func (a linksAPI) create(w http.ResponseWriter, r *http.Request) {
+	var payload LinkRequest
+	if !decodeJSON(w, r, &payload) {
+		return
+	}
+
+	if payload.TargetUrl == nil {
+		writeJSONError(w, http.StatusBadRequest, "targetUrl is required")
+		return
+	}
+	if err := a.validateLinkRequest(&payload); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if payload.ShortUrl == nil || len(strings.TrimSpace(*payload.ShortUrl)) == 0 {
+		generated, err := a.suffixes.Generate(*payload.TargetUrl, a.isSuffixUnavailable)
+		if err != nil {
+			log.Println("API: can't generate a short URL, error " + err.Error())
+			writeJSONError(w, http.StatusConflict, err.Error())
+			return
+		}
+		payload.ShortUrl = &generated
+	} else if err := a.suffixPolicy.Validate(*payload.ShortUrl); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "shortUrl is invalid: "+err.Error())
+		return
+	} else if a.suffixPolicy.IgnoreCase && a.db.IsShortUrlTaken(*payload.ShortUrl, true) {
+		writeJSONError(w, http.StatusConflict, "short URL '"+*payload.ShortUrl+"' already exists")
+		return
+	}
+
+	passwordHash, err := hashPasswordFromRequest(&payload)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "can't use this password: "+err.Error())
+		return
+	}
+
+	link := db.ShortURL{
+		ShortUrl:  *payload.ShortUrl,
+		TargetUrl: *payload.TargetUrl,
+	}
+	applyLinkRequest(&link, &payload, passwordHash)
+
+	if err := a.db.SaveShortUrlObject(&link); err != nil {
+		if err == storm.ErrAlreadyExists {
+			writeJSONError(w, http.StatusConflict, "short URL '"+link.ShortUrl+"' already exists")
+			return
+		}
+		log.Println("API: failed to save a new short link, error " + err.Error())
+		writeJSONError(w, http.StatusInternalServerError, "can't save the link")
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, a.toResponse(&link))
+}
+
+func (a linksAPI) update(w http.ResponseWriter, r *http.Request) {
+	link, ok := a.findLink(w, r)
+	if !ok {
+		return
+	}
+
+	var payload LinkRequest
+	if !decodeJSON(w, r, &payload) {
+		return
+	}
+
+	if payload.ShortUrl != nil && *payload.ShortUrl != link.ShortUrl {
+		writeJSONError(w, http.StatusBadRequest, "shortUrl can't be changed")
+		return
+	}
+	if err := a.validateLinkRequest(&payload); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// bcrypt is slow, so the password is hashed before the transaction
+	passwordHash, err := hashPasswordFromRequest(&payload)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "can't use this password: "+err.Error())
+		return
+	}
+
+	updated, err := a.db.ModifyShortUrl(link.ID, func(link *db.ShortURL) {
+		applyLinkRequest(link, &payload, passwordHash)
+	})
+	if err != nil {
+		if err == storm.ErrNotFound {
+			writeJSONError(w, http.StatusNotFound, "link not found")
+			return
+		}
+		log.Printf("API: failed to update the link %s, error %s", link.ShortUrl, err.Error())
+		writeJSONError(w, http.StatusInternalServerError, "can't update the link")
+		return
+	}
+	writeJSON(w, http.StatusOK, a.toResponse(updated))
+}
+
+// hashPasswordFromRequest returns the hash of the password, if it is present in the payload
+func hashPasswordFromRequest(payload *LinkRequest) (string, error) {
+	if payload.Password == nil {
+		return "", nil
+	}
+	return db.HashPassword(*payload.Password)
+}
+
+// applyLinkRequest copies the fields that are present in the payload to the link, except the short URL.
+// The payload must be validated and the password hashed already
+func applyLinkRequest(link *db.ShortURL, payload *LinkRequest, passwordHash string) {
+	if payload.TargetUrl != nil {
+		link.TargetUrl = *payload.TargetUrl
+	}
+	if payload.Description != nil {
+		link.Description = *payload.Description
+	}
+	if payload.IsPublic != nil {
+		link.IsPublic = *payload.IsPublic
+	}
+	if payload.ExpiresAt != nil {
+		link.ExpiresAt, _ = parseExpiresAt(*payload.ExpiresAt)
+	}
+	if payload.MaxClicks != nil {
+		link.MaxClicks = *payload.MaxClicks
+	}
+	if payload.Password != nil {
+		link.PasswordHash = passwordHash
+	}
+	if payload.RedirectType != nil {
+		link.RedirectType = *payload.RedirectType
+	}
+	if payload.Rules != nil {
+		link.Rules = fromRulesJSON(*payload.Rules)
+	}
+	if payload.Variants != nil {
+		link.Variants = fromVariantsJSON(*payload.Variants)
+	}
+	if payload.Passthrough != nil {
+		link.Passthrough = *payload.Passthrough
+	}
+	if payload.UTM != nil {
+		link.UTM = db.UTM(*payload.UTM)
+	}
+}
+
+func (a linksAPI) delete(w http.ResponseWriter, r *http.Request) {
+	link, ok := a.findLink(w, r)
+	if !ok {
+		return
+	}
+
+	if err := a.db.DeleteShortURLandStats(link.ID); err != nil {
+		log.Println("API: error deleting of the ShortURL, err: " + err.Error())
+		writeJSONError(w, http.StatusInternalServerError, "can't delete the link")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// findLink loads the link by the {id} URL parameter. If it returns false, then
+// the error response is already written
+func (a linksAPI) findLink(w http.ResponseWriter, r *http.Request) (*db.ShortURL, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "id must be a number")
+		return nil, false
+	}
+
+	link, err := a.db.GetUrlByID(id)
+	if err != nil {
+		if err == storm.ErrNotFound {
+			writeJSONError(w, http.StatusNotFound, "link not found")
+			return nil, false
+		}
+		log.Println("API: can't read a link, error " + err.Error())
+		writeJSONError(w, http.StatusInternalServerError, "can't read the link")
+		return nil, false
+	}
+	return link, true
+}
+
+func (a linksAPI) toResponse(link *db.ShortURL) LinkResponse {
+	rules := make([]RuleJSON, 0, len(link.Rules))
+	for _, rule := range link.Rules {
+		rules = append(rules, RuleJSON{
+			Countries: rule.Countries,
+			OS:        rule.OS,
+			Devices:   rule.Devices,
+			TargetUrl: rule.TargetUrl,
+		})
+	}
+
+	variants := make([]VariantJSON, 0, len(link.Variants))
+	for _, variant := range link.Variants {
+		variants = append(variants, VariantJSON{
+			TargetUrl: variant.TargetUrl,
+			Weight:    variant.Weight,
+		})
+	}
+
+	var expiresAt *time.Time
+	if !link.ExpiresAt.IsZero() {
+		expiresAt = &link.ExpiresAt
+	}
+
+	return LinkResponse{
+		ID:           link.ID,
+		ShortUrl:     link.ShortUrl,
+		FullUrl:      a.hostname + "/" + link.ShortUrl,
+		TargetUrl:    link.TargetUrl,
+		Description:  link.Description,
+		IsPublic:     link.IsPublic,
+		PublishDate:  link.PublishDate,
+		ExpiresAt:    expiresAt,
+		MaxClicks:    link.MaxClicks,
+		Clicks:       link.Clicks,
+		HasPassword:  link.IsProtected(),
+		RedirectType: link.RedirectType,
+		Rules:        rules,
+		Variants:     variants,
+		Passthrough:  link.Passthrough,
+		UTM:          UTMJSON(link.UTM),
+	}
+}
+
+// returns TRUE if the generated suffix can't be used
+func (a linksAPI) isSuffixUnavailable(text string) bool {
+	return a.suffixPolicy.Validate(text) != nil || a.db.IsShortUrlTaken(text, a.suffixPolicy.IgnoreCase)
+}
+
+// validateLinkRequest checks values that are present in the payload. The target URL is trimmed here,
+// so the same value is checked and saved
+func (a linksAPI) validateLinkRequest(payload *LinkRequest) error {
+	if payload.TargetUrl != nil {
+		*payload.TargetUrl = strings.TrimSpace(*payload.TargetUrl)
+		if err := a.targets.Check(*payload.TargetUrl); err != nil {
+			return errors.New("targetUrl is invalid: " + err.Error())
+		}
+	}
+	if payload.ExpiresAt != nil {
+		if _, err := parseExpiresAt(*payload.ExpiresAt); err != nil {
+			return errors.New("expiresAt must be in RFC3339 format, for example 2021-01-31T18:00:00Z")
+		}
+	}
+	if payload.MaxClicks != nil && *payload.MaxClicks < 0 {
+		return errors.New("maxClicks must not be negative")
+	}
+	if payload.RedirectType != nil && *payload.RedirectType != 0 && !db.IsValidRedirectType(*payload.RedirectType) {
+		return fmt.Errorf("redirectType must be 0 or one of %v", db.RedirectTypes)
+	}
+	if payload.Rules != nil {
+		rules := fromRulesJSON(*payload.Rules)
+		if err := db.ValidateRules(rules, a.targets); err != nil {
+			return err
+		}
+	}
+	if payload.Variants != nil {
+		variants := fromVariantsJSON(*payload.Variants)
+		if err := db.ValidateVariants(variants, a.targets); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fromVariantsJSON(variantsJSON []VariantJSON) []db.Variant {
+	variants := make([]db.Variant, 0, len(variantsJSON))
+	for _, variant := range variantsJSON {
+		variants = append(variants, db.Variant{
+			TargetUrl: strings.TrimSpace(variant.TargetUrl),
+			Weight:    variant.Weight,
+		})
+	}
+	return variants
+}
+
+func fromRulesJSON(rulesJSON []RuleJSON) []db.RedirectRule {
+	rules := make([]db.RedirectRule, 0, len(rulesJSON))
+	for _, rule := range rulesJSON {
+		rules = append(rules, db.RedirectRule{
+			Countries: rule.Countries,
+			OS:        rule.OS,
+			Devices:   rule.Devices,
+			TargetUrl: strings.TrimSpace(rule.TargetUrl),
+		})
+	}
+	return db.NormalizeRules(rules)
+}
+
+// parseExpiresAt parses expiry date from the payload, where empty value means "never expires"
+func parseExpiresAt(value string) (time.Time, error) {
+	if len(value) == 0 {
+		return time.Time{}, nil
+	}
+	expiresAt, err := time.Parse(time.RFC3339, value)
+	return expiresAt.UTC(), err
+}
+
+// decodeJSON parses request body. If it returns false, then the error response is already written
+func decodeJSON(w http.ResponseWriter, r *http.Request, to interface{}) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBodySize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(to); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON: "+err.Error())
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		log.Println("API: error encoding response: " + err.Error())
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, ErrorResponse{Error: message})
+}
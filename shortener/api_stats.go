@@ -0,0 +1,280 @@
+package shortener
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/w32blaster/shortana/db"
+
+	"github.com/go-chi/chi"
+)
+
+type (
+	// OneURLStatsResponse is the per-day statistics for one short URL
+	OneURLStatsResponse struct {
+		Link      LinkResponse                  `json:"link"`
+		Days      []db.OneDaySummaryStatistics  `json:"days"`
+		Variants  []db.VariantSummaryStatistics `json:"variants"`  // for the whole time, regardless the period
+		Referrers []db.ReferrerStatistics       `json:"referrers"` // top referrers for the whole time, regardless the period
+		Clients   *db.ClientBreakdown           `json:"clients"`   // for the whole time, regardless the period
+	}
+
+	// OneDayStatsResponse lists all the visitors of one short URL for one day
+	OneDayStatsResponse struct {
+		Link      LinkResponse            `json:"link"`
+		Day       string                  `json:"day"`
+		Views     []ViewResponse          `json:"views"`
+		Rollups   []RollupResponse        `json:"rollups"` // if the day is older than the retention period, only these are left
+		Referrers []db.ReferrerStatistics `json:"referrers"`
+	}
+
+	// RollupResponse is the JSON representation of the db.DailyRollup
+	RollupResponse struct {
+		CountryCode string `json:"countryCode"`
+		Device      string `json:"device"`
+		IsBot       bool   `json:"isBot"`
+		MatchedRule int    `json:"matchedRule"`
+		Variant     int    `json:"variant"`
+		Views       int    `json:"views"`
+		Visitors    int    `json:"visitors"`
+	}
+
+	// ViewResponse is the JSON representation of the db.OneViewStatistic
+	ViewResponse struct {
+		ID             int         `json:"id"`
+		UserIpAddress  string      `json:"userIpAddress"`
+		ShortUrl       string      `json:"shortUrl"`
+		Day            string      `json:"day"`
+		CountryCode    string      `json:"countryCode"`
+		CountryName    string      `json:"countryName"`
+		City           string      `json:"city"`
+		UserAgent      string      `json:"userAgent"`
+		Views          int         `json:"views"`     // number of all the views of the visitor during the day
+		ViewTimes      []time.Time `json:"viewTimes"` // only the latest views, see db.MaxViewTimes
+		MatchedRule    int         `json:"matchedRule"`
+		Variant        int         `json:"variant"`
+		IsBot          bool        `json:"isBot"`
+		ReferrerDomain string      `json:"referrerDomain"` // empty for direct visits
+		Referrer       string      `json:"referrer"`       // the full URL, if it is kept
+		Browser        string      `json:"browser"`        // the parsed userAgent; empty for views saved by older versions
+		BrowserVersion string      `json:"browserVersion"`
+		OS             string      `json:"os"`
+		Device         string      `json:"device"`
+	}
+)
+
+// allStats returns summary for every short URL, the same as the bot command /stats. Views of bots
+// are not counted, unless the query parameter "includeBots=true" is given; the same applies to other statistics.
+// The header X-Dropped-Views tells how many views were lost since the start, because the queue was full
+func (a linksAPI) allStats(w http.ResponseWriter, r *http.Request) {
+	includeBots, ok := parseIncludeBotsParam(w, r)
+	if !ok {
+		return
+	}
+
+	grouped, err := a.db.GetAllStatisticsGroupedByURLs(includeBots)
+	if err != nil {
+		log.Println("API: error getting grouped stats, err is " + err.Error())
+		writeJSONError(w, http.StatusInternalServerError, "can't get statistics")
+		return
+	}
+
+	resp := make([]db.OneURLSummaryStatistics, 0, len(grouped))
+	for _, summary := range grouped {
+		resp = append(resp, summary)
+	}
+	sort.Slice(resp, func(i, j int) bool {
+		return resp[i].ShortUrlID < resp[j].ShortUrlID
+	})
+
+	w.Header().Set("X-Dropped-Views", strconv.FormatUint(a.stats.Dropped(), 10))
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// oneURLStats returns views grouped by day for one short URL. Optional query
+// parameters "from" and "to" (inclusive, format is 2006-01-02) limit the period
+func (a linksAPI) oneURLStats(w http.ResponseWriter, r *http.Request) {
+	link, ok := a.findLink(w, r)
+	if !ok {
+		return
+	}
+
+	from, ok := parseDayParam(w, r.URL.Query().Get("from"), "from")
+	if !ok {
+		return
+	}
+	to, ok := parseDayParam(w, r.URL.Query().Get("to"), "to")
+	if !ok {
+		return
+	}
+	includeBots, ok := parseIncludeBotsParam(w, r)
+	if !ok {
+		return
+	}
+
+	_, days, err := a.db.GetStatisticsForOneURL(link.ID, includeBots)
+	if err != nil {
+		log.Printf("API: can't get statistics for short ID = %d, error is %s", link.ID, err.Error())
+		writeJSONError(w, http.StatusInternalServerError, "can't get statistics")
+		return
+	}
+
+	variants, err := a.db.GetVariantStatisticsForOneURL(link.ID, includeBots)
+	if err != nil {
+		log.Printf("API: can't get variant statistics for short ID = %d, error is %s", link.ID, err.Error())
+		writeJSONError(w, http.StatusInternalServerError, "can't get statistics")
+		return
+	}
+
+	referrers, err := a.db.GetTopReferrers(link.ShortUrl, "", includeBots, db.TopReferrersCount)
+	if err != nil {
+		log.Printf("API: can't get referrers for short ID = %d, error is %s", link.ID, err.Error())
+		writeJSONError(w, http.StatusInternalServerError, "can't get statistics")
+		return
+	}
+
+	clients, err := a.db.GetClientBreakdown(link.ShortUrl, "", includeBots)
+	if err != nil {
+		log.Printf("API: can't get client breakdown for short ID = %d, error is %s", link.ID, err.Error())
+		writeJSONError(w, http.StatusInternalServerError, "can't get statistics")
+		return
+	}
+
+	// days are sortable strings, so they can be compared without parsing
+	resp := OneURLStatsResponse{
+		Link:      a.toResponse(link),
+		Days:      make([]db.OneDaySummaryStatistics, 0, len(days)),
+		Variants:  variants,
+		Referrers: referrers,
+		Clients:   clients,
+	}
+	for day, summary := range days {
+		if (len(from) > 0 && day < from) || (len(to) > 0 && day > to) {
+			continue
+		}
+		resp.Days = append(resp.Days, summary)
+	}
+	sort.Slice(resp.Days, func(i, j int) bool {
+		return resp.Days[i].Date < resp.Days[j].Date
+	})
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// oneURLOneDayStats returns all the visitors for one short URL for the given {day}
+func (a linksAPI) oneURLOneDayStats(w http.ResponseWriter, r *http.Request) {
+	link, ok := a.findLink(w, r)
+	if !ok {
+		return
+	}
+
+	dayDate, err := time.Parse(db.DayFormat, chi.URLParam(r, "day"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "day must be in format "+db.DayFormat)
+		return
+	}
+	includeBots, ok := parseIncludeBotsParam(w, r)
+	if !ok {
+		return
+	}
+
+	_, views, err := a.db.GetStatisticForOneURLOneDay(link.ID, dayDate, includeBots)
+	if err != nil {
+		log.Printf("API: can't get stats for the short ID=%d, error is %s", link.ID, err.Error())
+		writeJSONError(w, http.StatusInternalServerError, "can't get statistics")
+		return
+	}
+
+	rollups, err := a.db.GetRollupsForOneURLOneDay(link.ShortUrl, dayDate.Format(db.DayFormat), includeBots)
+	if err != nil {
+		log.Printf("API: can't get rollups for the short ID=%d, error is %s", link.ID, err.Error())
+		writeJSONError(w, http.StatusInternalServerError, "can't get statistics")
+		return
+	}
+
+	referrers, err := a.db.GetTopReferrers(link.ShortUrl, dayDate.Format(db.DayFormat), includeBots, db.TopReferrersCount)
+	if err != nil {
+		log.Printf("API: can't get referrers for the short ID=%d, error is %s", link.ID, err.Error())
+		writeJSONError(w, http.StatusInternalServerError, "can't get statistics")
+		return
+	}
+
+	resp := OneDayStatsResponse{
+		Link:      a.toResponse(link),
+		Day:       dayDate.Format(db.DayFormat),
+		Views:     make([]ViewResponse, 0, len(views)),
+		Rollups:   make([]RollupResponse, 0, len(rollups)),
+		Referrers: referrers,
+	}
+	for _, view := range views {
+		resp.Views = append(resp.Views, toViewResponse(&view))
+	}
+	for _, rollup := range rollups {
+		resp.Rollups = append(resp.Rollups, RollupResponse{
+			CountryCode: rollup.CountryCode,
+			Device:      rollup.Device,
+			IsBot:       rollup.IsBot,
+			MatchedRule: rollup.MatchedRule,
+			Variant:     rollup.Variant,
+			Views:       rollup.Views,
+			Visitors:    rollup.Visitors,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// parseDayParam validates optional date from the query. If it returns false, then
+// the error response is already written
+func parseDayParam(w http.ResponseWriter, value, name string) (string, bool) {
+	if len(value) == 0 {
+		return "", true
+	}
+	if _, err := time.Parse(db.DayFormat, value); err != nil {
+		writeJSONError(w, http.StatusBadRequest, name+" must be in format "+db.DayFormat)
+		return "", false
+	}
+	return value, true
+}
+
+// parseIncludeBotsParam reads the optional "includeBots" from the query. If it returns false, then
+// the error response is already written
+func parseIncludeBotsParam(w http.ResponseWriter, r *http.Request) (bool, bool) {
+	value := r.URL.Query().Get("includeBots")
+	if len(value) == 0 {
+		return false, true
+	}
+	includeBots, err := strconv.ParseBool(value)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "includeBots must be true or false")
+		return false, false
+	}
+	return includeBots, true
+}
+
+func toViewResponse(view *db.OneViewStatistic) ViewResponse {
+	return ViewResponse{
+		ID:             view.ID,
+		UserIpAddress:  view.UserIpAddress,
+		ShortUrl:       view.ShortUrl,
+		Day:            view.Day,
+		CountryCode:    view.CountryCode,
+		CountryName:    view.CountryName,
+		City:           view.City,
+		UserAgent:      view.UserAgent,
+		Views:          view.ViewCount(),
+		ViewTimes:      view.ViewTimes,
+		MatchedRule:    view.MatchedRule,
+		Variant:        view.Variant,
+		IsBot:          view.IsBot,
+		ReferrerDomain: view.ReferrerDomain,
+		Referrer:       view.Referrer,
+		Browser:        view.Browser,
+		BrowserVersion: view.BrowserVersion,
+		OS:             view.OS,
+		Device:         view.Device,
+	}
+}
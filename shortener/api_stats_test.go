@@ -0,0 +1,222 @@
+package shortener
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/w32blaster/shortana/db"
+)
+
+func TestApiAllStats(t *testing.T) {
+
+	// Given:
+	api, database := newTestAPI(t)
+	assert.Nil(t, database.SaveShortUrl("abc", "https://example.com", "", true))
+	saveTestView(t, database, "1.2.3.4", "abc", "GB", "London")
+	saveTestView(t, database, "1.2.3.4", "abc", "GB", "London")
+	saveTestView(t, database, "5.6.7.8", "abc", "DE", "Berlin")
+
+	// When:
+	resp := doRequest(api, http.MethodGet, "/stats", "", testToken)
+
+	// Then:
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var summary []db.OneURLSummaryStatistics
+	assert.Nil(t, json.Unmarshal(resp.Body.Bytes(), &summary))
+	assert.Len(t, summary, 1)
+	assert.Equal(t, "abc", summary[0].ShortUrl)
+	assert.Equal(t, 3, summary[0].TotalViews)
+	assert.Equal(t, 2, summary[0].TotalUniqueUsers)
+	assert.Equal(t, "0", resp.Header().Get("X-Dropped-Views"))
+}
+
+func TestApiStatsIncludeBots(t *testing.T) {
+
+	// Given:
+	api, database := newTestAPI(t)
+	assert.Nil(t, database.SaveShortUrl("abc", "https://example.com", "", true))
+	saveTestView(t, database, "1.2.3.4", "abc", "GB", "London")
+	assert.Nil(t, database.SaveStatisticForOneView(&db.OneViewStatistic{UserIpAddress: "66.249.66.1", ShortUrl: "abc", IsBot: true}))
+	day := time.Now().UTC().Format(db.DayFormat)
+
+	// When:
+	respDefault := doRequest(api, http.MethodGet, "/links/1/stats/"+day, "", testToken)
+	respWithBots := doRequest(api, http.MethodGet, "/links/1/stats/"+day+"?includeBots=true", "", testToken)
+	respWrong := doRequest(api, http.MethodGet, "/stats?includeBots=maybe", "", testToken)
+
+	// Then:
+	var withoutBots, withBots OneDayStatsResponse
+	assert.Nil(t, json.Unmarshal(respDefault.Body.Bytes(), &withoutBots))
+	assert.Nil(t, json.Unmarshal(respWithBots.Body.Bytes(), &withBots))
+	assert.Len(t, withoutBots.Views, 1)
+	assert.Len(t, withBots.Views, 2)
+	assert.Equal(t, http.StatusBadRequest, respWrong.Code)
+}
+
+func TestApiOneURLStatsWithPeriod(t *testing.T) {
+
+	// Given:
+	api, database := newTestAPI(t)
+	assert.Nil(t, database.SaveShortUrl("abc", "https://example.com", "", true))
+	saveTestView(t, database, "1.2.3.4", "abc", "GB", "London")
+	today := time.Now().UTC().Format(db.DayFormat)
+
+	// When:
+	respToday := doRequest(api, http.MethodGet, "/links/1/stats?from="+today+"&to="+today, "", testToken)
+	respPast := doRequest(api, http.MethodGet, "/links/1/stats?to=2020-01-01", "", testToken)
+
+	// Then:
+	assert.Equal(t, http.StatusOK, respToday.Code)
+	var stats OneURLStatsResponse
+	assert.Nil(t, json.Unmarshal(respToday.Body.Bytes(), &stats))
+	assert.Equal(t, "abc", stats.Link.ShortUrl)
+	assert.Len(t, stats.Days, 1)
+	assert.Equal(t, today, stats.Days[0].Date)
+	assert.Equal(t, 1, stats.Days[0].TotalViews)
+
+	// and:
+	assert.Nil(t, json.Unmarshal(respPast.Body.Bytes(), &stats))
+	assert.Len(t, stats.Days, 0)
+}
+
+func TestApiOneURLStatsWithoutViews(t *testing.T) {
+
+	// Given:
+	api, database := newTestAPI(t)
+	assert.Nil(t, database.SaveShortUrl("abc", "https://example.com", "", true))
+
+	// When:
+	resp := doRequest(api, http.MethodGet, "/links/1/stats", "", testToken)
+	respWrongDate := doRequest(api, http.MethodGet, "/links/1/stats?from=yesterday", "", testToken)
+	respUnknown := doRequest(api, http.MethodGet, "/links/2/stats", "", testToken)
+
+	// Then:
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, http.StatusBadRequest, respWrongDate.Code)
+	assert.Equal(t, http.StatusNotFound, respUnknown.Code)
+}
+
+func TestApiOneURLOneDayStats(t *testing.T) {
+
+	// Given:
+	api, database := newTestAPI(t)
+	assert.Nil(t, database.SaveShortUrl("abc", "https://example.com", "", true))
+	saveTestView(t, database, "1.2.3.4", "abc", "GB", "London")
+	today := time.Now().UTC().Format(db.DayFormat)
+
+	// When:
+	resp := doRequest(api, http.MethodGet, "/links/1/stats/"+today, "", testToken)
+	respWrongDay := doRequest(api, http.MethodGet, "/links/1/stats/20201201", "", testToken)
+
+	// Then:
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var stats OneDayStatsResponse
+	assert.Nil(t, json.Unmarshal(resp.Body.Bytes(), &stats))
+	assert.Len(t, stats.Views, 1)
+	assert.Equal(t, "1.2.3.4", stats.Views[0].UserIpAddress)
+	assert.Equal(t, "London", stats.Views[0].City)
+
+	// and:
+	assert.Equal(t, http.StatusBadRequest, respWrongDay.Code)
+}
+
+func TestApiOneURLStatsWithVariants(t *testing.T) {
+
+	// Given:
+	api, database := newTestAPI(t)
+	assert.Nil(t, database.SaveShortUrlObject(&db.ShortURL{
+		ShortUrl:  "ab",
+		TargetUrl: "https://example.com",
+		Variants: []db.Variant{
+			{TargetUrl: "https://example.com/a", Weight: 3},
+			{TargetUrl: "https://example.com/b", Weight: 1},
+		},
+	}))
+	for _, view := range []db.OneViewStatistic{
+		{UserIpAddress: "1.2.3.4", ShortUrl: "ab", Variant: 1},
+		{UserIpAddress: "1.2.3.4", ShortUrl: "ab", Variant: 1},
+		{UserIpAddress: "5.6.7.8", ShortUrl: "ab", Variant: 1},
+	} {
+		view := view
+		assert.Nil(t, database.SaveStatisticForOneView(&view))
+	}
+
+	// When:
+	resp := doRequest(api, http.MethodGet, "/links/1/stats", "", testToken)
+
+	// Then:
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var stats OneURLStatsResponse
+	assert.Nil(t, json.Unmarshal(resp.Body.Bytes(), &stats))
+	assert.Equal(t, []db.VariantSummaryStatistics{
+		{Variant: 1, TargetUrl: "https://example.com/a", Weight: 3, Percent: 75, TotalViews: 3, UniqueViews: 2},
+		{Variant: 2, TargetUrl: "https://example.com/b", Weight: 1, Percent: 25, TotalViews: 0, UniqueViews: 0},
+	}, stats.Variants)
+}
+
+func TestApiStatsTopReferrers(t *testing.T) {
+
+	// Given:
+	api, database := newTestAPI(t)
+	assert.Nil(t, database.SaveShortUrl("abc", "https://example.com", "", true))
+	for _, view := range []db.OneViewStatistic{
+		{UserIpAddress: "1.2.3.4", ShortUrl: "abc", ReferrerDomain: "news.ycombinator.com", Referrer: "https://news.ycombinator.com/item?id=1"},
+		{UserIpAddress: "5.6.7.8", ShortUrl: "abc", ReferrerDomain: "news.ycombinator.com"},
+		{UserIpAddress: "9.9.9.9", ShortUrl: "abc"},
+	} {
+		view := view
+		assert.Nil(t, database.SaveStatisticForOneView(&view))
+	}
+	today := time.Now().UTC().Format(db.DayFormat)
+
+	// When:
+	respLink := doRequest(api, http.MethodGet, "/links/1/stats", "", testToken)
+	respDay := doRequest(api, http.MethodGet, "/links/1/stats/"+today, "", testToken)
+
+	// Then:
+	expected := []db.ReferrerStatistics{
+		{Domain: "news.ycombinator.com", Visitors: 2},
+		{Domain: "", Visitors: 1},
+	}
+	var linkStats OneURLStatsResponse
+	assert.Nil(t, json.Unmarshal(respLink.Body.Bytes(), &linkStats))
+	assert.Equal(t, expected, linkStats.Referrers)
+
+	// and:
+	var dayStats OneDayStatsResponse
+	assert.Nil(t, json.Unmarshal(respDay.Body.Bytes(), &dayStats))
+	assert.Equal(t, expected, dayStats.Referrers)
+	assert.Contains(t, respDay.Body.String(), `"referrer":"https://news.ycombinator.com/item?id=1"`)
+}
+
+func TestApiStatsClientBreakdown(t *testing.T) {
+
+	// Given:
+	api, database := newTestAPI(t)
+	assert.Nil(t, database.SaveShortUrl("abc", "https://example.com", "", true))
+	for _, view := range []db.OneViewStatistic{
+		{UserIpAddress: "1.2.3.4", ShortUrl: "abc", Browser: "Safari", BrowserVersion: "14", OS: "iOS", Device: "mobile"},
+		{UserIpAddress: "5.6.7.8", ShortUrl: "abc", Browser: "Chrome", BrowserVersion: "87", OS: "Windows", Device: "desktop"},
+	} {
+		view := view
+		assert.Nil(t, database.SaveStatisticForOneView(&view))
+	}
+	today := time.Now().UTC().Format(db.DayFormat)
+
+	// When:
+	resp := doRequest(api, http.MethodGet, "/links/1/stats", "", testToken)
+	respDay := doRequest(api, http.MethodGet, "/links/1/stats/"+today, "", testToken)
+
+	// Then:
+	var stats OneURLStatsResponse
+	assert.Nil(t, json.Unmarshal(resp.Body.Bytes(), &stats))
+	assert.Equal(t, []db.Share{{Name: "desktop", Visitors: 1, Percent: 50}, {Name: "mobile", Visitors: 1, Percent: 50}}, stats.Clients.Devices)
+	assert.Len(t, stats.Clients.OS, 2)
+	assert.Len(t, stats.Clients.Browsers, 2)
+
+	// and:
+	assert.Contains(t, respDay.Body.String(), `"browser":"Safari","browserVersion":"14","os":"iOS","device":"mobile"`)
+}
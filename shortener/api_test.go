@@ -0,0 +1,287 @@
+package shortener
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/w32blaster/shortana/db"
+	"github.com/w32blaster/shortana/stats"
+	"github.com/w32blaster/shortana/suffix"
+	"github.com/w32blaster/shortana/urlcheck"
+)
+
+const testToken = "secret-token"
+
+func newTestAPI(t *testing.T) (http.Handler, *db.Database) {
+	dir, err := ioutil.TempDir("", "shortana-api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	database := db.Init(dir)
+	t.Cleanup(func() {
+		database.Close()
+		os.RemoveAll(dir)
+	})
+	return apiRouter(database, stats.New(database, nil), Config{
+		Hostname:     "https://sho.rt",
+		ApiToken:     testToken,
+		Suffixes:     suffix.Generator{Strategy: suffix.StrategyHash, Length: 6},
+		SuffixPolicy: suffix.NewPolicy(nil, true),
+		Targets:      urlcheck.Checker{Hostname: "https://sho.rt"},
+	}), database
+}
+
+func saveTestView(t *testing.T, database *db.Database, ipAddress, shortUrl, countryCode, city string) {
+	assert.Nil(t, database.SaveStatisticForOneView(&db.OneViewStatistic{
+		UserIpAddress: ipAddress,
+		ShortUrl:      shortUrl,
+		CountryCode:   countryCode,
+		City:          city,
+		UserAgent:     "curl",
+	}))
+}
+
+func doRequest(handler http.Handler, method, path, body, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if len(token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestApiRejectsRequestsWithoutToken(t *testing.T) {
+
+	// Given:
+	api, _ := newTestAPI(t)
+
+	// When:
+	respNoToken := doRequest(api, http.MethodGet, "/links", "", "")
+	respWrongToken := doRequest(api, http.MethodGet, "/links", "", "wrong")
+
+	// Then:
+	assert.Equal(t, http.StatusUnauthorized, respNoToken.Code)
+	assert.Equal(t, http.StatusUnauthorized, respWrongToken.Code)
+	assert.Contains(t, respNoToken.Body.String(), `"error"`)
+}
+
+func TestApiCreateAndGetLink(t *testing.T) {
+
+	// Given:
+	api, _ := newTestAPI(t)
+
+	// When:
+	resp := doRequest(api, http.MethodPost, "/links", `{"shortUrl":"yeti","targetUrl":"https://example.com/mic","description":"Mic","isPublic":true}`, testToken)
+
+	// Then:
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	var created LinkResponse
+	assert.Nil(t, json.Unmarshal(resp.Body.Bytes(), &created))
+	assert.Equal(t, "yeti", created.ShortUrl)
+	assert.Equal(t, "https://sho.rt/yeti", created.FullUrl)
+	assert.True(t, created.IsPublic)
+
+	// and:
+	resp = doRequest(api, http.MethodGet, "/links/1", "", testToken)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var fetched LinkResponse
+	assert.Nil(t, json.Unmarshal(resp.Body.Bytes(), &fetched))
+	assert.Equal(t, created, fetched)
+}
+
+func TestApiCreateValidation(t *testing.T) {
+
+	// Given:
+	api, _ := newTestAPI(t)
+
+	cases := map[string]string{
+		"missing target":  `{"shortUrl":"abc"}`,
+		"wrong target":    `{"shortUrl":"abc","targetUrl":"ftp://example.com"}`,
+		"loop":            `{"shortUrl":"abc","targetUrl":"https://sho.rt/yeti"}`,
+		"loop in rule":    `{"shortUrl":"abc","targetUrl":"https://example.com","rules":[{"os":["iOS"],"targetUrl":"https://sho.rt/x"}]}`,
+		"loop in variant": `{"shortUrl":"abc","targetUrl":"https://example.com","variants":[{"targetUrl":"https://example.com/a","weight":1},{"targetUrl":"https://sho.rt/x","weight":1}]}`,
+		"slash in suffix": `{"shortUrl":"a/b","targetUrl":"https://example.com"}`,
+		"reserved suffix": `{"shortUrl":"API","targetUrl":"https://example.com"}`,
+		"unknown field":   `{"shortUrl":"abc","targetUrl":"https://example.com","foo":1}`,
+		"broken json":     `{"shortUrl":`,
+	}
+
+	for name, body := range cases {
+
+		// When:
+		resp := doRequest(api, http.MethodPost, "/links", body, testToken)
+
+		// Then:
+		assert.Equal(t, http.StatusBadRequest, resp.Code, name)
+		assert.Contains(t, resp.Body.String(), `"error"`, name)
+	}
+}
+
+func TestApiCreateGeneratesMissingSuffix(t *testing.T) {
+
+	// Given:
+	api, database := newTestAPI(t)
+
+	// When:
+	respFirst := doRequest(api, http.MethodPost, "/links", `{"targetUrl":"https://example.com"}`, testToken)
+	respSecond := doRequest(api, http.MethodPost, "/links", `{"shortUrl":"","targetUrl":"https://example.com"}`, testToken)
+
+	// Then:
+	assert.Equal(t, http.StatusCreated, respFirst.Code)
+	assert.Equal(t, http.StatusCreated, respSecond.Code)
+
+	var first, second LinkResponse
+	assert.Nil(t, json.Unmarshal(respFirst.Body.Bytes(), &first))
+	assert.Nil(t, json.Unmarshal(respSecond.Body.Bytes(), &second))
+	assert.Len(t, first.ShortUrl, 6)
+	assert.Len(t, second.ShortUrl, 6)
+	assert.NotEqual(t, first.ShortUrl, second.ShortUrl, "the same target must not collide")
+
+	// and:
+	link, err := database.GetUrl(first.ShortUrl)
+	assert.Nil(t, err)
+	assert.Equal(t, "https://example.com", link.TargetUrl)
+}
+
+func TestApiCreateDuplicate(t *testing.T) {
+
+	// Given:
+	api, database := newTestAPI(t)
+	assert.Nil(t, database.SaveShortUrl("abc", "https://example.com", "", true))
+
+	// When:
+	resp := doRequest(api, http.MethodPost, "/links", `{"shortUrl":"abc","targetUrl":"https://example.org"}`, testToken)
+
+	// Then:
+	assert.Equal(t, http.StatusConflict, resp.Code)
+}
+
+func TestApiCreateDuplicateIgnoringCase(t *testing.T) {
+
+	// Given:
+	api, database := newTestAPI(t)
+	assert.Nil(t, database.SaveShortUrl("yeti", "https://example.com", "", true))
+
+	// When:
+	resp := doRequest(api, http.MethodPost, "/links", `{"shortUrl":"Yeti","targetUrl":"https://example.org"}`, testToken)
+
+	// Then:
+	assert.Equal(t, http.StatusConflict, resp.Code)
+}
+
+func TestApiListLinks(t *testing.T) {
+
+	// Given:
+	api, database := newTestAPI(t)
+	assert.Nil(t, database.SaveShortUrl("one", "https://example.com/1", "", true))
+	assert.Nil(t, database.SaveShortUrl("two", "https://example.com/2", "", false))
+
+	// When:
+	resp := doRequest(api, http.MethodGet, "/links", "", testToken)
+
+	// Then:
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var links []LinkResponse
+	assert.Nil(t, json.Unmarshal(resp.Body.Bytes(), &links))
+	assert.Len(t, links, 2)
+}
+
+func TestApiUpdateLink(t *testing.T) {
+
+	// Given:
+	api, database := newTestAPI(t)
+	assert.Nil(t, database.SaveShortUrl("abc", "https://example.com", "old", true))
+
+	// When:
+	resp := doRequest(api, http.MethodPatch, "/links/1", `{"targetUrl":" https://example.org ","isPublic":false}`, testToken)
+
+	// Then:
+	assert.Equal(t, http.StatusOK, resp.Code)
+	saved, err := database.GetUrl("abc")
+	assert.Nil(t, err)
+	assert.Equal(t, "https://example.org", saved.TargetUrl, "the target is saved trimmed, as it was checked")
+	assert.Equal(t, "old", saved.Description)
+	assert.False(t, saved.IsPublic)
+}
+
+func TestApiUpdateUnknownLink(t *testing.T) {
+
+	// Given:
+	api, _ := newTestAPI(t)
+
+	// When:
+	resp := doRequest(api, http.MethodPatch, "/links/42", `{"description":"new"}`, testToken)
+	respNotNumber := doRequest(api, http.MethodGet, "/links/abc", "", testToken)
+
+	// Then:
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+	assert.Equal(t, http.StatusBadRequest, respNotNumber.Code)
+}
+
+func TestApiDeleteLink(t *testing.T) {
+
+	// Given:
+	api, database := newTestAPI(t)
+	assert.Nil(t, database.SaveShortUrl("abc", "https://example.com", "", true))
+	saveTestView(t, database, "1.2.3.4", "abc", "GB", "London")
+
+	// When:
+	resp := doRequest(api, http.MethodDelete, "/links/1", "", testToken)
+
+	// Then:
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	_, err := database.GetUrl("abc")
+	assert.NotNil(t, err)
+
+	// and:
+	resp = doRequest(api, http.MethodDelete, "/links/1", "", testToken)
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+}
+
+func TestApiCreateLinkWithExpiry(t *testing.T) {
+
+	// Given:
+	api, _ := newTestAPI(t)
+
+	// When:
+	resp := doRequest(api, http.MethodPost, "/links", `{"shortUrl":"promo","targetUrl":"https://example.com","expiresAt":"2030-01-31T18:00:00Z","maxClicks":100}`, testToken)
+	respWrong := doRequest(api, http.MethodPost, "/links", `{"shortUrl":"promo2","targetUrl":"https://example.com","expiresAt":"tomorrow"}`, testToken)
+
+	// Then:
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	var created LinkResponse
+	assert.Nil(t, json.Unmarshal(resp.Body.Bytes(), &created))
+	assert.Equal(t, 100, created.MaxClicks)
+	assert.Equal(t, "2030-01-31T18:00:00Z", created.ExpiresAt.Format(time.RFC3339))
+
+	// and:
+	assert.Equal(t, http.StatusBadRequest, respWrong.Code)
+}
+
+func TestApiUpdateRules(t *testing.T) {
+
+	// Given:
+	api, database := newTestAPI(t)
+	assert.Nil(t, database.SaveShortUrl("abc", "https://example.com", "", true))
+
+	// When:
+	resp := doRequest(api, http.MethodPatch, "/links/1", `{"rules":[{"countries":["DE","AT"],"targetUrl":"https://example.de"}]}`, testToken)
+	respWrong := doRequest(api, http.MethodPatch, "/links/1", `{"rules":[{"countries":["DEU"],"targetUrl":"https://example.de"}]}`, testToken)
+
+	// Then:
+	assert.Equal(t, http.StatusOK, resp.Code)
+	saved, err := database.GetUrl("abc")
+	assert.Nil(t, err)
+	assert.Equal(t, []db.RedirectRule{{Countries: []string{"DE", "AT"}, TargetUrl: "https://example.de"}}, saved.Rules)
+
+	// and:
+	assert.Equal(t, http.StatusBadRequest, respWrong.Code)
+}
@@ -0,0 +1,76 @@
+package shortener
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/w32blaster/shortana/clientip"
+)
+
+type (
+	failedAttempts struct {
+		count   int
+		firstAt time.Time
+	}
+
+	// passwordGuard blocks an IP address for a while after too many wrong passwords.
+	// It works in addition to the common rate limiter, that doesn't distinguish
+	// wrong passwords from ordinary visits
+	passwordGuard struct {
+		mu          sync.Mutex
+		attempts    map[string]*failedAttempts
+		maxAttempts int
+		window      time.Duration
+	}
+)
+
+func newPasswordGuard(maxAttempts int, window time.Duration) *passwordGuard {
+	return &passwordGuard{
+		attempts:    make(map[string]*failedAttempts),
+		maxAttempts: maxAttempts,
+		window:      window,
+	}
+}
+
+// Attempt takes one password attempt of this IP address and returns FALSE if the address has used all its
+// attempts within the time window. The check and the increment are made under one lock, so concurrent
+// requests can't try more passwords than allowed. The correct password resets the attempts
+func (g *passwordGuard) Attempt(ip string, now time.Time) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	// forget old attempts, so the map doesn't grow forever
+	for key, attempt := range g.attempts {
+		if now.Sub(attempt.firstAt) >= g.window {
+			delete(g.attempts, key)
+		}
+	}
+
+	attempt, found := g.attempts[ip]
+	if !found {
+		g.attempts[ip] = &failedAttempts{count: 1, firstAt: now}
+		return true
+	}
+	if attempt.count >= g.maxAttempts {
+		return false
+	}
+	attempt.count++
+	return true
+}
+
+// Reset forgets wrong attempts after the correct password
+func (g *passwordGuard) Reset(ip string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.attempts, ip)
+}
+
+// clientIP returns the visitor address without the port. The RemoteAddr is already resolved
+// by the clientip.Resolver middleware, if the request came through a trusted proxy
+func clientIP(req *http.Request) string {
+	if ip := clientip.Normalize(req.RemoteAddr); len(ip) > 0 {
+		return ip
+	}
+	return req.RemoteAddr
+}
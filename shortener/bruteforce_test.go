@@ -0,0 +1,94 @@
+package shortener
+
+import (
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPasswordGuardBlocksAfterMaxAttempts(t *testing.T) {
+
+	// Given:
+	guard := newPasswordGuard(3, time.Minute)
+	now := time.Now()
+
+	// When:
+	first := guard.Attempt("1.2.3.4", now)
+	second := guard.Attempt("1.2.3.4", now)
+	third := guard.Attempt("1.2.3.4", now)
+
+	// Then:
+	assert.True(t, first)
+	assert.True(t, second)
+	assert.True(t, third)
+	assert.False(t, guard.Attempt("1.2.3.4", now))
+	assert.True(t, guard.Attempt("5.6.7.8", now))
+}
+
+func TestPasswordGuardAllowsOnlyMaxConcurrentAttempts(t *testing.T) {
+
+	// Given:
+	guard := newPasswordGuard(3, time.Minute)
+	now := time.Now()
+	var allowed int32
+	var wg sync.WaitGroup
+
+	// When:
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if guard.Attempt("1.2.3.4", now) {
+				atomic.AddInt32(&allowed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Then:
+	assert.Equal(t, int32(3), allowed)
+}
+
+func TestPasswordGuardUnblocksAfterWindow(t *testing.T) {
+
+	// Given:
+	guard := newPasswordGuard(1, time.Minute)
+	now := time.Now()
+	guard.Attempt("1.2.3.4", now)
+
+	// When:
+	allowedNow := guard.Attempt("1.2.3.4", now.Add(30*time.Second))
+	allowedLater := guard.Attempt("1.2.3.4", now.Add(time.Minute))
+
+	// Then:
+	assert.False(t, allowedNow)
+	assert.True(t, allowedLater)
+}
+
+func TestPasswordGuardReset(t *testing.T) {
+
+	// Given:
+	guard := newPasswordGuard(1, time.Minute)
+	now := time.Now()
+	guard.Attempt("1.2.3.4", now)
+
+	// When:
+	guard.Reset("1.2.3.4")
+
+	// Then:
+	assert.True(t, guard.Attempt("1.2.3.4", now))
+}
+
+func TestClientIPWithoutPort(t *testing.T) {
+
+	// Given:
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "1.2.3.4:5678"
+
+	// Then:
+	assert.Equal(t, "1.2.3.4", clientIP(req))
+}
@@ -0,0 +1,61 @@
+package shortener
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/go-chi/chi"
+)
+
+// passthroughTarget appends the rest of the requested path to the target path and merges the incoming
+// query parameters into the target query. If a parameter is present in both, then the target value wins,
+// because the link owner set it on purpose (for example, an affiliate ID), and the incoming one is dropped.
+// The extra path must be escaped, see requestExtraPath
+func passthroughTarget(targetUrl, extraPath string, incoming url.Values) string {
+	extraPath = strings.Trim(extraPath, "/")
+	if len(extraPath) == 0 && len(incoming) == 0 {
+		return targetUrl
+	}
+
+	target, err := url.Parse(targetUrl)
+	if err != nil {
+		log.Println("Can't parse the target URL " + targetUrl + " for passthrough, error: " + err.Error())
+		return targetUrl
+	}
+
+	if len(extraPath) > 0 {
+		// both forms are set, so the escaped characters like %2F are kept as they are
+		rawPath := strings.TrimSuffix(target.EscapedPath(), "/") + "/" + extraPath
+		path, err := url.PathUnescape(rawPath)
+		if err != nil {
+			log.Println("Can't append the path " + extraPath + " to the target URL " + targetUrl + ", error: " + err.Error())
+			return targetUrl
+		}
+		target.Path = path
+		target.RawPath = rawPath
+	}
+
+	if len(incoming) > 0 {
+		query := target.Query()
+		for key, values := range incoming {
+			if _, ok := query[key]; !ok {
+				query[key] = values
+			}
+		}
+		target.RawQuery = query.Encode()
+	}
+
+	return target.String()
+}
+
+// requestExtraPath returns the escaped rest of the requested path after the short URL. The router takes the path
+// from RawPath if the request has one, otherwise from the unescaped Path, so the latter is escaped again here
+func requestExtraPath(req *http.Request) string {
+	extraPath := chi.URLParam(req, "*")
+	if len(req.URL.RawPath) > 0 {
+		return extraPath
+	}
+	return (&url.URL{Path: extraPath}).EscapedPath()
+}
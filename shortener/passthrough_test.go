@@ -0,0 +1,69 @@
+package shortener
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/w32blaster/shortana/db"
+)
+
+func TestPassthroughTarget(t *testing.T) {
+
+	cases := []struct {
+		target    string
+		extraPath string
+		query     string
+		expected  string
+	}{
+		{"https://example.com", "", "", "https://example.com"},
+		{"https://example.com", "docs/intro", "", "https://example.com/docs/intro"},
+		{"https://example.com/blog/", "/2020/12/", "", "https://example.com/blog/2020/12"},
+		{"https://example.com/blog", "", "utm_source=x", "https://example.com/blog?utm_source=x"},
+		{"https://example.com/?ref=me", "page", "utm_source=x", "https://example.com/page?ref=me&utm_source=x"},
+		{"https://example.com/?ref=me", "", "ref=you&a=1", "https://example.com/?a=1&ref=me"}, // the target wins
+		{"https://example.com/#top", "page", "", "https://example.com/page#top"},
+		{"https://example.com/files", "a%2Fb/c%20d", "", "https://example.com/files/a%2Fb/c%20d"},
+		{"https://example.com/a%2Fb", "c", "", "https://example.com/a%2Fb/c"},
+	}
+
+	for _, c := range cases {
+
+		// Given:
+		query, _ := url.ParseQuery(c.query)
+
+		// When:
+		target := passthroughTarget(c.target, c.extraPath, query)
+
+		// Then:
+		assert.Equal(t, c.expected, target, c.target+" "+c.extraPath+" "+c.query)
+	}
+}
+
+func TestRedirectWithPassthrough(t *testing.T) {
+
+	// Given:
+	_, database := newTestAPI(t)
+	assert.Nil(t, database.SaveShortUrlObject(&db.ShortURL{ShortUrl: "docs", TargetUrl: "https://example.com/docs", Passthrough: true}))
+	assert.Nil(t, database.SaveShortUrlObject(&db.ShortURL{ShortUrl: "blog", TargetUrl: "https://example.com/blog"}))
+	redirector := newTestRedirector(database)
+
+	// When:
+	respPassthrough := doRequest(redirector, http.MethodGet, "/docs/api/v1?utm_source=x", "", "")
+	respQuery := doRequest(redirector, http.MethodGet, "/docs?utm_source=x", "", "")
+	respOrdinary := doRequest(redirector, http.MethodGet, "/blog/2020?utm_source=x", "", "")
+	respOrdinaryQuery := doRequest(redirector, http.MethodGet, "/blog?utm_source=x", "", "")
+	respUnknown := doRequest(redirector, http.MethodGet, "/unknown/page", "", "")
+	respEscaped := doRequest(redirector, http.MethodGet, "/docs/a%2Fb/c%20d", "", "")
+	respSpace := doRequest(redirector, http.MethodGet, "/docs/c%20d", "", "")
+
+	// Then:
+	assert.Equal(t, "https://example.com/docs/api/v1?utm_source=x", respPassthrough.Header().Get("Location"))
+	assert.Equal(t, "https://example.com/docs?utm_source=x", respQuery.Header().Get("Location"))
+	assert.Equal(t, http.StatusNotFound, respOrdinary.Code)
+	assert.Equal(t, "https://example.com/blog", respOrdinaryQuery.Header().Get("Location"))
+	assert.Equal(t, http.StatusNotFound, respUnknown.Code)
+	assert.Equal(t, "https://example.com/docs/a%2Fb/c%20d", respEscaped.Header().Get("Location"))
+	assert.Equal(t, "https://example.com/docs/c%20d", respSpace.Header().Get("Location"))
+}
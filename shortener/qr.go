@@ -0,0 +1,54 @@
+package shortener
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/w32blaster/shortana/db"
+	"github.com/w32blaster/shortana/qr"
+
+	"github.com/go-chi/chi"
+)
+
+// qrCodeHandler renders QR code of the full short URL, for example /qr/yeti?format=svg&size=512&level=H.
+// All the query parameters are optional, please refer to qr.Options for the defaults. The code always contains
+// the suffix as it is saved, even if it was requested in another case
+func qrCodeHandler(database *db.Database, cfg Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		link, err := database.FindUrl(chi.URLParam(r, "shortUrl"), cfg.SuffixPolicy.IgnoreCase)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		shortUrl := link.ShortUrl
+
+		size := 0
+		if value := r.URL.Query().Get("size"); len(value) > 0 {
+			if size, err = strconv.Atoi(value); err != nil {
+				http.Error(w, "size must be a number", http.StatusBadRequest)
+				return
+			}
+		}
+
+		opts, err := qr.Options{
+			Format: r.URL.Query().Get("format"),
+			Size:   size,
+			Level:  r.URL.Query().Get("level"),
+		}.Normalize()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		image, err := qr.Render(cfg.Hostname+"/"+shortUrl, opts)
+		if err != nil {
+			log.Println("Can't render QR code for " + shortUrl + ", error: " + err.Error())
+			http.Error(w, "Can't render QR code", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", opts.ContentType())
+		w.Write(image)
+	}
+}
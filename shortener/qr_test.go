@@ -0,0 +1,41 @@
+package shortener
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQRCode(t *testing.T) {
+
+	// Given:
+	_, database := newTestAPI(t)
+	assert.Nil(t, database.SaveShortUrl("yeti", "https://example.com", "", true))
+	r := chi.NewRouter()
+	r.Get("/qr/{shortUrl}", qrCodeHandler(database, testConfig))
+
+	// When:
+	respPNG := doRequest(r, http.MethodGet, "/qr/yeti", "", "")
+	respSVG := doRequest(r, http.MethodGet, "/qr/yeti?format=svg&size=512&level=H", "", "")
+	respWrongSize := doRequest(r, http.MethodGet, "/qr/yeti?size=big", "", "")
+	respWrongLevel := doRequest(r, http.MethodGet, "/qr/yeti?level=Z", "", "")
+	respUnknown := doRequest(r, http.MethodGet, "/qr/unknown", "", "")
+
+	// Then:
+	assert.Equal(t, http.StatusOK, respPNG.Code)
+	assert.Equal(t, "image/png", respPNG.Header().Get("Content-Type"))
+	assert.True(t, strings.HasPrefix(respPNG.Body.String(), "\x89PNG"))
+
+	// and:
+	assert.Equal(t, http.StatusOK, respSVG.Code)
+	assert.Equal(t, "image/svg+xml", respSVG.Header().Get("Content-Type"))
+	assert.Contains(t, respSVG.Body.String(), `width="512"`)
+
+	// and:
+	assert.Equal(t, http.StatusBadRequest, respWrongSize.Code)
+	assert.Equal(t, http.StatusBadRequest, respWrongLevel.Code)
+	assert.Equal(t, http.StatusNotFound, respUnknown.Code)
+}
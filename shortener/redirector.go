@@ -0,0 +1,243 @@
+package shortener
+
+import (
+	"errors"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/w32blaster/shortana/db"
+	"github.com/w32blaster/shortana/geoip"
+	"github.com/w32blaster/shortana/stats"
+	"github.com/w32blaster/shortana/useragent"
+
+	"github.com/go-chi/chi"
+)
+
+// redirector handles visits of short URLs
+type redirector struct {
+	db    *db.Database
+	stats *stats.Statistics
+	geoIP *geoip.GeoIP
+	cfg   Config
+	guard *passwordGuard
+}
+
+func newRedirector(database *db.Database, statistics *stats.Statistics, geoIP *geoip.GeoIP, cfg Config) *redirector {
+	return &redirector{
+		db:    database,
+		stats: statistics,
+		geoIP: geoIP,
+		cfg:   cfg,
+		guard: newPasswordGuard(5, 15*time.Minute),
+	}
+}
+
+// mount registers routes of short URLs. The wildcard routes serve links with the passthrough
+// mode, so the rest of the path can be appended to the target
+func (rd *redirector) mount(r chi.Router) {
+	r.Get("/{shortUrl}", rd.processRequest)
+	r.Post("/{shortUrl}", rd.processPassword)
+	r.Get("/{shortUrl}/*", rd.processRequest)
+	r.Post("/{shortUrl}/*", rd.processPassword)
+}
+
+func (rd *redirector) processRequest(w http.ResponseWriter, req *http.Request) {
+	url, ok := rd.findShortUrl(w, req)
+	if !ok {
+		return
+	}
+
+	if url.IsProtected() {
+		printPasswordForm(w, req, http.StatusOK, rd.cfg.Hostname, url.ShortUrl, "")
+		return
+	}
+
+	rd.redirect(w, req, url, false)
+}
+
+// processPassword handles the password form submitted for a protected link
+func (rd *redirector) processPassword(w http.ResponseWriter, req *http.Request) {
+	url, ok := rd.findShortUrl(w, req)
+	if !ok {
+		return
+	}
+
+	if url.IsProtected() {
+		ip := clientIP(req)
+		if !rd.guard.Attempt(ip, time.Now()) {
+			printPasswordForm(w, req, http.StatusTooManyRequests, rd.cfg.Hostname, url.ShortUrl, "Too many wrong attempts, please try again later")
+			return
+		}
+
+		if !url.CheckPassword(req.PostFormValue("password")) {
+			printPasswordForm(w, req, http.StatusForbidden, rd.cfg.Hostname, url.ShortUrl, "Wrong password")
+			return
+		}
+		rd.guard.Reset(ip)
+	}
+
+	rd.redirect(w, req, url, true)
+}
+
+// findShortUrl returns the requested link if it can be followed, otherwise prints a page explaining why not
+func (rd *redirector) findShortUrl(w http.ResponseWriter, req *http.Request) (*db.ShortURL, bool) {
+	shortUrl := chi.URLParam(req, "shortUrl")
+	if len(shortUrl) == 0 {
+		w.Write([]byte("Short URL is not provided"))
+		return nil, false
+	}
+
+	// the extra path is served only for passthrough links, others behave as if there was no such route
+	hasExtraPath := strings.HasPrefix(req.URL.Path, "/"+shortUrl+"/")
+
+	// a link without the target can be left by older versions of the bot, it is the same as unknown link
+	url, err := rd.db.FindUrl(shortUrl, rd.cfg.SuffixPolicy.IgnoreCase)
+	if err == nil && len(url.TargetUrl) == 0 {
+		err = errors.New("link " + shortUrl + " has no target URL")
+	}
+	if err != nil {
+		if hasExtraPath {
+			http.NotFound(w, req)
+		} else {
+			printIndex(rd.db, w, rd.cfg.Hostname, shortUrl)
+		}
+		return nil, false
+	}
+
+	if hasExtraPath && !url.Passthrough {
+		http.NotFound(w, req)
+		return nil, false
+	}
+
+	if url.IsExpired(time.Now()) {
+		printGone(w, rd.cfg.Hostname, shortUrl)
+		return nil, false
+	}
+
+	return url, true
+}
+
+// redirect sends visitor to the target URL and saves the statistics. The redirect after
+// the password form is always "See Other", so browser doesn't cache it.
+// Every click on a link with the click budget is a synchronous write to the database, so
+// crawlers and link previews are not counted, otherwise they would use up the budget
+func (rd *redirector) redirect(w http.ResponseWriter, req *http.Request, url *db.ShortURL, isAfterForm bool) {
+	if url.MaxClicks > 0 && !rd.stats.IsBot(req) {
+		if err := rd.db.RegisterClick(url.ID); err == db.ErrLinkExpired {
+			printGone(w, rd.cfg.Hostname, url.ShortUrl)
+			return
+		} else if err != nil {
+			log.Println("Can't register a click for " + url.ShortUrl + ", error: " + err.Error())
+		}
+	}
+
+	targetUrl, matchedRule, variant := resolveTarget(url, rd.describeVisitor(req, url))
+	if url.Passthrough {
+		targetUrl = passthroughTarget(targetUrl, requestExtraPath(req), req.URL.Query())
+	}
+	targetUrl = tagTarget(targetUrl, url.UTM.WithDefaults(rd.cfg.DefaultUTM))
+
+	rd.stats.ProcessRequest(req, url.ShortUrl, matchedRule, variant)
+
+	redirectType := url.RedirectType
+	if redirectType == 0 {
+		redirectType = rd.cfg.DefaultRedirectType
+	}
+
+	if redirectType == db.RedirectInterstitial {
+		data := InterstitialPageData{
+			Hostname:  rd.cfg.Hostname,
+			ShortUrl:  url.ShortUrl,
+			TargetUrl: targetUrl,
+		}
+		renderPage(w, http.StatusOK, "interstitial.html", data)
+		return
+	}
+
+	if isAfterForm {
+		redirectType = http.StatusSeeOther
+	}
+
+	w.Header().Add("Location", targetUrl)
+	w.WriteHeader(redirectType)
+}
+
+// describeVisitor collects data about the visitor needed for the link rules
+func (rd *redirector) describeVisitor(req *http.Request, url *db.ShortURL) db.Visitor {
+	visitor := db.Visitor{
+		IpAddress: clientIP(req),
+		UserAgent: req.Header.Get("User-Agent"),
+	}
+	if len(url.Rules) == 0 {
+		return visitor
+	}
+
+	// the GeoIP lookup is the most expensive part, so make it only if some rule needs it
+	if db.NeedsCountry(url.Rules) {
+		visitor.CountryCode = rd.visitorCountry(req)
+	}
+
+	ua := useragent.Parse(visitor.UserAgent)
+	visitor.OS = ua.OS
+	visitor.Device = ua.Device
+	return visitor
+}
+
+// visitorCountry returns ISO code of the visitor's country or empty string if it is unknown
+func (rd *redirector) visitorCountry(req *http.Request) string {
+	if rd.geoIP == nil || !rd.geoIP.IsReady() {
+		return ""
+	}
+
+	countryCode, _, _, err := rd.geoIP.GetGeoStatsForTheIP(clientIP(req))
+	if err != nil {
+		log.Println("Can't get GeoIP data for redirect rules. Reason: " + err.Error())
+		return ""
+	}
+	return countryCode
+}
+
+// resolveTarget chooses the target URL using the link rules, the first matching rule wins. If none of rules matched,
+// then the visitor gets one of the A/B split variants, or the default target if there is no split. It returns the number
+// of the matched rule and the number of the variant, both start from 1 and zero means "not used"
+func resolveTarget(url *db.ShortURL, visitor db.Visitor) (string, int, int) {
+	for i, rule := range url.Rules {
+		if rule.Matches(visitor) {
+			return rule.TargetUrl, i + 1, 0
+		}
+	}
+
+	if len(url.Variants) > 0 {
+		variant := chooseVariant(url.Variants, url.ShortUrl+"|"+visitor.IpAddress+"|"+visitor.UserAgent)
+		return url.Variants[variant].TargetUrl, 0, variant + 1
+	}
+
+	return url.TargetUrl, 0, 0
+}
+
+// chooseVariant picks the variant index by weight. The choice depends only on the visitor key, so the
+// same visitor always gets the same variant, as long as the variants are not changed
+func chooseVariant(variants []db.Variant, visitorKey string) int {
+	totalWeight := 0
+	for _, variant := range variants {
+		totalWeight += variant.Weight
+	}
+	if totalWeight <= 0 {
+		return 0
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(visitorKey))
+	point := int(hash.Sum32() % uint32(totalWeight))
+
+	for i, variant := range variants {
+		if point < variant.Weight {
+			return i
+		}
+		point -= variant.Weight
+	}
+	return len(variants) - 1
+}
@@ -0,0 +1,182 @@
+package shortener
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/w32blaster/shortana/db"
+	"github.com/w32blaster/shortana/useragent"
+)
+
+func TestResolveTargetByCountry(t *testing.T) {
+
+	// Given:
+	url := &db.ShortURL{
+		TargetUrl: "https://example.com",
+		Rules: []db.RedirectRule{
+			{Countries: []string{"DE", "AT", "CH"}, TargetUrl: "https://example.de"},
+			{Countries: []string{"FR", "CH"}, TargetUrl: "https://example.fr"},
+		},
+	}
+
+	cases := []struct {
+		country        string
+		expectedTarget string
+		expectedRule   int
+	}{
+		{"DE", "https://example.de", 1},
+		{"CH", "https://example.de", 1}, // the first matching rule wins
+		{"FR", "https://example.fr", 2},
+		{"GB", "https://example.com", 0},
+		{"", "https://example.com", 0}, // unknown country
+	}
+
+	for _, c := range cases {
+
+		// When:
+		target, rule, _ := resolveTarget(url, db.Visitor{CountryCode: c.country})
+
+		// Then:
+		assert.Equal(t, c.expectedTarget, target, c.country)
+		assert.Equal(t, c.expectedRule, rule, c.country)
+	}
+}
+
+func TestResolveTargetWithoutRules(t *testing.T) {
+
+	// When:
+	target, rule, variant := resolveTarget(&db.ShortURL{TargetUrl: "https://example.com"}, db.Visitor{CountryCode: "DE"})
+
+	// Then:
+	assert.Equal(t, "https://example.com", target)
+	assert.Equal(t, 0, rule)
+	assert.Equal(t, 0, variant)
+}
+
+func TestResolveTargetByDeviceAndOS(t *testing.T) {
+
+	// Given:
+	url := &db.ShortURL{
+		TargetUrl: "https://example.com",
+		Rules: []db.RedirectRule{
+			{OS: []string{useragent.OSiOS}, TargetUrl: "https://apps.apple.com/app"},
+			{OS: []string{useragent.OSAndroid}, Devices: []string{useragent.DeviceMobile}, TargetUrl: "https://play.google.com/app"},
+			{Countries: []string{"DE"}, Devices: []string{useragent.DeviceDesktop}, TargetUrl: "https://example.de"},
+		},
+	}
+
+	cases := []struct {
+		visitor        db.Visitor
+		expectedTarget string
+	}{
+		{db.Visitor{OS: useragent.OSiOS, Device: useragent.DeviceTablet}, "https://apps.apple.com/app"},
+		{db.Visitor{OS: useragent.OSAndroid, Device: useragent.DeviceMobile}, "https://play.google.com/app"},
+		{db.Visitor{OS: useragent.OSAndroid, Device: useragent.DeviceTablet}, "https://example.com"},
+		{db.Visitor{CountryCode: "DE", OS: useragent.OSWindows, Device: useragent.DeviceDesktop}, "https://example.de"},
+		{db.Visitor{CountryCode: "DE", OS: useragent.OSAndroid, Device: useragent.DeviceTablet}, "https://example.com"},
+	}
+
+	for _, c := range cases {
+
+		// When:
+		target, _, _ := resolveTarget(url, c.visitor)
+
+		// Then:
+		assert.Equal(t, c.expectedTarget, target, c.visitor)
+	}
+}
+
+func TestResolveTargetSplitIsSticky(t *testing.T) {
+
+	// Given:
+	url := &db.ShortURL{
+		ShortUrl:  "ab",
+		TargetUrl: "https://example.com",
+		Variants: []db.Variant{
+			{TargetUrl: "https://example.com/a", Weight: 50},
+			{TargetUrl: "https://example.com/b", Weight: 50},
+		},
+	}
+	visitor := db.Visitor{IpAddress: "1.2.3.4", UserAgent: "Mozilla/5.0"}
+
+	// When:
+	target, rule, variant := resolveTarget(url, visitor)
+
+	// Then:
+	assert.Equal(t, 0, rule)
+	assert.Equal(t, url.Variants[variant-1].TargetUrl, target)
+	for i := 0; i < 10; i++ {
+		sameTarget, _, sameVariant := resolveTarget(url, visitor)
+		assert.Equal(t, target, sameTarget)
+		assert.Equal(t, variant, sameVariant)
+	}
+}
+
+func TestResolveTargetRulesGoBeforeSplit(t *testing.T) {
+
+	// Given:
+	url := &db.ShortURL{
+		TargetUrl: "https://example.com",
+		Rules: []db.RedirectRule{
+			{Countries: []string{"DE"}, TargetUrl: "https://example.de"},
+		},
+		Variants: []db.Variant{
+			{TargetUrl: "https://example.com/a", Weight: 1},
+			{TargetUrl: "https://example.com/b", Weight: 1},
+		},
+	}
+
+	// When:
+	target, rule, variant := resolveTarget(url, db.Visitor{CountryCode: "DE", IpAddress: "1.2.3.4"})
+
+	// Then:
+	assert.Equal(t, "https://example.de", target)
+	assert.Equal(t, 1, rule)
+	assert.Equal(t, 0, variant)
+}
+
+func TestChooseVariantFollowsWeights(t *testing.T) {
+
+	// Given:
+	variants := []db.Variant{
+		{TargetUrl: "https://example.com/a", Weight: 80},
+		{TargetUrl: "https://example.com/b", Weight: 20},
+		{TargetUrl: "https://example.com/c", Weight: 0},
+	}
+	counts := make([]int, len(variants))
+
+	// When:
+	for i := 0; i < 10000; i++ {
+		counts[chooseVariant(variants, "visitor"+strconv.Itoa(i))]++
+	}
+
+	// Then:
+	assert.InDelta(t, 8000, counts[0], 300)
+	assert.InDelta(t, 2000, counts[1], 300)
+	assert.Equal(t, 0, counts[2])
+}
+
+func TestRedirectByUserAgent(t *testing.T) {
+
+	// Given:
+	_, database := newTestAPI(t)
+	assert.Nil(t, database.SaveShortUrlObject(&db.ShortURL{
+		ShortUrl:  "app",
+		TargetUrl: "https://example.com",
+		Rules: []db.RedirectRule{
+			{OS: []string{useragent.OSiOS}, TargetUrl: "https://apps.apple.com/app"},
+		},
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/app", nil)
+	req.Header.Set("User-Agent", "Mozilla/5.0 (iPhone; CPU iPhone OS 14_2 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/14.0.1 Mobile/15E148 Safari/604.1")
+
+	// When:
+	resp := httptest.NewRecorder()
+	newTestRedirector(database).ServeHTTP(resp, req)
+
+	// Then:
+	assert.Equal(t, "https://apps.apple.com/app", resp.Header().Get("Location"))
+}
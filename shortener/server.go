@@ -4,10 +4,15 @@ import (
 	"html/template"
 	"log"
 	"net/http"
+	"sync"
 	"time"
 
+	"github.com/w32blaster/shortana/clientip"
 	"github.com/w32blaster/shortana/db"
+	"github.com/w32blaster/shortana/geoip"
 	"github.com/w32blaster/shortana/stats"
+	"github.com/w32blaster/shortana/suffix"
+	"github.com/w32blaster/shortana/urlcheck"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
@@ -15,42 +20,46 @@ import (
 )
 
 var (
-	tmplIndex = template.Must(template.ParseFiles("templates/index.html"))
+	pages     *template.Template // see loadPages
+	pagesOnce sync.Once
 )
 
 type (
+	// Config holds the server settings
+	Config struct {
+		Hostname            string
+		ApiToken            string            // the REST API is disabled if the token is empty
+		DefaultRedirectType int               // used for links without their own RedirectType
+		DefaultUTM          db.UTM            // tags for links that don't set their own
+		Suffixes            suffix.Generator  // makes up the short URL when the API request has none
+		SuffixPolicy        suffix.Policy     // checks suffixes given in the API and how they are matched on visit
+		Targets             urlcheck.Checker  // checks target URLs given in the API
+		Proxies             clientip.Resolver // finds the visitor address behind trusted proxies
+	}
+
 	AllLinksData struct {
 		Links    []db.ShortURL
 		Error    error
 		WrongUrl string
 		Hostname string
 	}
-)
-
-func makeRequestProcessor(db *db.Database, stats *stats.Statistics, hostname string) func(http.ResponseWriter, *http.Request) {
-	return func(w http.ResponseWriter, req *http.Request) {
-		shortUrl := chi.URLParam(req, "shortUrl")
-		if len(shortUrl) == 0 {
-			w.Write([]byte("Short URL is not provided"))
-			return
-		}
-
-		url, err := db.GetUrl(shortUrl)
-		if err != nil {
-			printIndex(db, w, hostname, shortUrl)
-			return
-		}
 
-		go stats.ProcessRequest(req, shortUrl)
+	PasswordPageData struct {
+		Hostname   string
+		ShortUrl   string
+		FormAction string // the requested path with the query, so passthrough links keep them after the form
+		Error      string
+	}
 
-		w.Header().Add("Location", url.TargetUrl)
-		w.WriteHeader(http.StatusMovedPermanently)
+	InterstitialPageData struct {
+		Hostname  string
+		ShortUrl  string
+		TargetUrl string
 	}
-}
+)
 
 // printIndex prints page with available public (!) links in case if short URL was wrong
 func printIndex(db *db.Database, w http.ResponseWriter, hostname, wrongUrl string) {
-	w.Header().Add("Content-Type", "text/html; charset=utf-8")
 	links, err := db.GetAll()
 	data := AllLinksData{
 		Links:    links,
@@ -59,26 +68,85 @@ func printIndex(db *db.Database, w http.ResponseWriter, hostname, wrongUrl strin
 		WrongUrl: wrongUrl,
 	}
 
-	if err = tmplIndex.Execute(w, data); err != nil {
+	renderPage(w, http.StatusOK, "index.html", data)
+}
+
+// printGone prints page for a link that is expired or has no clicks left
+func printGone(w http.ResponseWriter, hostname, shortUrl string) {
+	data := AllLinksData{
+		Hostname: hostname,
+		WrongUrl: shortUrl,
+	}
+	renderPage(w, http.StatusGone, "gone.html", data)
+}
+
+// printPasswordForm asks visitor to enter the password for a protected link
+func printPasswordForm(w http.ResponseWriter, req *http.Request, status int, hostname, shortUrl, errorMessage string) {
+	data := PasswordPageData{
+		Hostname:   hostname,
+		ShortUrl:   shortUrl,
+		FormAction: req.URL.RequestURI(),
+		Error:      errorMessage,
+	}
+	renderPage(w, status, "password.html", data)
+}
+
+// loadPages parses all the HTML pages from the "templates" folder only once, so they are
+// not read from disk on every request. It panics if the pages can't be parsed
+func loadPages() *template.Template {
+	pagesOnce.Do(func() {
+		pages = template.Must(template.ParseGlob("templates/*.html"))
+	})
+	return pages
+}
+
+// renderPage renders HTML page from the "templates" folder
+func renderPage(w http.ResponseWriter, status int, templateFileName string, data interface{}) {
+	w.Header().Add("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := loadPages().ExecuteTemplate(w, templateFileName, data); err != nil {
 		log.Println("Error while rendering page: " + err.Error())
 	}
 }
 
-// StartServer starts the server that handles all the requests
-func StartServer(db *db.Database, stats *stats.Statistics, host string) {
+// keyByClientIP limits requests per visitor. Unlike httprate.KeyByIP it doesn't read the proxy
+// headers itself, they are already checked by the clientip.Resolver
+func keyByClientIP(req *http.Request) (string, error) {
+	return clientIP(req), nil
+}
+
+// StartServer starts the server that handles all the requests. It listens in the background,
+// the returned server is needed only to shut it down
+func StartServer(db *db.Database, stats *stats.Statistics, geoIP *geoip.GeoIP, cfg Config) *http.Server {
+
+	// a missing page should stop the start, not a visitor's request
+	loadPages()
 
 	r := chi.NewRouter()
 
-	r.Use(middleware.RealIP)
+	r.Use(cfg.Proxies.Middleware)
 	r.Use(middleware.Logger)
 	r.Use(middleware.NoCache)
 	r.Use(middleware.Recoverer)
-	r.Use(httprate.LimitByIP(100, 1*time.Minute))
+	r.Use(httprate.Limit(100, 1*time.Minute, keyByClientIP))
+
+	if len(cfg.ApiToken) > 0 {
+		r.Mount("/api/v1", apiRouter(db, stats, cfg))
+	} else {
+		log.Println("API_TOKEN is not set, so the REST API is disabled")
+	}
 
 	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
-		printIndex(db, w, host, "")
+		printIndex(db, w, cfg.Hostname, "")
 	})
-	r.Get("/{shortUrl}", makeRequestProcessor(db, stats, host))
+	r.Get("/qr/{shortUrl}", qrCodeHandler(db, cfg))
+	newRedirector(db, stats, geoIP, cfg).mount(r)
 
-	http.ListenAndServe(":3000", r)
+	server := &http.Server{Addr: ":3000", Handler: r}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Println("Web server failed, error " + err.Error())
+		}
+	}()
+	return server
 }
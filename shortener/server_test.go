@@ -0,0 +1,293 @@
+package shortener
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/stretchr/testify/assert"
+	"github.com/w32blaster/shortana/db"
+	"github.com/w32blaster/shortana/stats"
+	"github.com/w32blaster/shortana/suffix"
+)
+
+// templates are loaded from the "templates" folder relative to the project root
+func TestMain(m *testing.M) {
+	if err := os.Chdir(".."); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+var testConfig = Config{
+	Hostname:            "https://sho.rt",
+	DefaultRedirectType: http.StatusFound,
+}
+
+func newTestRedirector(database *db.Database) http.Handler {
+	return newTestRedirectorWithConfig(database, testConfig)
+}
+
+func newTestRedirectorWithConfig(database *db.Database, cfg Config) http.Handler {
+	rd := newRedirector(database, stats.New(database, nil), nil, cfg)
+	rd.guard = newPasswordGuard(2, time.Minute)
+
+	r := chi.NewRouter()
+	rd.mount(r)
+	return r
+}
+
+func saveProtectedLink(t *testing.T, database *db.Database) {
+	hash, err := db.HashPassword("s3cret")
+	assert.Nil(t, err)
+	assert.Nil(t, database.SaveShortUrlObject(&db.ShortURL{
+		ShortUrl:     "docs",
+		TargetUrl:    "https://example.com/internal",
+		PasswordHash: hash,
+	}))
+}
+
+func postPassword(handler http.Handler, password string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/docs", strings.NewReader(url.Values{"password": {password}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestExpiredLinkIsGone(t *testing.T) {
+
+	// Given:
+	_, database := newTestAPI(t)
+	assert.Nil(t, database.SaveShortUrlObject(&db.ShortURL{
+		ShortUrl:  "old",
+		TargetUrl: "https://example.com",
+		ExpiresAt: time.Now().Add(-time.Hour),
+	}))
+
+	// When:
+	resp := doRequest(newTestRedirector(database), http.MethodGet, "/old", "", "")
+
+	// Then:
+	assert.Equal(t, http.StatusGone, resp.Code)
+	assert.Empty(t, resp.Header().Get("Location"))
+}
+
+func TestLinkIsGoneWhenClicksAreExhausted(t *testing.T) {
+
+	// Given:
+	_, database := newTestAPI(t)
+	assert.Nil(t, database.SaveShortUrlObject(&db.ShortURL{
+		ShortUrl:  "once",
+		TargetUrl: "https://example.com",
+		MaxClicks: 1,
+		Clicks:    1,
+	}))
+
+	// When:
+	resp := doRequest(newTestRedirector(database), http.MethodGet, "/once", "", "")
+
+	// Then:
+	assert.Equal(t, http.StatusGone, resp.Code)
+}
+
+func TestRegisterClickCountsBudget(t *testing.T) {
+
+	// Given:
+	_, database := newTestAPI(t)
+	link := db.ShortURL{ShortUrl: "twice", TargetUrl: "https://example.com", MaxClicks: 2}
+	assert.Nil(t, database.SaveShortUrlObject(&link))
+
+	// When:
+	errFirst := database.RegisterClick(link.ID)
+	errSecond := database.RegisterClick(link.ID)
+	errThird := database.RegisterClick(link.ID)
+
+	// Then:
+	assert.Nil(t, errFirst)
+	assert.Nil(t, errSecond)
+	assert.Equal(t, db.ErrLinkExpired, errThird)
+}
+
+func TestUnknownLinkPrintsIndex(t *testing.T) {
+
+	// Given:
+	_, database := newTestAPI(t)
+
+	// When:
+	resp := httptest.NewRecorder()
+	newTestRedirector(database).ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/nope", nil))
+
+	// Then:
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Contains(t, resp.Body.String(), "can't find the url")
+}
+
+func TestLinkWithoutTargetPrintsIndex(t *testing.T) {
+
+	// Given:
+	_, database := newTestAPI(t)
+	assert.Nil(t, database.SaveShortUrlObject(&db.ShortURL{ShortUrl: "half"}))
+
+	// When:
+	resp := doRequest(newTestRedirector(database), http.MethodGet, "/half", "", "")
+
+	// Then:
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Empty(t, resp.Header().Get("Location"))
+	assert.Contains(t, resp.Body.String(), "can't find the url")
+}
+
+func TestProtectedLinkAsksForPassword(t *testing.T) {
+
+	// Given:
+	_, database := newTestAPI(t)
+	saveProtectedLink(t, database)
+
+	// When:
+	resp := doRequest(newTestRedirector(database), http.MethodGet, "/docs", "", "")
+
+	// Then:
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Empty(t, resp.Header().Get("Location"))
+	assert.Contains(t, resp.Body.String(), `type="password"`)
+}
+
+func TestProtectedLinkBlocksBruteForce(t *testing.T) {
+
+	// Given:
+	_, database := newTestAPI(t)
+	saveProtectedLink(t, database)
+	handler := newTestRedirector(database)
+
+	// When:
+	respFirst := postPassword(handler, "wrong1")
+	respSecond := postPassword(handler, "wrong2")
+	respCorrectButBlocked := postPassword(handler, "s3cret")
+
+	// Then:
+	assert.Equal(t, http.StatusForbidden, respFirst.Code)
+	assert.Contains(t, respFirst.Body.String(), "Wrong password")
+	assert.Equal(t, http.StatusForbidden, respSecond.Code)
+	assert.Equal(t, http.StatusTooManyRequests, respCorrectButBlocked.Code)
+	assert.Empty(t, respCorrectButBlocked.Header().Get("Location"))
+}
+
+func TestRedirectTypes(t *testing.T) {
+
+	// Given:
+	_, database := newTestAPI(t)
+	handler := newTestRedirector(database)
+
+	cases := map[int]int{
+		0:   http.StatusFound, // the default from the config
+		301: http.StatusMovedPermanently,
+		307: http.StatusTemporaryRedirect,
+		308: http.StatusPermanentRedirect,
+	}
+
+	for redirectType, expectedStatus := range cases {
+		suffix := "link" + strconv.Itoa(redirectType)
+		assert.Nil(t, database.SaveShortUrlObject(&db.ShortURL{
+			ShortUrl:     suffix,
+			TargetUrl:    "https://example.com",
+			RedirectType: redirectType,
+		}))
+
+		// When:
+		resp := doRequest(handler, http.MethodGet, "/"+suffix, "", "")
+
+		// Then:
+		assert.Equal(t, expectedStatus, resp.Code, suffix)
+		assert.Equal(t, "https://example.com", resp.Header().Get("Location"), suffix)
+	}
+}
+
+func TestRedirectWithInterstitialPage(t *testing.T) {
+
+	// Given:
+	_, database := newTestAPI(t)
+	assert.Nil(t, database.SaveShortUrlObject(&db.ShortURL{
+		ShortUrl:     "page",
+		TargetUrl:    "https://example.com/?a=1&b=2",
+		RedirectType: db.RedirectInterstitial,
+	}))
+
+	// When:
+	resp := doRequest(newTestRedirector(database), http.MethodGet, "/page", "", "")
+
+	// Then:
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Empty(t, resp.Header().Get("Location"))
+	assert.Contains(t, resp.Body.String(), `http-equiv="refresh"`)
+	assert.Contains(t, resp.Body.String(), `href="https://example.com/?a=1&amp;b=2"`)
+}
+
+func TestProtectedLinkRedirectsWithCorrectPassword(t *testing.T) {
+
+	// Given:
+	_, database := newTestAPI(t)
+	saveProtectedLink(t, database)
+
+	// When:
+	resp := postPassword(newTestRedirector(database), "s3cret")
+
+	// Then:
+	assert.Equal(t, http.StatusSeeOther, resp.Code)
+	assert.Equal(t, "https://example.com/internal", resp.Header().Get("Location"))
+}
+
+func TestLinkIsFoundIgnoringCase(t *testing.T) {
+
+	// Given:
+	_, database := newTestAPI(t)
+	assert.Nil(t, database.SaveShortUrl("yeti", "https://example.com/mic", "", true))
+	cfg := testConfig
+	cfg.SuffixPolicy = suffix.NewPolicy(nil, true)
+
+	// When:
+	respIgnoringCase := doRequest(newTestRedirectorWithConfig(database, cfg), http.MethodGet, "/Yeti", "", "")
+	respCaseSensitive := doRequest(newTestRedirector(database), http.MethodGet, "/Yeti", "", "")
+
+	// Then:
+	assert.Equal(t, http.StatusFound, respIgnoringCase.Code)
+	assert.Equal(t, "https://example.com/mic", respIgnoringCase.Header().Get("Location"))
+	assert.Empty(t, respCaseSensitive.Header().Get("Location"))
+}
+
+func TestBotsDoNotUseUpClicks(t *testing.T) {
+
+	// Given:
+	_, database := newTestAPI(t)
+	link := db.ShortURL{ShortUrl: "once", TargetUrl: "https://example.com", MaxClicks: 1}
+	assert.Nil(t, database.SaveShortUrlObject(&link))
+	handler := newTestRedirector(database)
+
+	// When: link preview of a messenger
+	preview := httptest.NewRequest(http.MethodGet, "/once", nil)
+	preview.Header.Set("User-Agent", "TelegramBot (like TwitterBot)")
+	previewResp := httptest.NewRecorder()
+	handler.ServeHTTP(previewResp, preview)
+
+	// Then:
+	assert.Equal(t, http.StatusFound, previewResp.Code)
+	saved, err := database.GetUrlByID(link.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, saved.Clicks)
+
+	// and: a real visitor uses the click
+	visit := httptest.NewRequest(http.MethodGet, "/once", nil)
+	visit.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) Gecko/20100101 Firefox/84.0")
+	visitResp := httptest.NewRecorder()
+	handler.ServeHTTP(visitResp, visit)
+	assert.Equal(t, http.StatusFound, visitResp.Code)
+	saved, err = database.GetUrlByID(link.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, saved.Clicks)
+}
@@ -0,0 +1,41 @@
+package shortener
+
+import (
+	"log"
+	"net/url"
+
+	"github.com/w32blaster/shortana/db"
+)
+
+// tagTarget adds UTM tags to the target URL. A tag that is already present in the target is
+// never overwritten, so the tags set by hand (or passed through from the visitor) always win
+func tagTarget(targetUrl string, tags db.UTM) string {
+	if tags.IsEmpty() {
+		return targetUrl
+	}
+
+	target, err := url.Parse(targetUrl)
+	if err != nil {
+		log.Println("Can't parse the target URL " + targetUrl + " for UTM tags, error: " + err.Error())
+		return targetUrl
+	}
+
+	query := target.Query()
+	changed := false
+	for key, value := range map[string]string{
+		"utm_source":   tags.Source,
+		"utm_medium":   tags.Medium,
+		"utm_campaign": tags.Campaign,
+	} {
+		if len(value) > 0 && len(query.Get(key)) == 0 {
+			query.Set(key, value)
+			changed = true
+		}
+	}
+
+	if !changed {
+		return targetUrl
+	}
+	target.RawQuery = query.Encode()
+	return target.String()
+}
@@ -0,0 +1,62 @@
+package shortener
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/w32blaster/shortana/db"
+)
+
+func TestTagTarget(t *testing.T) {
+
+	cases := []struct {
+		target   string
+		tags     db.UTM
+		expected string
+	}{
+		{"https://example.com", db.UTM{}, "https://example.com"},
+		{"https://example.com/page", db.UTM{Source: "bot", Medium: "chat"}, "https://example.com/page?utm_medium=chat&utm_source=bot"},
+		{"https://example.com/?utm_source=manual", db.UTM{Source: "bot", Campaign: "spring"}, "https://example.com/?utm_campaign=spring&utm_source=manual"},
+		{"https://example.com/?utm_source=manual", db.UTM{Source: "bot"}, "https://example.com/?utm_source=manual"},
+	}
+
+	for _, c := range cases {
+
+		// When:
+		target := tagTarget(c.target, c.tags)
+
+		// Then:
+		assert.Equal(t, c.expected, target, c.target)
+	}
+}
+
+func TestUTMWithDefaults(t *testing.T) {
+
+	// When:
+	tags := db.UTM{Campaign: "spring"}.WithDefaults(db.UTM{Source: "shortana", Campaign: "default"})
+
+	// Then:
+	assert.Equal(t, db.UTM{Source: "shortana", Campaign: "spring"}, tags)
+}
+
+func TestRedirectWithUTMTags(t *testing.T) {
+
+	// Given:
+	_, database := newTestAPI(t)
+	assert.Nil(t, database.SaveShortUrlObject(&db.ShortURL{
+		ShortUrl:    "promo",
+		TargetUrl:   "https://example.com/sale?utm_medium=banner",
+		Passthrough: true,
+		UTM:         db.UTM{Source: "newsletter", Medium: "email"},
+	}))
+	cfg := testConfig
+	cfg.DefaultUTM = db.UTM{Source: "shortana", Campaign: "global"}
+	redirector := newTestRedirectorWithConfig(database, cfg)
+
+	// When:
+	resp := doRequest(redirector, http.MethodGet, "/promo?utm_source=twitter", "", "")
+
+	// Then:
+	assert.Equal(t, "https://example.com/sale?utm_campaign=global&utm_medium=banner&utm_source=twitter", resp.Header().Get("Location"))
+}
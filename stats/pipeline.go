@@ -0,0 +1,121 @@
+package stats
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/w32blaster/shortana/db"
+)
+
+// pipeline is the bounded queue of views with the pool of workers that save them in batches
+type pipeline struct {
+	dropped   uint64 // views that didn't fit into the queue, atomic; the first field to be aligned on 32-bit platforms
+	queue     chan db.OneViewStatistic
+	batchSize int
+	interval  time.Duration // a batch that is not full is saved after this time anyway
+	mu        sync.RWMutex  // guards the closed flag, so nothing is sent to the closed queue
+	closed    bool
+	workers   sync.WaitGroup
+}
+
+// Start runs workers that save views in the background. A redirect never waits for the database: if the queue
+// of the given size is full, the view is dropped and counted, see Dropped. Every worker saves up to batchSize
+// views in one transaction
+func (s *Statistics) Start(workers, queueSize, batchSize int) {
+	p := &pipeline{
+		queue:     make(chan db.OneViewStatistic, queueSize),
+		batchSize: batchSize,
+		interval:  time.Second,
+	}
+	for i := 0; i < workers; i++ {
+		p.workers.Add(1)
+		go s.work(p)
+	}
+	s.pipeline = p
+}
+
+// Stop stops accepting views and waits until all the queued views are saved. Views that come
+// after Stop are saved immediately, as if the pipeline was never started
+func (s *Statistics) Stop() {
+	p := s.pipeline
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.queue)
+	}
+	p.mu.Unlock()
+
+	p.workers.Wait()
+	if dropped := s.Dropped(); dropped > 0 {
+		log.Printf("%d views were dropped because the queue was full", dropped)
+	}
+}
+
+// Dropped returns the number of views that were lost, because the queue was full
+func (s *Statistics) Dropped() uint64 {
+	if s.pipeline == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&s.pipeline.dropped)
+}
+
+// enqueue returns FALSE if the pipeline doesn't work, so the view must be saved by the caller
+func (s *Statistics) enqueue(view db.OneViewStatistic) bool {
+	p := s.pipeline
+	if p == nil {
+		return false
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return false
+	}
+
+	select {
+	case p.queue <- view:
+	default:
+		if dropped := atomic.AddUint64(&p.dropped, 1); dropped%100 == 1 {
+			log.Printf("The statistics queue is full, %d views are dropped so far", dropped)
+		}
+	}
+	return true
+}
+
+// work collects views into batches until the queue is closed and drained
+func (s *Statistics) work(p *pipeline) {
+	defer p.workers.Done()
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	batch := make([]db.OneViewStatistic, 0, p.batchSize)
+	flush := func() {
+		if len(batch) > 0 {
+			s.save(batch)
+			batch = make([]db.OneViewStatistic, 0, p.batchSize)
+		}
+	}
+
+	for {
+		select {
+		case view, ok := <-p.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, view)
+			if len(batch) >= p.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
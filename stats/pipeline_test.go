@@ -0,0 +1,115 @@
+package stats
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/w32blaster/shortana/db"
+)
+
+func newTestStatistics(t *testing.T) (*Statistics, *db.Database) {
+	dir, err := ioutil.TempDir("", "shortana")
+	assert.Nil(t, err)
+
+	database := db.Init(dir)
+	t.Cleanup(func() {
+		database.Close()
+		os.RemoveAll(dir)
+	})
+	assert.Nil(t, database.SaveShortUrl("yeti", "https://example.com", "", true))
+	return New(database, nil), database
+}
+
+func visit(s *Statistics, ipAddress string) {
+	req := httptest.NewRequest("GET", "/yeti", nil)
+	req.RemoteAddr = ipAddress + ":12345"
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) Firefox/84.0")
+	s.ProcessRequest(req, "yeti", 0, 0)
+}
+
+func TestQueuedViewsAreSavedOnStop(t *testing.T) {
+
+	// Given:
+	statistics, database := newTestStatistics(t)
+	statistics.Start(2, 100, 10)
+
+	// When:
+	for i := 0; i < 25; i++ {
+		visit(statistics, "1.2.3.4")
+	}
+	visit(statistics, "5.6.7.8")
+	statistics.Stop()
+
+	// Then:
+	grouped, err := database.GetAllStatisticsGroupedByURLs(false)
+	assert.Nil(t, err)
+	assert.Equal(t, 26, grouped["yeti"].TotalViews)
+	assert.Equal(t, 2, grouped["yeti"].TotalUniqueUsers)
+	assert.Equal(t, uint64(0), statistics.Dropped())
+}
+
+func TestViewsAreDroppedWhenQueueIsFull(t *testing.T) {
+
+	// Given: the queue is never read, because there are no workers
+	statistics, database := newTestStatistics(t)
+	statistics.Start(0, 2, 10)
+
+	// When:
+	for i := 0; i < 5; i++ {
+		visit(statistics, "1.2.3.4")
+	}
+
+	// Then:
+	assert.Equal(t, uint64(3), statistics.Dropped())
+
+	// and: after Stop views are saved right away
+	statistics.Stop()
+	visit(statistics, "5.6.7.8")
+	grouped, err := database.GetAllStatisticsGroupedByURLs(false)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, grouped["yeti"].TotalViews)
+}
+
+func TestViewIsSavedImmediatelyWithoutPipeline(t *testing.T) {
+
+	// Given:
+	statistics, database := newTestStatistics(t)
+
+	// When:
+	visit(statistics, "1.2.3.4")
+
+	// Then:
+	_, views, err := database.GetStatisticForOneURLOneDay(1, time.Now().UTC(), false)
+	assert.Nil(t, err)
+	if assert.Len(t, views, 1) {
+		assert.Equal(t, "1.2.3.4", views[0].UserIpAddress, "the port is stripped")
+		assert.Equal(t, "Firefox", views[0].Browser)
+		assert.Equal(t, "84", views[0].BrowserVersion)
+		assert.Equal(t, "Windows", views[0].OS)
+		assert.Equal(t, "desktop", views[0].Device)
+		assert.False(t, views[0].IsBot)
+	}
+}
+
+func TestViewFromCrawlerRangeIsBot(t *testing.T) {
+
+	// Given:
+	statistics, database := newTestStatistics(t)
+	assert.Nil(t, statistics.SetCrawlerRanges([]string{"66.249.64.0/19"}))
+
+	// When:
+	visit(statistics, "66.249.66.1")
+
+	// Then:
+	_, views, err := database.GetStatisticForOneURLOneDay(1, time.Now().UTC(), true)
+	assert.Nil(t, err)
+	if assert.Len(t, views, 1) {
+		assert.True(t, views[0].IsBot)
+		assert.Equal(t, "bot", views[0].Device, "even if the User-Agent looks like a browser")
+		assert.Equal(t, "Firefox", views[0].Browser)
+	}
+}
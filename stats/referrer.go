@@ -0,0 +1,50 @@
+package stats
+
+import (
+	"net/url"
+	"strings"
+)
+
+// SetReferrerPolicy sets the hostname of Shortana itself, so that visits from its own pages (for example, after
+// the password form) are counted as direct. The full URL of the referrer is kept only if keepFullURL is TRUE,
+// otherwise only its domain is saved
+func (s *Statistics) SetReferrerPolicy(hostname string, keepFullURL bool) {
+	s.ownDomain = ""
+	if u, err := url.Parse(hostname); err == nil {
+		s.ownDomain = referrerDomain(u)
+	}
+	s.keepFullReferrer = keepFullURL
+}
+
+// parseReferrer returns the domain and the full URL of the page from the Referer header. Both are empty
+// for direct visits, for the pages of Shortana itself and if the header is garbage
+func (s *Statistics) parseReferrer(header string) (string, string) {
+	header = strings.TrimSpace(header)
+	if len(header) == 0 {
+		return "", ""
+	}
+
+	u, err := url.Parse(header)
+	if err != nil || len(u.Hostname()) == 0 {
+		return "", ""
+	}
+
+	domain := referrerDomain(u)
+	if domain == s.ownDomain {
+		return "", ""
+	}
+	if !s.keepFullReferrer {
+		return domain, ""
+	}
+
+	// browsers never send these, but the header can be made up by anyone
+	u.User = nil
+	u.Fragment = ""
+	return domain, u.String()
+}
+
+// referrerDomain returns the host in lower case without port and the "www." prefix,
+// so that www.example.com and example.com are one referrer
+func referrerDomain(u *url.URL) string {
+	return strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+}
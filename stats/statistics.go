@@ -2,15 +2,24 @@ package stats
 
 import (
 	"log"
+	"net"
 	"net/http"
+	"strings"
+	"time"
 
+	"github.com/w32blaster/shortana/clientip"
 	"github.com/w32blaster/shortana/db"
 	"github.com/w32blaster/shortana/geoip"
+	"github.com/w32blaster/shortana/useragent"
 )
 
 type Statistics struct {
-	db    *db.Database
-	geoIP *geoip.GeoIP
+	db               *db.Database
+	geoIP            *geoip.GeoIP
+	crawlerRanges    []*net.IPNet
+	ownDomain        string // visits from this domain are direct, see SetReferrerPolicy
+	keepFullReferrer bool
+	pipeline         *pipeline // nil until Start is called
 }
 
 func New(database *db.Database, geoIPdb *geoip.GeoIP) *Statistics {
@@ -20,29 +29,118 @@ func New(database *db.Database, geoIPdb *geoip.GeoIP) *Statistics {
 	}
 }
 
-func (s Statistics) ProcessRequest(req *http.Request, requestedUrl string) {
+// SetCrawlerRanges sets networks of known crawlers in CIDR notation, for example "66.249.64.0/19".
+// Views from these networks are marked as bots, even if the crawler pretends to be a browser
+func (s *Statistics) SetCrawlerRanges(cidrs []string) error {
+	ranges := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if len(cidr) == 0 {
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		ranges = append(ranges, network)
+	}
+	s.crawlerRanges = ranges
+	return nil
+}
 
-	ipAddress := req.RemoteAddr
+// parseClient parses the User-Agent. Visits of crawlers, link previews and monitoring tools have the bot device class,
+// even if they pretend to be a browser
+func (s *Statistics) parseClient(ipAddress, userAgent string) useragent.Info {
+	client := useragent.Parse(userAgent)
+	if s.isCrawler(ipAddress) {
+		client.Device = useragent.DeviceBot
+	}
+	return client
+}
+
+// IsBot returns TRUE if the request is made by a crawler, link preview or monitoring tool,
+// the same way as the views are marked as bots in the statistics
+func (s *Statistics) IsBot(req *http.Request) bool {
+	return s.parseClient(requestIP(req), req.Header.Get("User-Agent")).Device == useragent.DeviceBot
+}
+
+// requestIP returns the address of the visitor. Normally it is already resolved by the clientip.Resolver middleware,
+// but the port is stripped here as well, so the same visitor is always grouped and GeoIP gets a valid address
+func requestIP(req *http.Request) string {
+	ipAddress := clientip.Normalize(req.RemoteAddr)
 	if len(ipAddress) == 0 {
 		ipAddress = req.RemoteAddr
 	}
+	return ipAddress
+}
 
+// isCrawler returns TRUE if the address belongs to one of the crawler ranges
+func (s *Statistics) isCrawler(ipAddress string) bool {
+	ip := net.ParseIP(ipAddress)
+	if ip == nil {
+		if host, _, err := net.SplitHostPort(ipAddress); err == nil {
+			ip = net.ParseIP(host)
+		}
+	}
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range s.crawlerRanges {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ProcessRequest records one visit. Everything needed is copied from the request right away, because the request
+// can't be used after the handler returns. If the pipeline is started, the view is saved later by a worker,
+// otherwise it is saved immediately. The matchedRule is the number of the redirect rule that chose the target,
+// or zero if it was the default target; the variant is the number of A/B split variant
+func (s *Statistics) ProcessRequest(req *http.Request, requestedUrl string, matchedRule, variant int) {
+
+	ipAddress := requestIP(req)
 	userAgent := req.Header.Get("User-Agent")
+	client := s.parseClient(ipAddress, userAgent)
+	referrerDomain, referrer := s.parseReferrer(req.Referer())
 
-	var countryCode, countryName, city string
-	var err error
+	view := db.OneViewStatistic{
+		UserIpAddress:  ipAddress,
+		ShortUrl:       requestedUrl,
+		UserAgent:      userAgent,
+		ViewTimes:      []time.Time{time.Now().UTC()},
+		MatchedRule:    matchedRule,
+		Variant:        variant,
+		IsBot:          client.Device == useragent.DeviceBot,
+		ReferrerDomain: referrerDomain,
+		Referrer:       referrer,
+		Browser:        client.Browser,
+		BrowserVersion: client.BrowserVersion,
+		OS:             client.OS,
+		Device:         client.Device,
+	}
 
-	if s.geoIP.IsReady() {
-		countryCode, countryName, city, err = s.geoIP.GetGeoStatsForTheIP(ipAddress)
-		if err != nil {
-			log.Println("ERROR! Can't get GeoIP data. Reason: " + err.Error())
+	if !s.enqueue(view) {
+		s.save([]db.OneViewStatistic{view})
+	}
+}
+
+// save adds GeoIP data to the views and saves them in one transaction
+func (s *Statistics) save(views []db.OneViewStatistic) {
+	if s.geoIP != nil && s.geoIP.IsReady() {
+		for i := range views {
+			var err error
+			views[i].CountryCode, views[i].CountryName, views[i].City, err = s.geoIP.GetGeoStatsForTheIP(views[i].UserIpAddress)
+			if err != nil {
+				log.Println("ERROR! Can't get GeoIP data. Reason: " + err.Error())
+			}
 		}
 	} else {
-		log.Println("GeoIP database is not ready yet, so the current view will be saved without GEO data :(")
+		log.Printf("GeoIP database is not ready yet, so %d views will be saved without GEO data :(", len(views))
 	}
 
-	err = s.db.SaveStatisticForOneView(ipAddress, requestedUrl, countryCode, countryName, city, userAgent)
-	if err != nil {
-		log.Println("ERROR cant save stats because: " + err.Error())
+	if err := s.db.SaveStatisticsForViews(views); err != nil {
+		log.Printf("ERROR cant save stats of %d views because: %s", len(views), err.Error())
 	}
 }
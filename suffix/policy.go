@@ -0,0 +1,64 @@
+package suffix
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	defaultMinLength = 1
+	defaultMaxLength = 64
+)
+
+// DefaultReserved are suffixes that clash with the routes of the web server or with files browsers ask for
+var DefaultReserved = []string{"api", "qr", "health", "favicon.ico", "robots.txt"}
+
+// Policy checks suffixes given by users. It is shared by the bot and the web server, so a link
+// created in one place can always be opened and managed in the other one
+type Policy struct {
+	MinLength  int
+	MaxLength  int
+	Reserved   []string // compared ignoring the case
+	IgnoreCase bool     // TRUE means that /Yeti opens the link /yeti and they can't exist together
+}
+
+// NewPolicy returns the policy with default limits, the given reserved words are added to the default ones
+func NewPolicy(reserved []string, ignoreCase bool) Policy {
+	words := append([]string{}, DefaultReserved...)
+	for _, word := range reserved {
+		if word = strings.TrimSpace(word); len(word) > 0 {
+			words = append(words, word)
+		}
+	}
+
+	return Policy{
+		MinLength:  defaultMinLength,
+		MaxLength:  defaultMaxLength,
+		Reserved:   words,
+		IgnoreCase: ignoreCase,
+	}
+}
+
+// Validate returns an error that can be shown to user as it is, if the suffix can't be used
+func (p Policy) Validate(suffix string) error {
+	if len(suffix) < p.MinLength || len(suffix) > p.MaxLength {
+		return fmt.Errorf("the short URL must be from %d to %d characters long", p.MinLength, p.MaxLength)
+	}
+
+	for _, r := range suffix {
+		if !isAllowed(r) {
+			return fmt.Errorf("the short URL can contain only latin letters, digits, '-' and '_', but not '%c'", r)
+		}
+	}
+
+	for _, word := range p.Reserved {
+		if strings.EqualFold(suffix, word) {
+			return fmt.Errorf("the short URL '%s' is reserved", suffix)
+		}
+	}
+	return nil
+}
+
+func isAllowed(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '_'
+}
@@ -0,0 +1,50 @@
+package suffix
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPolicyAcceptsValidSuffixes(t *testing.T) {
+
+	// Given:
+	policy := NewPolicy(nil, false)
+
+	for _, suffix := range []string{"yeti", "BFMV", "brave-otter", "2021_promo", "a"} {
+
+		// When:
+		err := policy.Validate(suffix)
+
+		// Then:
+		assert.Nil(t, err, suffix)
+	}
+}
+
+func TestPolicyRejectsInvalidSuffixes(t *testing.T) {
+
+	// Given:
+	policy := NewPolicy([]string{" admin ", ""}, false)
+
+	cases := map[string]string{
+		"empty":            "",
+		"too long":         strings.Repeat("a", 65),
+		"slash":            "a/b",
+		"space":            "a b",
+		"emoji":            "yeti🎤",
+		"route":            "api",
+		"route upper case": "QR",
+		"file":             "favicon.ico",
+		"configured":       "Admin",
+	}
+
+	for name, suffix := range cases {
+
+		// When:
+		err := policy.Validate(suffix)
+
+		// Then:
+		assert.NotNil(t, err, name)
+	}
+}
@@ -0,0 +1,157 @@
+package suffix
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// generation strategies
+const (
+	StrategyRandom = "random" // base62 of the given length, for example "aZ3kP9"
+	StrategyWords  = "words"  // human-readable pair, for example "brave-otter"
+	StrategyHash   = "hash"   // base62 of the target URL hash, so the same target gives the same suffix
+)
+
+// Strategies are all the supported strategies
+var Strategies = []string{StrategyRandom, StrategyWords, StrategyHash}
+
+const (
+	alphabet      = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	maxAttempts   = 10
+	defaultLength = 6
+)
+
+var (
+	// ErrNoFreeSuffix means that every attempt gave a suffix that is already taken
+	ErrNoFreeSuffix = errors.New("can't generate a free short URL, please try a longer one")
+
+	adjectives = []string{
+		"amber", "bold", "brave", "bright", "calm", "clever", "cosy", "crisp",
+		"curious", "daring", "eager", "fancy", "fast", "fluffy", "gentle", "giant",
+		"golden", "happy", "honest", "humble", "jolly", "keen", "kind", "lively",
+		"lucky", "merry", "mighty", "misty", "modest", "noble", "polite", "proud",
+		"quick", "quiet", "rapid", "rosy", "rusty", "shiny", "silent", "silver",
+		"smart", "snowy", "sunny", "swift", "tidy", "tiny", "vivid", "witty",
+	}
+	nouns = []string{
+		"badger", "beaver", "bison", "camel", "cobra", "comet", "crane", "dingo",
+		"dolphin", "eagle", "falcon", "ferret", "gecko", "heron", "husky", "ibis",
+		"koala", "lemur", "lynx", "magpie", "marmot", "meadow", "moose", "otter",
+		"owl", "panda", "parrot", "pebble", "penguin", "pigeon", "puffin", "rabbit",
+		"raven", "river", "robin", "salmon", "seal", "sparrow", "squid", "tiger",
+		"toucan", "turtle", "walrus", "whale", "willow", "wombat", "yak", "zebra",
+	}
+)
+
+// Generator creates suffixes for new short URLs
+type Generator struct {
+	Strategy string
+	Length   int // for random and hash strategies
+}
+
+// New returns a generator and checks the settings; zero length means the default one
+func New(strategy string, length int) (Generator, error) {
+	if length == 0 {
+		length = defaultLength
+	}
+	if length < 3 || length > 32 {
+		return Generator{}, errors.New("suffix length must be between 3 and 32")
+	}
+
+	for _, known := range Strategies {
+		if strategy == known {
+			return Generator{Strategy: strategy, Length: length}, nil
+		}
+	}
+	return Generator{}, errors.New("suffix strategy must be one of " + strings.Join(Strategies, ", "))
+}
+
+// NeedsTarget returns TRUE if the suffix depends on the target URL, so it can be generated only when the target is known
+func (g Generator) NeedsTarget() bool {
+	return g.Strategy == StrategyHash
+}
+
+// Generate returns a suffix that is not taken yet. The function isTaken is usually a lookup in
+// the database; the database unique index still has to be respected when the link is saved,
+// because someone else may take the same suffix in between
+func (g Generator) Generate(targetUrl string, isTaken func(string) bool) (string, error) {
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		candidate, err := g.candidate(targetUrl, attempt)
+		if err != nil {
+			return "", err
+		}
+		if !isTaken(candidate) {
+			return candidate, nil
+		}
+	}
+	return "", ErrNoFreeSuffix
+}
+
+func (g Generator) candidate(targetUrl string, attempt int) (string, error) {
+	switch g.Strategy {
+	case StrategyWords:
+		adjective, err := randomIndex(len(adjectives))
+		if err != nil {
+			return "", err
+		}
+		noun, err := randomIndex(len(nouns))
+		if err != nil {
+			return "", err
+		}
+
+		// there are not that many pairs, so after a few collisions add a number to them
+		pair := adjectives[adjective] + "-" + nouns[noun]
+		if attempt >= maxAttempts/2 {
+			number, err := randomIndex(100)
+			if err != nil {
+				return "", err
+			}
+			pair += "-" + strconv.Itoa(number)
+		}
+		return pair, nil
+
+	case StrategyHash:
+		// the first attempt is the hash of the target, the next ones are salted with the attempt number
+		content := targetUrl
+		if attempt > 0 {
+			content += "#" + strconv.Itoa(attempt)
+		}
+		sum := sha256.Sum256([]byte(content))
+		return toBase62(new(big.Int).SetBytes(sum[:]), g.Length), nil
+
+	default:
+		var sb strings.Builder
+		for i := 0; i < g.Length; i++ {
+			idx, err := randomIndex(len(alphabet))
+			if err != nil {
+				return "", err
+			}
+			sb.WriteByte(alphabet[idx])
+		}
+		return sb.String(), nil
+	}
+}
+
+// toBase62 takes the last "length" digits of the number in base62
+func toBase62(number *big.Int, length int) string {
+	base := big.NewInt(int64(len(alphabet)))
+	digit := new(big.Int)
+	result := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		number.DivMod(number, base, digit)
+		result[i] = alphabet[digit.Int64()]
+	}
+	return string(result)
+}
+
+func randomIndex(max int) (int, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(max)))
+	if err != nil {
+		return 0, err
+	}
+	return int(n.Int64()), nil
+}
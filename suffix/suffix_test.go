@@ -0,0 +1,93 @@
+package suffix
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func nothingIsTaken(string) bool {
+	return false
+}
+
+func TestNewChecksSettings(t *testing.T) {
+
+	// When:
+	generator, err := New(StrategyRandom, 0)
+	_, errStrategy := New("uuid", 6)
+	_, errLength := New(StrategyHash, 100)
+
+	// Then:
+	assert.Nil(t, err)
+	assert.Equal(t, defaultLength, generator.Length)
+	assert.NotNil(t, errStrategy)
+	assert.NotNil(t, errLength)
+}
+
+func TestGenerateRandom(t *testing.T) {
+
+	// Given:
+	generator, _ := New(StrategyRandom, 8)
+
+	// When:
+	first, errFirst := generator.Generate("https://example.com", nothingIsTaken)
+	second, errSecond := generator.Generate("https://example.com", nothingIsTaken)
+
+	// Then:
+	assert.Nil(t, errFirst)
+	assert.Nil(t, errSecond)
+	assert.Regexp(t, regexp.MustCompile(`^[0-9a-zA-Z]{8}$`), first)
+	assert.NotEqual(t, first, second)
+}
+
+func TestGenerateWords(t *testing.T) {
+
+	// Given:
+	generator, _ := New(StrategyWords, 0)
+
+	// When:
+	pair, err := generator.Generate("https://example.com", nothingIsTaken)
+
+	// Then:
+	assert.Nil(t, err)
+	assert.Regexp(t, regexp.MustCompile(`^[a-z]+-[a-z]+$`), pair)
+	assert.False(t, generator.NeedsTarget())
+}
+
+func TestGenerateHashIsStable(t *testing.T) {
+
+	// Given:
+	generator, _ := New(StrategyHash, 7)
+
+	// When:
+	first, _ := generator.Generate("https://example.com", nothingIsTaken)
+	second, _ := generator.Generate("https://example.com", nothingIsTaken)
+	other, _ := generator.Generate("https://example.org", nothingIsTaken)
+
+	// Then:
+	assert.Len(t, first, 7)
+	assert.Equal(t, first, second)
+	assert.NotEqual(t, first, other)
+	assert.True(t, generator.NeedsTarget())
+}
+
+func TestGenerateSkipsTakenSuffixes(t *testing.T) {
+
+	// Given:
+	generator, _ := New(StrategyHash, 6)
+	taken, _ := generator.Generate("https://example.com", nothingIsTaken)
+
+	// When:
+	suffix, err := generator.Generate("https://example.com", func(s string) bool {
+		return s == taken
+	})
+	_, errAllTaken := generator.Generate("https://example.com", func(string) bool {
+		return true
+	})
+
+	// Then:
+	assert.Nil(t, err)
+	assert.NotEqual(t, taken, suffix)
+	assert.Equal(t, ErrNoFreeSuffix, errAllTaken)
+}
@@ -0,0 +1,132 @@
+package urlcheck
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// BlocklistFile is the name of the optional blocklist in the storage folder
+const BlocklistFile = "blocklist.txt"
+
+// DefaultSchemes are allowed if the checker has no own list
+var DefaultSchemes = []string{"http", "https"}
+
+// Checker validates target URLs before they are saved. The zero value allows http and https
+// links to any host
+type Checker struct {
+	Hostname  string   // our own address, links to it are rejected because they would redirect to themselves
+	Schemes   []string // allowed schemes, DefaultSchemes if empty
+	blocklist []blockRule
+}
+
+// one line of the blocklist: a domain (with all its subdomains) or a pattern with wildcards
+type blockRule struct {
+	line    string
+	domain  string
+	pattern *regexp.Regexp
+}
+
+// New returns the checker for the given hostname. The blocklist is loaded from the storage folder,
+// it is fine if there is no such file
+func New(storagePath, hostname string, schemes []string) (Checker, error) {
+	checker := Checker{
+		Hostname: hostname,
+		Schemes:  schemes,
+	}
+
+	file, err := os.Open(storagePath + "/" + BlocklistFile)
+	if os.IsNotExist(err) {
+		return checker, nil
+	}
+	if err != nil {
+		return checker, err
+	}
+	defer file.Close()
+
+	checker.blocklist, err = parseBlocklist(bufio.NewScanner(file))
+	if err == nil {
+		log.Printf("Loaded %d entries from the %s", len(checker.blocklist), BlocklistFile)
+	}
+	return checker, err
+}
+
+// parseBlocklist reads one entry per line, empty lines and lines starting with # are skipped.
+// An entry with * or / is a pattern for the host and path (example.com/ads/*), otherwise it is a domain
+func parseBlocklist(scanner *bufio.Scanner) ([]blockRule, error) {
+	var rules []blockRule
+	for scanner.Scan() {
+		line := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if !strings.ContainsAny(line, "*/") {
+			rules = append(rules, blockRule{line: line, domain: strings.TrimPrefix(line, ".")})
+			continue
+		}
+
+		pattern := "^" + strings.ReplaceAll(regexp.QuoteMeta(line), `\*`, ".*") + "$"
+		rules = append(rules, blockRule{line: line, pattern: regexp.MustCompile(pattern)})
+	}
+	return rules, scanner.Err()
+}
+
+// Check returns an error that can be shown to user as it is, if the target URL can't be saved
+func (c Checker) Check(target string) error {
+	parsed, err := url.Parse(strings.TrimSpace(target))
+	if err != nil || len(parsed.Scheme) == 0 || len(parsed.Host) == 0 {
+		return errors.New("the target must be a full URL, for example https://example.com")
+	}
+
+	schemes := c.Schemes
+	if len(schemes) == 0 {
+		schemes = DefaultSchemes
+	}
+	if !containsFold(schemes, parsed.Scheme) {
+		return fmt.Errorf("the target URL must start with one of %s", strings.Join(schemes, ":// or ")+"://")
+	}
+
+	host := strings.ToLower(parsed.Hostname())
+	if own, err := url.Parse(c.Hostname); err == nil && len(own.Host) > 0 && strings.EqualFold(own.Hostname(), host) {
+		return fmt.Errorf("the target URL can't lead to %s itself", c.Hostname)
+	}
+
+	for _, rule := range c.blocklist {
+		if rule.matches(host, host+parsed.EscapedPath()) {
+			return fmt.Errorf("the target URL is blocked by the rule '%s'", rule.line)
+		}
+	}
+	return nil
+}
+
+// CheckAll checks every given target and returns the first error
+func (c Checker) CheckAll(targets ...string) error {
+	for _, target := range targets {
+		if err := c.Check(target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r blockRule) matches(host, hostAndPath string) bool {
+	if r.pattern != nil {
+		return r.pattern.MatchString(host) || r.pattern.MatchString(hostAndPath)
+	}
+	return host == r.domain || strings.HasSuffix(host, "."+r.domain)
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+package urlcheck
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestChecker(t *testing.T, blocklist string) Checker {
+	dir, err := ioutil.TempDir("", "shortana-urlcheck")
+	assert.Nil(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	if len(blocklist) > 0 {
+		assert.Nil(t, ioutil.WriteFile(dir+"/"+BlocklistFile, []byte(blocklist), 0600))
+	}
+
+	checker, err := New(dir, "https://sho.rt", nil)
+	assert.Nil(t, err)
+	return checker
+}
+
+func TestCheckAcceptsValidTargets(t *testing.T) {
+
+	// Given:
+	checker := newTestChecker(t, "")
+
+	for _, target := range []string{"https://example.com", "http://example.com/a?b=c", "HTTPS://Example.com/Path"} {
+
+		// When:
+		err := checker.Check(target)
+
+		// Then:
+		assert.Nil(t, err, target)
+	}
+}
+
+func TestCheckRejectsInvalidTargets(t *testing.T) {
+
+	// Given:
+	checker := newTestChecker(t, "")
+
+	cases := map[string]string{
+		"not a URL":      "example.com",
+		"no host":        "https://",
+		"broken":         "http://[::1",
+		"javascript":     "javascript:alert(1)",
+		"ftp":            "ftp://example.com/file",
+		"loop":           "https://sho.rt/yeti",
+		"loop uppercase": "http://SHO.RT/other",
+	}
+
+	for name, target := range cases {
+
+		// When:
+		err := checker.Check(target)
+
+		// Then:
+		assert.NotNil(t, err, name)
+	}
+}
+
+func TestCheckBlocklist(t *testing.T) {
+
+	// Given:
+	checker := newTestChecker(t, "# spam\n\nbad.com\n  Example.org/ads/*  \n*.tk\n")
+
+	cases := map[string]bool{
+		"https://bad.com":                true,
+		"https://www.bad.com/page":       true,
+		"https://notbad.com":             false,
+		"https://example.org/ads/1":      true,
+		"https://example.org/articles":   false,
+		"https://free.tk":                true,
+		"https://free.tk/page":           true,
+		"https://example.com/bad.com":    false,
+		"https://example.com/?u=bad.com": false,
+	}
+
+	for target, isBlocked := range cases {
+
+		// When:
+		err := checker.Check(target)
+
+		// Then:
+		assert.Equal(t, isBlocked, err != nil, target)
+	}
+}
+
+func TestZeroCheckerAllowsHttp(t *testing.T) {
+
+	// When:
+	err := Checker{}.CheckAll("https://example.com", "http://example.org")
+	errScheme := Checker{}.CheckAll("https://example.com", "mailto:me@example.org")
+
+	// Then:
+	assert.Nil(t, err)
+	assert.NotNil(t, errScheme)
+}
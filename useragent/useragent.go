@@ -0,0 +1,178 @@
+package useragent
+
+import (
+	"strings"
+)
+
+// device classes
+const (
+	DeviceDesktop = "desktop"
+	DeviceMobile  = "mobile"
+	DeviceTablet  = "tablet"
+	DeviceBot     = "bot"
+)
+
+// operating systems
+const (
+	OSiOS          = "iOS"
+	OSAndroid      = "Android"
+	OSWindows      = "Windows"
+	OSWindowsPhone = "Windows Phone"
+	OSMacOS        = "macOS"
+	OSChromeOS     = "Chrome OS"
+	OSLinux        = "Linux"
+	Other          = "Other"
+)
+
+var (
+	// Devices are all the device classes the parser can return
+	Devices = []string{DeviceDesktop, DeviceMobile, DeviceTablet, DeviceBot}
+
+	// OperatingSystems are all the operating systems the parser can return
+	OperatingSystems = []string{OSiOS, OSAndroid, OSWindows, OSWindowsPhone, OSMacOS, OSChromeOS, OSLinux, Other}
+
+	// substrings of User-Agent (in lower case) sent by crawlers, link previews and monitoring tools
+	botMarkers = []string{
+		"bot", "crawler", "spider", "slurp", "facebookexternalhit", "embedly", "preview",
+		"monitor", "uptime", "pingdom", "statuscake", "curl/", "wget/", "python-requests",
+		"go-http-client", "okhttp", "headless", "lighthouse",
+	}
+
+	// browsers in order of detection: many browsers mention others in their User-Agent, for
+	// example Edge contains "Chrome" and "Safari", so the more specific ones go first
+	browsers = []struct {
+		name  string
+		token string
+	}{
+		{"Edge", "Edg/"},
+		{"Edge", "Edge/"},
+		{"Edge", "EdgiOS/"},
+		{"Opera", "OPR/"},
+		{"Opera", "Opera/"},
+		{"Samsung Internet", "SamsungBrowser/"},
+		{"Yandex Browser", "YaBrowser/"},
+		{"Firefox", "FxiOS/"},
+		{"Firefox", "Firefox/"},
+		{"Chrome", "CriOS/"},
+		{"Chrome", "Chrome/"},
+		{"Safari", "Version/"}, // Safari keeps its version here and the WebKit version in "Safari/"
+		{"Internet Explorer", "MSIE "},
+		{"Internet Explorer", "rv:"}, // IE 11 has "Trident/7.0; rv:11.0"
+	}
+)
+
+// Info is the parsed User-Agent
+type Info struct {
+	Browser        string
+	BrowserVersion string // major version only
+	OS             string
+	Device         string
+}
+
+// Parse classifies User-Agent header. It never fails, the unknown values are "Other"
+func Parse(userAgent string) Info {
+	info := Info{
+		Browser: Other,
+		OS:      Other,
+		Device:  DeviceDesktop,
+	}
+
+	if len(strings.TrimSpace(userAgent)) == 0 {
+		info.Device = DeviceBot // real browsers always send User-Agent
+		return info
+	}
+
+	info.OS, info.Device = parseOS(userAgent)
+	info.Browser, info.BrowserVersion = parseBrowser(userAgent)
+
+	if IsBot(userAgent) {
+		info.Device = DeviceBot
+	}
+	return info
+}
+
+// IsBot returns TRUE if the User-Agent belongs to a crawler, link preview or monitoring tool
+func IsBot(userAgent string) bool {
+	lower := strings.ToLower(userAgent)
+	for _, marker := range botMarkers {
+		if strings.Contains(lower, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// CanonicalOS returns the operating system name as the parser returns it, so that user
+// can type "ios" or "chromeos". Returns FALSE if there is no such operating system
+func CanonicalOS(name string) (string, bool) {
+	return canonical(name, OperatingSystems)
+}
+
+// CanonicalDevice returns the device class as the parser returns it. Returns FALSE if there is no such device class
+func CanonicalDevice(name string) (string, bool) {
+	return canonical(name, Devices)
+}
+
+func canonical(name string, values []string) (string, bool) {
+	normalized := normalize(name)
+	for _, value := range values {
+		if normalize(value) == normalized {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+func normalize(name string) string {
+	return strings.ToLower(strings.Replace(name, " ", "", -1))
+}
+
+func parseOS(userAgent string) (string, string) {
+	switch {
+	case strings.Contains(userAgent, "Windows Phone"):
+		return OSWindowsPhone, DeviceMobile
+	case strings.Contains(userAgent, "iPad"):
+		return OSiOS, DeviceTablet
+	case strings.Contains(userAgent, "iPhone") || strings.Contains(userAgent, "iPod"):
+		return OSiOS, DeviceMobile
+	case strings.Contains(userAgent, "Android"):
+		if strings.Contains(userAgent, "Mobile") {
+			return OSAndroid, DeviceMobile
+		}
+		return OSAndroid, DeviceTablet
+	case strings.Contains(userAgent, "CrOS"):
+		return OSChromeOS, DeviceDesktop
+	case strings.Contains(userAgent, "Macintosh") || strings.Contains(userAgent, "Mac OS X"):
+		return OSMacOS, DeviceDesktop
+	case strings.Contains(userAgent, "Windows"):
+		return OSWindows, DeviceDesktop
+	case strings.Contains(userAgent, "Linux") || strings.Contains(userAgent, "X11"):
+		return OSLinux, DeviceDesktop
+	}
+	return Other, DeviceDesktop
+}
+
+func parseBrowser(userAgent string) (string, string) {
+	for _, browser := range browsers {
+		if browser.name == "Safari" && !strings.Contains(userAgent, "Safari/") {
+			continue
+		}
+		if browser.token == "rv:" && !strings.Contains(userAgent, "Trident/") {
+			continue
+		}
+
+		if idx := strings.Index(userAgent, browser.token); idx >= 0 {
+			return browser.name, majorVersion(userAgent[idx+len(browser.token):])
+		}
+	}
+	return Other, ""
+}
+
+// majorVersion takes leading digits, for example "87.0.4280.88 Safari" gives "87"
+func majorVersion(s string) string {
+	end := 0
+	for end < len(s) && s[end] >= '0' && s[end] <= '9' {
+		end++
+	}
+	return s[:end]
+}
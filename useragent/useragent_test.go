@@ -0,0 +1,102 @@
+package useragent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRealUserAgents(t *testing.T) {
+
+	cases := []struct {
+		userAgent string
+		expected  Info
+	}{
+		{
+			"Mozilla/5.0 (iPhone; CPU iPhone OS 14_2 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/14.0.1 Mobile/15E148 Safari/604.1",
+			Info{Browser: "Safari", BrowserVersion: "14", OS: OSiOS, Device: DeviceMobile},
+		},
+		{
+			"Mozilla/5.0 (iPad; CPU OS 14_2 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) CriOS/87.0.4280.77 Mobile/15E148 Safari/604.1",
+			Info{Browser: "Chrome", BrowserVersion: "87", OS: OSiOS, Device: DeviceTablet},
+		},
+		{
+			"Mozilla/5.0 (Linux; Android 10; SM-G973F) AppleWebKit/537.36 (KHTML, like Gecko) SamsungBrowser/13.0 Chrome/83.0.4103.106 Mobile Safari/537.36",
+			Info{Browser: "Samsung Internet", BrowserVersion: "13", OS: OSAndroid, Device: DeviceMobile},
+		},
+		{
+			"Mozilla/5.0 (Linux; Android 9; SM-T820) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/87.0.4280.66 Safari/537.36",
+			Info{Browser: "Chrome", BrowserVersion: "87", OS: OSAndroid, Device: DeviceTablet},
+		},
+		{
+			"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/87.0.4280.88 Safari/537.36 Edg/87.0.664.60",
+			Info{Browser: "Edge", BrowserVersion: "87", OS: OSWindows, Device: DeviceDesktop},
+		},
+		{
+			"Mozilla/5.0 (Macintosh; Intel Mac OS X 10.15; rv:83.0) Gecko/20100101 Firefox/83.0",
+			Info{Browser: "Firefox", BrowserVersion: "83", OS: OSMacOS, Device: DeviceDesktop},
+		},
+		{
+			"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/87.0.4280.88 Safari/537.36 OPR/73.0.3856.284",
+			Info{Browser: "Opera", BrowserVersion: "73", OS: OSLinux, Device: DeviceDesktop},
+		},
+		{
+			"Mozilla/5.0 (X11; CrOS x86_64 13421.99.0) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/86.0.4240.198 Safari/537.36",
+			Info{Browser: "Chrome", BrowserVersion: "86", OS: OSChromeOS, Device: DeviceDesktop},
+		},
+		{
+			"Mozilla/5.0 (Windows NT 6.1; WOW64; Trident/7.0; rv:11.0) like Gecko",
+			Info{Browser: "Internet Explorer", BrowserVersion: "11", OS: OSWindows, Device: DeviceDesktop},
+		},
+		{
+			"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			Info{Browser: Other, OS: Other, Device: DeviceBot},
+		},
+		{
+			"Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)",
+			Info{Browser: Other, OS: Other, Device: DeviceBot},
+		},
+		{
+			"curl/7.64.1",
+			Info{Browser: Other, OS: Other, Device: DeviceBot},
+		},
+		{
+			"",
+			Info{Browser: Other, OS: Other, Device: DeviceBot},
+		},
+	}
+
+	for _, c := range cases {
+
+		// When:
+		info := Parse(c.userAgent)
+
+		// Then:
+		assert.Equal(t, c.expected, info, c.userAgent)
+	}
+}
+
+func TestIsBot(t *testing.T) {
+	assert.True(t, IsBot("Twitterbot/1.0"))
+	assert.True(t, IsBot("facebookexternalhit/1.1 (+http://www.facebook.com/externalhit_uatext.php)"))
+	assert.True(t, IsBot("Mozilla/5.0+(compatible; UptimeRobot/2.0; http://www.uptimerobot.com/)"))
+	assert.False(t, IsBot("Mozilla/5.0 (Macintosh; Intel Mac OS X 10.15; rv:83.0) Gecko/20100101 Firefox/83.0"))
+}
+
+func TestCanonicalNames(t *testing.T) {
+
+	// When:
+	ios, okIOS := CanonicalOS("ios")
+	chromeOS, okChromeOS := CanonicalOS("chromeos")
+	_, okUnknown := CanonicalOS("beos")
+	mobile, okMobile := CanonicalDevice("Mobile")
+
+	// Then:
+	assert.True(t, okIOS)
+	assert.Equal(t, OSiOS, ios)
+	assert.True(t, okChromeOS)
+	assert.Equal(t, OSChromeOS, chromeOS)
+	assert.False(t, okUnknown)
+	assert.True(t, okMobile)
+	assert.Equal(t, DeviceMobile, mobile)
+}